@@ -19,10 +19,15 @@ import (
 	"time"
 
 	"github.com/maksim-paskal/file-sync/pkg/api"
+	"github.com/maksim-paskal/file-sync/pkg/applied"
 	"github.com/maksim-paskal/file-sync/pkg/certs"
 	"github.com/maksim-paskal/file-sync/pkg/config"
+	"github.com/maksim-paskal/file-sync/pkg/merkle"
 	"github.com/maksim-paskal/file-sync/pkg/metrics"
 	"github.com/maksim-paskal/file-sync/pkg/queue"
+	"github.com/maksim-paskal/file-sync/pkg/resync"
+	"github.com/maksim-paskal/file-sync/pkg/upload"
+	"github.com/maksim-paskal/file-sync/pkg/watcher"
 	"github.com/maksim-paskal/file-sync/pkg/web"
 	logrushooksentry "github.com/maksim-paskal/logrus-hook-sentry"
 	log "github.com/sirupsen/logrus"
@@ -71,6 +76,11 @@ func main() {
 	defer hook.Stop()
 
 	log.Infof("Starting %s...", config.GetVersion())
+
+	for _, warning := range config.ApplyDeprecated() {
+		log.Warn(warning)
+	}
+
 	log.Debug(config.String())
 
 	if err := certs.Init(); err != nil {
@@ -87,11 +97,15 @@ func main() {
 		log.WithError(err).Fatal()
 	}
 
+	if err := applied.Init(); err != nil {
+		log.WithError(err).Fatal()
+	}
+
 	web.Init()
 
-	// for redis
-	queue.OnNewValue = func(message api.Message) {
-		err := api.SendWithRetry(message)
+	queue.OnNewValue = func(message api.Message) error {
+		// queue retries failed messages
+		err := api.Send(message)
 		if err != nil {
 			log.
 				WithError(err).
@@ -99,8 +113,29 @@ func main() {
 				Error("error in api.send")
 			metrics.SendErrorCounter.WithLabelValues(message.Type).Inc()
 		}
+
+		return err
 	}
 
+	if *config.Get().WatchEnabled {
+		watcher.OnNewMessage = func(message api.Message) {
+			metrics.QueueRequestCounter.WithLabelValues(message.Type).Inc()
+
+			merkle.UpdateSource(message)
+
+			// errors are logged in queue.Send
+			_, _ = queue.Send(message, web.GetSyncAddress())
+		}
+
+		if err := watcher.Start(ctx); err != nil {
+			log.WithError(err).Fatal()
+		}
+	}
+
+	resync.Schedule(ctx, web.GetSyncAddress())
+	merkle.Schedule(ctx, web.GetSyncAddress())
+	upload.Schedule(ctx)
+
 	web.StartServer()
 
 	<-ctx.Done()
@@ -25,11 +25,9 @@ import (
 	"io/ioutil"
 	"net/http"
 	"os"
-	"path"
 	"path/filepath"
 	"regexp"
 	"strings"
-	"time"
 
 	"github.com/maksim-paskal/file-sync/pkg/certs"
 	"github.com/maksim-paskal/file-sync/pkg/config"
@@ -46,8 +44,21 @@ const (
 	MessageTypeCopy   = "copy"
 	MessageTypeMove   = "move"
 	defaultFileMode1  = fs.FileMode(0o777)
-	defaultFileMode2  = fs.FileMode(0o600)
 	defaultFileMode3  = fs.FileMode(0o644)
+
+	// directory operations, delete, copy and move are recursive
+	MessageTypeMkdir     = "mkdir"
+	MessageTypeDeleteDir = "rmdir"
+	MessageTypeCopyDir   = "copydir"
+	MessageTypeMoveDir   = "movedir"
+
+	// HeaderMessage holds base64 encoded message json when content is sent as raw stream.
+	HeaderMessage     = "X-File-Sync-Message"
+	ContentTypeJSON   = "application/json"
+	ContentTypeStream = "application/octet-stream"
+
+	// StatusSHA256Failed returned when received content does not match message SHA256.
+	StatusSHA256Failed = http.StatusUnprocessableEntity
 )
 
 type Message struct {
@@ -60,6 +71,18 @@ type Message struct {
 	FileContent       string `json:"fileContent"`
 	FileContentBase64 string `json:"fileContentBase64"`
 	SHA256            string `json:"sha256"`
+	// file content is not in message, it will be streamed from SourceDir
+	Stream bool `json:"stream"`
+	// source file metadata, applied on destination by sync.preserve
+	Mode    uint32 `json:"mode,omitempty"`
+	DirMode uint32 `json:"dirMode,omitempty"`
+	ModTime int64  `json:"modTime,omitempty"`
+	UID     *int   `json:"uid,omitempty"`
+	GID     *int   `json:"gid,omitempty"`
+	// content of patch is delta to destination file
+	Delta *Delta `json:"delta,omitempty"`
+	// content was uploaded in chunks, message commits upload with this id
+	Upload string `json:"upload,omitempty"`
 }
 
 func (m *Message) String() string {
@@ -71,6 +94,8 @@ type Response struct {
 	FileName   string `json:"fileName"`
 	StatusCode int    `json:"statusCode"`
 	StatusText string `json:"statusText"`
+	// SHA256 of file on destination after put, patch or copy
+	SHA256 string `json:"sha256,omitempty"`
 }
 
 var client *http.Client
@@ -110,38 +135,70 @@ func Init() error {
 	return nil
 }
 
-func makeCopy(message Message) error {
-	message.FileName = path.Join(*config.Get().DestinationDir, message.FileName)
-	message.NewFileName = path.Join(*config.Get().DestinationDir, message.NewFileName)
+func makeCopy(message Message) (string, error) {
+	var err error
+
+	if message.FileName, err = getDestinationPath(message.FileName); err != nil {
+		return "", err
+	}
+
+	if message.NewFileName, err = getDestinationPath(message.NewFileName); err != nil {
+		return "", err
+	}
 
 	sourceFileStat, err := os.Stat(message.FileName)
 	if err != nil {
-		return errors.Wrap(err, "error in os.Stat")
+		return "", errors.Wrap(err, "error in os.Stat")
 	}
 
 	if !sourceFileStat.Mode().IsRegular() {
-		return fmt.Errorf("%s is not a regular file", message.FileName)
+		return "", fmt.Errorf("%s is not a regular file", message.FileName)
 	}
 
-	source, err := os.Open(message.FileName)
+	return copyFile(message.FileName, message.NewFileName, nil)
+}
+
+// copyFile copies regular file atomically, metadata is applied to copy if it is not nil.
+func copyFile(sourcePath, targetPath string, metadata *Message) (string, error) {
+	source, err := os.Open(sourcePath)
 	if err != nil {
-		return errors.Wrap(err, "error in os.Open")
+		return "", errors.Wrap(err, "error in os.Open")
 	}
 	defer source.Close()
 
-	destination, err := os.Create(message.NewFileName)
+	destination, err := newAtomicFile(targetPath)
 	if err != nil {
-		return errors.Wrap(err, "error in os.Create")
+		return "", errors.Wrap(err, "error in newAtomicFile")
 	}
-	defer destination.Close()
+	defer destination.Abort()
+
+	if metadata != nil {
+		destination.SetMetadata(*metadata)
+	}
+
 	_, err = io.Copy(destination, source)
+	if err != nil {
+		return "", errors.Wrap(err, "error in io.Copy")
+	}
 
-	return errors.Wrap(err, "error in io.Copy")
+	err = destination.Commit()
+	if err != nil {
+		return "", errors.Wrap(err, "error in destination.Commit")
+	}
+
+	return destination.SHA256(), nil
 }
 
 func makeMove(message Message) error {
-	message.FileName = path.Join(*config.Get().DestinationDir, message.FileName)
-	message.NewFileName = path.Join(*config.Get().DestinationDir, message.NewFileName)
+	var err error
+
+	if message.FileName, err = getDestinationPath(message.FileName); err != nil {
+		return err
+	}
+
+	if message.NewFileName, err = getDestinationPath(message.NewFileName); err != nil {
+		return err
+	}
 
 	if _, err := os.Stat(message.FileName); os.IsNotExist(err) {
 		return errors.Wrapf(err, "%s not exists", message.FileName)
@@ -149,7 +206,7 @@ func makeMove(message Message) error {
 
 	fileDir := filepath.Dir(message.NewFileName)
 
-	err := os.MkdirAll(fileDir, defaultFileMode1)
+	err = os.MkdirAll(fileDir, defaultFileMode1)
 	if err != nil {
 		return errors.Wrap(err, "error in os.MkdirAll")
 	}
@@ -165,13 +222,17 @@ func makeMove(message Message) error {
 }
 
 func makeDelete(message Message) error {
-	message.FileName = path.Join(*config.Get().DestinationDir, message.FileName)
+	var err error
+
+	if message.FileName, err = getDestinationPath(message.FileName); err != nil {
+		return err
+	}
 
 	if _, err := os.Stat(message.FileName); os.IsNotExist(err) {
 		return errors.Wrapf(err, "%s not exists", message.FileName)
 	}
 
-	err := os.Remove(message.FileName)
+	err = os.Remove(message.FileName)
 	if err != nil {
 		return errors.Wrap(err, "error in os.Remove")
 	}
@@ -181,14 +242,18 @@ func makeDelete(message Message) error {
 	return nil
 }
 
-func makeSave(message Message) error { //nolint:cyclop
-	message.FileName = path.Join(*config.Get().DestinationDir, message.FileName)
+func makeSave(message Message, content io.Reader) (string, error) { //nolint:cyclop
+	var err error
+
+	if message.FileName, err = getDestinationPath(message.FileName); err != nil {
+		return "", err
+	}
 
 	fileInfo, err := os.Stat(message.FileName)
 	isFileNameNotExists := os.IsNotExist(err)
 
 	if err == nil && fileInfo.IsDir() {
-		return fmt.Errorf("%s is directory", message.FileName)
+		return "", fmt.Errorf("%s is directory", message.FileName)
 	}
 
 	log.Debugf("FileName=%s,isFileNameNotExists=%t", message.FileName, isFileNameNotExists)
@@ -202,7 +267,7 @@ func makeSave(message Message) error { //nolint:cyclop
 					WithField("message", message.String()).
 					Warn()
 			} else {
-				return ErrFileMustNotExists
+				return "", ErrFileMustNotExists
 			}
 		}
 	case MessageTypePatch:
@@ -213,89 +278,92 @@ func makeSave(message Message) error { //nolint:cyclop
 					WithField("message", message.String()).
 					Warn()
 			} else {
-				return ErrFileMustExists
+				return "", ErrFileMustExists
 			}
 		}
 	}
 
-	fileContent := []byte(message.FileContent)
-
-	if len(message.FileContentBase64) > 0 {
-		decoded, err := base64.StdEncoding.DecodeString(message.FileContentBase64)
-		if err != nil {
-			return errors.Wrap(err, "error in base64.StdEncoding.DecodeString")
-		}
-
-		fileContent = decoded
-	}
-
 	fileDir := filepath.Dir(message.FileName)
 
-	err = os.MkdirAll(fileDir, defaultFileMode1)
+	err = os.MkdirAll(fileDir, getDirMode(message))
 	if err != nil {
-		return errors.Wrap(err, "error in os.MkdirAll")
+		return "", errors.Wrap(err, "error in os.MkdirAll")
 	}
 
-	err = ioutil.WriteFile(message.FileName, fileContent, defaultFileMode2)
+	file, err := newAtomicFile(message.FileName)
 	if err != nil {
-		return errors.Wrap(err, "error in ioutil.WriteFile")
+		return "", errors.Wrap(err, "error in newAtomicFile")
 	}
+	defer file.Abort()
 
-	err = os.Chmod(message.FileName, defaultFileMode3)
+	file.SetMetadata(message)
+
+	_, err = io.Copy(file, content)
 	if err != nil {
-		return errors.Wrap(err, "error in os.Chmod")
+		return "", errors.Wrap(err, "error in io.Copy")
 	}
 
-	if len(message.SHA256) != 0 {
-		data, err := ioutil.ReadFile(message.FileName)
-		if err != nil {
-			return errors.Wrap(err, "error in ioutil.ReadFile")
+	if len(message.SHA256) != 0 && message.SHA256 != file.SHA256() {
+		// in strict mode temporary file will be removed, original file will not be changed
+		if *config.Get().SyncStrictSHA256 {
+			return "", ErrSHA256Failed
 		}
 
-		if message.SHA256 != utils.NewSHA256(data) {
-			log.
-				WithError(ErrSHA256Failed).
-				WithField("message", message.String()).
-				Warn()
-		}
+		log.
+			WithError(ErrSHA256Failed).
+			WithField("message", message.String()).
+			Warn()
+	}
+
+	err = file.Commit()
+	if err != nil {
+		return "", errors.Wrap(err, "error in file.Commit")
 	}
 
 	log.Infof("%s file %s", message.Type, message.FileName)
 
-	return nil
+	return file.SHA256(), nil
 }
 
-func SendWithRetry(message Message) error {
-	var err error
+// Send makes one attempt to deliver message to destination.
+func Send(message Message) error {
+	results, err := send(message)
+	if err == nil {
+		err = checkResponse(message, results)
+	}
 
-	var (
-		results  = Response{}
-		tryCount = 0
-	)
+	if err == nil || !IsRetryable(err) {
+		return err
+	}
 
-	for {
-		results, err = send(message)
-		if err == nil {
-			break
-		}
+	log.WithField("message", message.String()).WithError(err).Error()
 
-		log.WithField("message", message.String()).WithError(err).Error()
+	if errors.Is(err, ErrSHA256Failed) {
+		metrics.SendSHA256Errors.Inc()
+	} else {
 		metrics.SendCommunicationErrors.Inc()
+	}
 
-		// retry if send operation has communication errors
-		tryCount++
-		if tryCount >= *config.Get().SyncRetryCount {
-			metrics.QueueMaxRetryCountCounter.WithLabelValues(message.Type).Inc()
-			log.WithField("message", message.String()).WithError(err).Warn("reachout try count")
-
-			return err
-		}
+	return err
+}
 
-		time.Sleep(*config.Get().SyncRetryTimeout)
+// checkResponse returns error if destination failed to process message,
+// in strict mode also checks that destination received the same content.
+func checkResponse(message Message, results Response) error {
+	if results.StatusCode == StatusSHA256Failed {
+		return errors.Wrapf(ErrSHA256Failed, "destination=%s", message.Destination)
 	}
 
 	if results.StatusCode != http.StatusOK {
-		return errors.New(results.StatusText)
+		return &ResponseError{StatusCode: results.StatusCode, StatusText: results.StatusText}
+	}
+
+	if !*config.Get().SyncStrictSHA256 || len(message.SHA256) == 0 || len(results.SHA256) == 0 {
+		return nil
+	}
+
+	if message.SHA256 != results.SHA256 {
+		return errors.Wrapf(ErrSHA256Failed, "destination=%s,sha256=%s", message.Destination, results.SHA256)
 	}
 
 	return nil
@@ -304,21 +372,39 @@ func SendWithRetry(message Message) error {
 func send(message Message) (Response, error) {
 	ctx := context.Background()
 
-	results := Response{}
+	url := fmt.Sprintf("https://%s/api/sync", message.Destination)
 
-	jsonStr, err := json.Marshal(message)
-	if err != nil {
-		return results, errors.Wrap(err, "error in json.Marshal")
+	if isDelta(message) {
+		results, err := sendDelta(ctx, url, message)
+		if !errors.Is(err, errDeltaNotApplied) {
+			return results, err
+		}
+
+		metrics.SendDeltaCounter.WithLabelValues("fallback").Inc()
+
+		log.WithField("message", message.String()).WithError(err).Warn("sending full content")
 	}
 
-	url := fmt.Sprintf("https://%s/api/sync", message.Destination)
+	if isChunked(message) {
+		results, err := sendChunked(ctx, url, message)
+		if !errors.Is(err, errUploadNotSupported) {
+			return results, err
+		}
 
-	req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewBuffer(jsonStr))
+		log.WithField("message", message.String()).WithError(err).Warn("sending content in one request")
+	}
+
+	req, err := newSyncRequest(ctx, url, message)
 	if err != nil {
-		return results, errors.Wrap(err, "error in http.NewRequestWithContext")
+		return Response{}, err
 	}
 
-	req.Header.Set("Content-Type", "application/json")
+	return doSyncRequest(req, url, message)
+}
+
+// doSyncRequest makes request to /api/sync and decodes response.
+func doSyncRequest(req *http.Request, url string, message Message) (Response, error) {
+	results := Response{}
 
 	resp, err := client.Do(req)
 	if err != nil {
@@ -332,7 +418,7 @@ func send(message Message) (Response, error) {
 	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK {
-		return results, errors.New("status != 200")
+		return results, errors.Errorf("%s returned status %d", url, resp.StatusCode)
 	}
 
 	// Dump response
@@ -355,71 +441,312 @@ func send(message Message) (Response, error) {
 	return results, nil
 }
 
-func GetMessageFromValue(value string) (Message, error) {
+// GetJSON makes GET request to destination and decodes json response.
+func GetJSON(ctx context.Context, destination string, uri string, result interface{}) error {
+	return requestJSON(ctx, http.MethodGet, destination, uri, nil, result)
+}
+
+// requestJSON makes request to destination with json body and decodes json response.
+func requestJSON(ctx context.Context, method, destination, uri string, value, result interface{}) error {
+	url := fmt.Sprintf("https://%s%s", destination, uri)
+
+	var body io.Reader
+
+	if value != nil {
+		jsonStr, err := json.Marshal(value)
+		if err != nil {
+			return errors.Wrap(err, "error in json.Marshal")
+		}
+
+		body = bytes.NewReader(jsonStr)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, url, body)
+	if err != nil {
+		return errors.Wrap(err, "error in http.NewRequestWithContext")
+	}
+
+	if body != nil {
+		req.Header.Set("Content-Type", ContentTypeJSON)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return errors.Wrap(err, "error in client.Do")
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return &statusError{url: url, statusCode: resp.StatusCode}
+	}
+
+	if err := json.NewDecoder(resp.Body).Decode(result); err != nil {
+		return errors.Wrap(err, "error in json.Decode")
+	}
+
+	return nil
+}
+
+func newSyncRequest(ctx context.Context, url string, message Message) (*http.Request, error) {
+	if message.Stream {
+		return newStreamRequest(ctx, url, message)
+	}
+
+	// content of committed upload is on destination
+	if len(message.Upload) == 0 && (message.Type == MessageTypePut || message.Type == MessageTypePatch) {
+		if encoding := getEncoding(ctx, message, getMessageContentSize(message)); len(encoding) > 0 {
+			return newContentRequest(ctx, url, message, encoding)
+		}
+	}
+
+	jsonStr, err := json.Marshal(message)
+	if err != nil {
+		return nil, errors.Wrap(err, "error in json.Marshal")
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewBuffer(jsonStr))
+	if err != nil {
+		return nil, errors.Wrap(err, "error in http.NewRequestWithContext")
+	}
+
+	req.Header.Set("Content-Type", ContentTypeJSON)
+
+	return req, nil
+}
+
+// newStreamRequest sends message in header and file content as request body.
+func newStreamRequest(ctx context.Context, url string, message Message) (*http.Request, error) {
+	filePath, err := getSourcePath(message.FileName)
+	if err != nil {
+		return nil, err
+	}
+
+	fileInfo, err := os.Stat(filePath)
+	if err != nil {
+		return nil, errors.Wrap(err, "error in os.Stat")
+	}
+
+	jsonStr, err := json.Marshal(message)
+	if err != nil {
+		return nil, errors.Wrap(err, "error in json.Marshal")
+	}
+
+	file, err := os.Open(filePath)
+	if err != nil {
+		return nil, errors.Wrap(err, "error in os.Open")
+	}
+
+	// body will be closed by client.Do
+	req, err := http.NewRequestWithContext(ctx, "POST", url, file)
+	if err != nil {
+		file.Close()
+
+		return nil, errors.Wrap(err, "error in http.NewRequestWithContext")
+	}
+
+	req.ContentLength = fileInfo.Size()
+	req.Header.Set("Content-Type", ContentTypeStream)
+	req.Header.Set(HeaderMessage, base64.StdEncoding.EncodeToString(jsonStr))
+
+	if encoding := getEncoding(ctx, message, fileInfo.Size()); len(encoding) > 0 {
+		compressRequest(req, encoding)
+	}
+
+	return req, nil
+}
+
+// newContentRequest sends message in header and compressed content of message as request body,
+// content is not encoded to base64.
+func newContentRequest(ctx context.Context, url string, message Message, encoding string) (*http.Request, error) {
+	content := getMessageContent(message)
+
+	message.FileContent = ""
+	message.FileContentBase64 = ""
+
+	jsonStr, err := json.Marshal(message)
+	if err != nil {
+		return nil, errors.Wrap(err, "error in json.Marshal")
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", url, content)
+	if err != nil {
+		return nil, errors.Wrap(err, "error in http.NewRequestWithContext")
+	}
+
+	req.Header.Set("Content-Type", ContentTypeStream)
+	req.Header.Set(HeaderMessage, base64.StdEncoding.EncodeToString(jsonStr))
+
+	compressRequest(req, encoding)
+
+	return req, nil
+}
+
+// GetMessageFromHeader returns message from stream request headers.
+func GetMessageFromHeader(header http.Header) (Message, error) {
 	message := Message{}
 
+	value := header.Get(HeaderMessage)
+	if len(value) == 0 {
+		return message, errors.Errorf("no %s header", HeaderMessage)
+	}
+
+	jsonStr, err := base64.StdEncoding.DecodeString(value)
+	if err != nil {
+		return message, errors.Wrap(err, "error in base64.StdEncoding.DecodeString")
+	}
+
+	err = json.Unmarshal(jsonStr, &message)
+	if err != nil {
+		return message, errors.Wrap(err, "error in json.Unmarshal")
+	}
+
+	return message, nil
+}
+
+func GetMessageFromValue(value string) (Message, error) {
 	if len(value) == 0 {
-		return message, errors.New("no value")
+		return Message{}, errors.New("no value")
 	}
 
-	matched, err := regexp.Match(`^(put|patch|delete|copy|move):.+$`, []byte(value))
+	matched, err := regexp.Match(`^(put|patch|delete|copy|move|mkdir|rmdir|copydir|movedir):.+$`, []byte(value))
 	if err != nil {
-		return message, errors.Wrap(err, "error in regexp.Match")
+		return Message{}, errors.Wrap(err, "error in regexp.Match")
 	}
 
 	if !matched {
-		return message, errors.New("value not correct")
+		return Message{}, errors.New("value not correct")
 	}
 
 	dataValues := strings.Split(value, ":")
+	newFileName := ""
+
+	if len(dataValues) > 2 { //nolint:gomnd
+		newFileName = dataValues[2]
+	}
+
+	return NewMessage(dataValues[0], dataValues[1], newFileName)
+}
 
-	message.Type = dataValues[0]
-	message.FileName = dataValues[1]
-	dataValuesLen := len(dataValues)
+// NewMessage creates message, content and metadata of put and patch messages are read from SourceDir.
+func NewMessage(messageType, fileName, newFileName string) (Message, error) {
+	message := Message{
+		Type:        messageType,
+		FileName:    fileName,
+		NewFileName: newFileName,
+	}
 
-	if dataValuesLen > 2 { //nolint:gomnd
-		message.NewFileName = dataValues[2]
+	if message.Type == MessageTypeMkdir {
+		return newMkdirMessage(message)
 	}
 
-	isSrcOperations := message.Type == MessageTypePut || message.Type == MessageTypePatch
+	if message.Type != MessageTypePut && message.Type != MessageTypePatch {
+		return message, nil
+	}
 
-	if isSrcOperations {
-		filePath := path.Join(*config.Get().SourceDir, dataValues[1])
-		fileInfo, err := os.Stat(filePath)
+	filePath, err := getSourcePath(message.FileName)
+	if err != nil {
+		return message, err
+	}
 
-		if os.IsNotExist(err) {
-			return message, fmt.Errorf("file %s not found", filePath)
-		}
+	fileInfo, err := os.Stat(filePath)
+	if os.IsNotExist(err) {
+		return message, errors.Wrap(ErrFileNotFound, filePath)
+	}
 
-		if fileInfo.IsDir() {
-			return message, fmt.Errorf("file %s is directory", filePath)
-		}
+	if err != nil {
+		return message, errors.Wrap(err, "error in os.Stat")
+	}
+
+	if fileInfo.IsDir() {
+		return message, fmt.Errorf("file %s is directory", filePath)
+	}
+
+	dirInfo, err := os.Stat(filepath.Dir(filePath))
+	if err != nil {
+		return message, errors.Wrap(err, "error in os.Stat")
+	}
+
+	setMetadata(&message, fileInfo, dirInfo)
 
-		fileContent, err := ioutil.ReadFile(filePath)
+	// big files will be streamed from SourceDir on send
+	if isStreamSize(message, fileInfo.Size()) {
+		message.Stream = true
+
+		message.SHA256, err = utils.NewSHA256File(filePath)
 		if err != nil {
-			return message, errors.Wrap(err, "error in ioutil.ReadFile")
+			return message, errors.Wrap(err, "error in utils.NewSHA256File")
 		}
 
-		message.SHA256 = utils.NewSHA256(fileContent)
-		message.FileContentBase64 = base64.StdEncoding.EncodeToString(fileContent)
+		return message, nil
 	}
 
+	fileContent, err := ioutil.ReadFile(filePath)
+	if err != nil {
+		return message, errors.Wrap(err, "error in ioutil.ReadFile")
+	}
+
+	message.SHA256 = utils.NewSHA256(fileContent)
+	message.FileContentBase64 = base64.StdEncoding.EncodeToString(fileContent)
+
 	return message, nil
 }
 
+// isStreamSize returns true if content of message must be streamed, patches
+// of big files are streamed to be sent as delta.
+func isStreamSize(message Message, size int64) bool {
+	if streamSize := *config.Get().SyncStreamSize; streamSize > 0 && size >= streamSize {
+		return true
+	}
+
+	deltaSize := *config.Get().SyncDeltaSize
+
+	return message.Type == MessageTypePatch && deltaSize > 0 && size >= deltaSize
+}
+
 func ProcessMessage(message Message) error {
+	_, err := ProcessMessageStream(message, nil)
+
+	return err
+}
+
+// ProcessMessageStream process message, content of put and patch messages
+// is read from body, if body is nil - content will be read from message.
+// Returns SHA256 of written file for put, patch and copy messages.
+func ProcessMessageStream(message Message, body io.Reader) (string, error) {
 	switch message.Type {
-	case MessageTypePut:
-		return makeSave(message)
-	case MessageTypePatch:
-		return makeSave(message)
+	case MessageTypePut, MessageTypePatch:
+		if body == nil {
+			body = getMessageContent(message)
+		}
+
+		if message.Type == MessageTypePatch && message.Delta != nil {
+			return makeDelta(message, body)
+		}
+
+		return makeSave(message, body)
 	case MessageTypeDelete:
-		return makeDelete(message)
+		return "", makeDelete(message)
 	case MessageTypeCopy:
 		return makeCopy(message)
 	case MessageTypeMove:
-		return makeMove(message)
+		return "", makeMove(message)
+	case MessageTypeMkdir:
+		return "", makeMkdir(message)
+	case MessageTypeDeleteDir:
+		return "", makeDeleteDir(message)
+	case MessageTypeCopyDir:
+		return "", makeCopyDir(message)
+	case MessageTypeMoveDir:
+		return "", makeMoveDir(message)
 	default:
-		return fmt.Errorf("unknown type %s", message.Type)
+		return "", fmt.Errorf("unknown type %s", message.Type)
+	}
+}
+
+func getMessageContent(message Message) io.Reader {
+	if len(message.FileContentBase64) > 0 {
+		return base64.NewDecoder(base64.StdEncoding, strings.NewReader(message.FileContentBase64))
 	}
+
+	return strings.NewReader(message.FileContent)
 }
@@ -14,8 +14,15 @@ package api_test
 
 import (
 	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"reflect"
+	"strings"
+	"syscall"
 	"testing"
+	"time"
 
 	"github.com/maksim-paskal/file-sync/pkg/api"
 	"github.com/maksim-paskal/file-sync/pkg/certs"
@@ -107,6 +114,11 @@ func TestGetMessageFromValue(t *testing.T) {
 		t.Fatal(err)
 	}
 
+	// source file metadata
+	for i := 0; i < 2; i++ {
+		tests[i].message = withMetadata(t, tests[i].message)
+	}
+
 	for _, test := range tests {
 		t.Log(test.value)
 
@@ -141,3 +153,335 @@ func TestGetMessageFromValue(t *testing.T) {
 		}
 	}
 }
+
+func withMetadata(t *testing.T, message api.Message) api.Message {
+	t.Helper()
+
+	filePath := filepath.Join(*config.Get().SourceDir, message.FileName)
+
+	fileInfo, err := os.Stat(filePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dirInfo, err := os.Stat(filepath.Dir(filePath))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stat, ok := fileInfo.Sys().(*syscall.Stat_t)
+	if !ok {
+		t.Fatal("no syscall.Stat_t")
+	}
+
+	uid, gid := int(stat.Uid), int(stat.Gid)
+
+	message.Mode = uint32(fileInfo.Mode().Perm())
+	message.DirMode = uint32(dirInfo.Mode().Perm())
+	message.ModTime = fileInfo.ModTime().UnixNano()
+	message.UID = &uid
+	message.GID = &gid
+
+	return message
+}
+
+func TestPreserveMetadata(t *testing.T) {
+	t.Parallel()
+
+	if err := config.Load(); err != nil {
+		t.Fatal(err)
+	}
+
+	modTime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	message := api.Message{
+		Type:        "put",
+		FileName:    "tests/metadata/test.sh",
+		FileContent: "#!/bin/sh",
+		Force:       true,
+		Mode:        0o750,
+		ModTime:     modTime.UnixNano(),
+	}
+
+	if err := api.ProcessMessage(message); err != nil {
+		t.Fatal(err)
+	}
+
+	fileInfo, err := os.Stat(filepath.Join(*config.Get().DestinationDir, message.FileName))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if fileInfo.Mode().Perm() != 0o750 {
+		t.Errorf("mode %s not OK", fileInfo.Mode())
+	}
+
+	if !fileInfo.ModTime().Equal(modTime) {
+		t.Errorf("mtime %s not OK", fileInfo.ModTime())
+	}
+}
+
+func TestAtomicSave(t *testing.T) {
+	t.Parallel()
+
+	if err := config.Load(); err != nil {
+		t.Fatal(err)
+	}
+
+	message := api.Message{
+		Type:        "put",
+		FileName:    "tests/atomic/test.txt",
+		FileContent: "original",
+		Force:       true,
+	}
+
+	if err := api.ProcessMessage(message); err != nil {
+		t.Fatal(err)
+	}
+
+	// broken content must not replace original file
+	message.Type = "patch"
+	message.FileContent = ""
+	message.FileContentBase64 = "!!!"
+
+	if err := api.ProcessMessage(message); err == nil {
+		t.Fatal("must be error")
+	}
+
+	fileDir := filepath.Join(*config.Get().DestinationDir, "tests/atomic")
+
+	fileContent, err := ioutil.ReadFile(filepath.Join(fileDir, "test.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(fileContent) != "original" {
+		t.Fatalf("file content %s not OK", string(fileContent))
+	}
+
+	files, err := ioutil.ReadDir(fileDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, file := range files {
+		if api.IsTempFile(file.Name()) {
+			t.Fatalf("temp file %s must be removed", file.Name())
+		}
+	}
+}
+
+func newSecureJoinRoot(t testing.TB) string {
+	t.Helper()
+
+	root := t.TempDir()
+
+	if err := os.MkdirAll(filepath.Join(root, "dir", "subdir"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.Symlink(os.TempDir(), filepath.Join(root, "outside")); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.Symlink(filepath.Join(root, "dir"), filepath.Join(root, "inside")); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.Symlink("/not-exists", filepath.Join(root, "broken")); err != nil {
+		t.Fatal(err)
+	}
+
+	return root
+}
+
+func TestSecureJoin(t *testing.T) {
+	t.Parallel()
+
+	root := newSecureJoinRoot(t)
+
+	tests := map[string]bool{
+		"test.txt":                true,
+		"dir/subdir/test.txt":     true,
+		"/dir/test.txt":           true,
+		"dir/../test.txt":         true,
+		"inside/test.txt":         true,
+		"":                        false,
+		".":                       false,
+		"dir/..":                  false,
+		"../test.txt":             false,
+		"../../etc/cron.d/x":      false,
+		"dir/../../test.txt":      false,
+		"outside/test.txt":        false,
+		"outside":                 false,
+		"inside/../../test.txt":   false,
+		"broken":                  false,
+		"broken/test.txt":         false,
+		"dir/subdir/../../../etc": false,
+	}
+
+	for name, allowed := range tests {
+		_, err := api.SecureJoin(root, name)
+
+		if allowed && err != nil {
+			t.Errorf("%s must be allowed, got %v", name, err)
+		}
+
+		if !allowed && !errors.Is(err, api.ErrPathNotAllowed) {
+			t.Errorf("%s must not be allowed, got %v", name, err)
+		}
+	}
+}
+
+func FuzzSecureJoin(f *testing.F) {
+	root := newSecureJoinRoot(f)
+
+	realRoot, err := filepath.EvalSymlinks(root)
+	if err != nil {
+		f.Fatal(err)
+	}
+
+	for _, seed := range []string{"test.txt", "../test.txt", "outside/x", "inside/../x", "dir//subdir/./x", "broken/x"} {
+		f.Add(seed)
+	}
+
+	f.Fuzz(func(t *testing.T, name string) {
+		result, err := api.SecureJoin(root, name)
+		if err != nil {
+			return
+		}
+
+		if !strings.HasPrefix(result, root+string(filepath.Separator)) {
+			t.Fatalf("%s is outside of %s", result, root)
+		}
+
+		existingPath := result
+
+		for {
+			if _, err := os.Lstat(existingPath); err == nil {
+				break
+			}
+
+			existingPath = filepath.Dir(existingPath)
+		}
+
+		realPath, err := filepath.EvalSymlinks(existingPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if realPath != realRoot && !strings.HasPrefix(realPath, realRoot+string(filepath.Separator)) {
+			t.Fatalf("%s resolves to %s outside of %s", result, realPath, realRoot)
+		}
+	})
+}
+
+func TestGetManifest(t *testing.T) {
+	t.Parallel()
+
+	if err := config.Load(); err != nil {
+		t.Fatal(err)
+	}
+
+	manifest, err := api.GetManifest(*config.Get().SourceDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := api.ManifestItem{
+		Path:   "tests/test.txt",
+		Size:   4,
+		SHA256: "701df70cc797a5d18f69fbf8fa538b15c5adcc06e51de80b446d465696d6c3b5",
+	}
+
+	for _, item := range manifest {
+		if item.Path == want.Path {
+			if item.Size != want.Size || item.SHA256 != want.SHA256 {
+				t.Fatalf("got=%+v,want=%+v", item, want)
+			}
+
+			return
+		}
+	}
+
+	t.Fatalf("%s not found in manifest", want.Path)
+}
+
+func TestGetManifestNotExists(t *testing.T) {
+	t.Parallel()
+
+	if _, err := api.GetManifest(filepath.Join(t.TempDir(), "not-exists")); !errors.Is(err, api.ErrFileNotFound) {
+		t.Fatalf("must be file not found error, got %v", err)
+	}
+}
+
+func TestDirOperations(t *testing.T) {
+	t.Parallel()
+
+	if err := config.Load(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, fileName := range []string{"tests/dirs/a/b.txt", "tests/dirs/a/c/d.txt"} {
+		if err := api.ProcessMessage(api.Message{Type: "put", FileName: fileName, FileContent: fileName, Force: true}); err != nil { //nolint:lll
+			t.Fatal(err)
+		}
+	}
+
+	for _, value := range []string{
+		"mkdir:tests",
+		"copydir:tests/dirs/a:tests/dirs/copy",
+		"movedir:tests/dirs/copy:tests/dirs/moved/a",
+	} {
+		message, err := api.GetMessageFromValue(value)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := api.ProcessMessage(message); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	destinationDir := *config.Get().DestinationDir
+
+	fileContent, err := ioutil.ReadFile(filepath.Join(destinationDir, "tests/dirs/moved/a/c/d.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(fileContent) != "tests/dirs/a/c/d.txt" {
+		t.Fatalf("file content %s not OK", string(fileContent))
+	}
+
+	if _, err := os.Stat(filepath.Join(destinationDir, "tests/dirs/copy")); !os.IsNotExist(err) {
+		t.Fatalf("moved directory must not exist, got %v", err)
+	}
+
+	if err := api.ProcessMessage(api.Message{Type: "copydir", FileName: "tests/dirs/a", NewFileName: "tests/dirs/a/c/a"}); err == nil { //nolint:lll
+		t.Fatal("directory must not be copied into itself")
+	}
+
+	if err := api.ProcessMessage(api.Message{Type: "movedir", FileName: "tests/dirs/a", NewFileName: "tests/dirs/moved/a"}); err == nil { //nolint:lll
+		t.Fatal("existing directory must not be replaced")
+	}
+
+	// destination root must not be removed
+	for _, fileName := range []string{".", "tests/..", "../data-test"} {
+		if err := api.ProcessMessage(api.Message{Type: "rmdir", FileName: fileName}); !errors.Is(err, api.ErrPathNotAllowed) {
+			t.Fatalf("%s must not be removed, got %v", fileName, err)
+		}
+	}
+
+	if err := api.ProcessMessage(api.Message{Type: "rmdir", FileName: "tests/dirs/a/b.txt"}); err == nil {
+		t.Fatal("file must not be removed with rmdir")
+	}
+
+	if err := api.ProcessMessage(api.Message{Type: "rmdir", FileName: "tests/dirs"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := os.Stat(filepath.Join(destinationDir, "tests/dirs")); !os.IsNotExist(err) {
+		t.Fatalf("directory must be removed, got %v", err)
+	}
+}
@@ -0,0 +1,126 @@
+/*
+Copyright paskal.maksim@gmail.com
+Licensed under the Apache License, Version 2.0 (the "License")
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package api
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"hash"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+const tempFileSuffix = ".file-sync-tmp"
+
+// atomicFile writes content to temporary file in target directory,
+// target will be replaced only on Commit, so readers never see half-written files.
+type atomicFile struct {
+	target    string
+	file      *os.File
+	hash      hash.Hash
+	metadata  *Message
+	committed bool
+}
+
+func newAtomicFile(target string) (*atomicFile, error) {
+	file, err := ioutil.TempFile(filepath.Dir(target), "."+filepath.Base(target)+".*"+tempFileSuffix)
+	if err != nil {
+		return nil, errors.Wrap(err, "error in ioutil.TempFile")
+	}
+
+	return &atomicFile{
+		target: target,
+		file:   file,
+		hash:   sha256.New(),
+	}, nil
+}
+
+// IsTempFile returns true if file is temporary file of unfinished write.
+func IsTempFile(fileName string) bool {
+	return strings.HasSuffix(fileName, tempFileSuffix)
+}
+
+func (f *atomicFile) Write(p []byte) (int, error) {
+	n, err := f.file.Write(p)
+	f.hash.Write(p[:n])
+
+	return n, err //nolint:wrapcheck
+}
+
+// SetMetadata sets source file metadata that will be applied before rename.
+func (f *atomicFile) SetMetadata(message Message) {
+	f.metadata = &message
+}
+
+// SHA256 returns hash of all written data.
+func (f *atomicFile) SHA256() string {
+	return hex.EncodeToString(f.hash.Sum(nil))
+}
+
+// Commit flush data to disk and rename temporary file to target.
+func (f *atomicFile) Commit() error {
+	if err := f.file.Chmod(defaultFileMode3); err != nil {
+		return errors.Wrap(err, "error in file.Chmod")
+	}
+
+	if err := f.file.Sync(); err != nil {
+		return errors.Wrap(err, "error in file.Sync")
+	}
+
+	if err := f.file.Close(); err != nil {
+		return errors.Wrap(err, "error in file.Close")
+	}
+
+	if f.metadata != nil {
+		if err := applyMetadata(f.file.Name(), *f.metadata); err != nil {
+			return errors.Wrap(err, "error in applyMetadata")
+		}
+	}
+
+	if err := os.Rename(f.file.Name(), f.target); err != nil {
+		return errors.Wrap(err, "error in os.Rename")
+	}
+
+	f.committed = true
+
+	return syncDir(filepath.Dir(f.target))
+}
+
+// Abort removes temporary file if it was not committed.
+func (f *atomicFile) Abort() {
+	if f.committed {
+		return
+	}
+
+	_ = f.file.Close()
+	_ = os.Remove(f.file.Name())
+}
+
+// syncDir makes rename durable.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return errors.Wrap(err, "error in os.Open")
+	}
+	defer d.Close()
+
+	if err := d.Sync(); err != nil {
+		return errors.Wrap(err, "error in dir.Sync")
+	}
+
+	return nil
+}
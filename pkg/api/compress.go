@@ -0,0 +1,241 @@
+/*
+Copyright paskal.maksim@gmail.com
+Licensed under the Apache License, Version 2.0 (the "License")
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package api
+
+import (
+	"compress/gzip"
+	"context"
+	"encoding/base64"
+	"io"
+	"net/http"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/maksim-paskal/file-sync/pkg/config"
+	"github.com/maksim-paskal/file-sync/pkg/metrics"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// HeaderContentEncoding holds compression of request body.
+const HeaderContentEncoding = "Content-Encoding"
+
+const (
+	// encodings of destination are requested again after this period.
+	encodingsTTL = 5 * time.Minute
+	// encodings are requested again sooner if request failed, destination can be restarted.
+	encodingsErrorTTL = time.Second
+)
+
+var ErrUnsupportedEncoding = errors.New("unsupported content encoding")
+
+type encoding struct {
+	newWriter func(w io.Writer) (io.WriteCloser, error)
+	newReader func(r io.Reader) (io.ReadCloser, error)
+}
+
+// encodings that can be used to compress sync payloads.
+var encodings = map[string]encoding{
+	"zstd": {
+		newWriter: func(w io.Writer) (io.WriteCloser, error) {
+			return zstd.NewWriter(w)
+		},
+		newReader: func(r io.Reader) (io.ReadCloser, error) {
+			decoder, err := zstd.NewReader(r, zstd.WithDecoderConcurrency(1))
+			if err != nil {
+				return nil, err
+			}
+
+			return decoder.IOReadCloser(), nil
+		},
+	},
+	"gzip": {
+		newWriter: func(w io.Writer) (io.WriteCloser, error) {
+			return gzip.NewWriter(w), nil
+		},
+		newReader: func(r io.Reader) (io.ReadCloser, error) {
+			return gzip.NewReader(r)
+		},
+	},
+}
+
+type destinationEncodings struct {
+	encodings []string
+	expires   time.Time
+}
+
+var (
+	destinationEncodingsMutex sync.Mutex
+	destinationEncodingsCache = make(map[string]destinationEncodings)
+)
+
+// GetEncodings returns encodings that destination can decompress.
+func GetEncodings() []string {
+	result := make([]string, 0, len(encodings))
+
+	for name := range encodings {
+		result = append(result, name)
+	}
+
+	sort.Strings(result)
+
+	return result
+}
+
+// NewDecoder returns reader that decompresses body.
+func NewDecoder(name string, body io.Reader) (io.ReadCloser, error) {
+	value, ok := encodings[name]
+	if !ok {
+		return nil, errors.Wrap(ErrUnsupportedEncoding, name)
+	}
+
+	reader, err := value.newReader(body)
+	if err != nil {
+		return nil, errors.Wrap(err, "error in newReader")
+	}
+
+	return reader, nil
+}
+
+// getDestinationEncodings returns encodings supported by destination,
+// destination that does not support compression returns empty list.
+func getDestinationEncodings(ctx context.Context, destination string) []string {
+	destinationEncodingsMutex.Lock()
+	cached, ok := destinationEncodingsCache[destination]
+	destinationEncodingsMutex.Unlock()
+
+	if ok && time.Now().Before(cached.expires) {
+		return cached.encodings
+	}
+
+	result := make([]string, 0)
+	ttl := encodingsTTL
+
+	if err := GetJSON(ctx, destination, "/api/encodings", &result); err != nil {
+		log.WithError(err).WithField("destination", destination).Warn("payloads will not be compressed")
+
+		result = make([]string, 0)
+
+		// only destination of previous version without compression is not requested for encodingsTTL
+		if !isNotSupported(err) {
+			ttl = encodingsErrorTTL
+		}
+	}
+
+	destinationEncodingsMutex.Lock()
+	destinationEncodingsCache[destination] = destinationEncodings{encodings: result, expires: time.Now().Add(ttl)}
+	destinationEncodingsMutex.Unlock()
+
+	return result
+}
+
+// isCompressed returns true if file has extension of already compressed file.
+func isCompressed(fileName string) bool {
+	extension := strings.ToLower(filepath.Ext(fileName))
+
+	for _, value := range strings.Split(*config.Get().SyncCompressSkip, ",") {
+		if value = strings.ToLower(strings.TrimSpace(value)); len(value) > 0 && value == extension {
+			return true
+		}
+	}
+
+	return false
+}
+
+// getEncoding returns first preferred encoding that destination supports,
+// empty if content of message must be sent without compression.
+func getEncoding(ctx context.Context, message Message, size int64) string {
+	if size < *config.Get().SyncCompressSize || isCompressed(message.FileName) {
+		return ""
+	}
+
+	preferred := strings.Split(*config.Get().SyncCompress, ",")
+	if len(strings.TrimSpace(preferred[0])) == 0 {
+		return ""
+	}
+
+	supported := getDestinationEncodings(ctx, message.Destination)
+
+	for _, name := range preferred {
+		name = strings.TrimSpace(name)
+
+		if _, ok := encodings[name]; !ok {
+			continue
+		}
+
+		for _, value := range supported {
+			if value == name {
+				return name
+			}
+		}
+	}
+
+	return ""
+}
+
+// getMessageContentSize returns size of content that is in message.
+func getMessageContentSize(message Message) int64 {
+	return int64(len(message.FileContent) + base64.StdEncoding.DecodedLen(len(message.FileContentBase64)))
+}
+
+// compressRequest compresses body of request while it is sent.
+func compressRequest(req *http.Request, name string) {
+	body := req.Body
+	pipeReader, pipeWriter := io.Pipe()
+
+	go func() {
+		defer body.Close()
+
+		compressed := &countWriter{w: pipeWriter}
+
+		writer, err := encodings[name].newWriter(compressed)
+		if err != nil {
+			pipeWriter.CloseWithError(err)
+
+			return
+		}
+
+		size, err := io.Copy(writer, body)
+		if err == nil {
+			err = writer.Close()
+		}
+
+		if err == nil && size > compressed.size {
+			metrics.SendCompressSavedBytes.WithLabelValues(name).Add(float64(size - compressed.size))
+		}
+
+		pipeWriter.CloseWithError(err)
+	}()
+
+	// size of compressed body is unknown
+	req.Body = pipeReader
+	req.ContentLength = -1
+	req.GetBody = nil
+	req.Header.Set(HeaderContentEncoding, name)
+}
+
+type countWriter struct {
+	w    io.Writer
+	size int64
+}
+
+func (c *countWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.size += int64(n)
+
+	return n, err //nolint:wrapcheck
+}
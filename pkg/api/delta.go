@@ -0,0 +1,241 @@
+/*
+Copyright paskal.maksim@gmail.com
+Licensed under the Apache License, Version 2.0 (the "License")
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package api
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+
+	"github.com/maksim-paskal/file-sync/pkg/config"
+	"github.com/maksim-paskal/file-sync/pkg/delta"
+	"github.com/maksim-paskal/file-sync/pkg/metrics"
+	"github.com/maksim-paskal/file-sync/pkg/utils"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// StatusDeltaBaseChanged returned when base file of delta is missing or was changed.
+const StatusDeltaBaseChanged = http.StatusConflict
+
+// Delta describes base file on destination, content of patch message is delta to this file.
+type Delta struct {
+	BlockSize  int    `json:"blockSize"`
+	BaseSHA256 string `json:"baseSha256"`
+}
+
+// errDeltaNotApplied returned when patch must be sent with full content.
+var errDeltaNotApplied = errors.New("delta not applied")
+
+// GetSignature returns checksums of blocks of destination file.
+func GetSignature(fileName string) (*delta.Signature, error) {
+	filePath, err := getDestinationPath(fileName)
+	if err != nil {
+		return nil, err
+	}
+
+	file, err := os.Open(filePath)
+	if os.IsNotExist(err) {
+		return nil, errors.Wrap(ErrFileNotFound, filePath)
+	}
+
+	if err != nil {
+		return nil, errors.Wrap(err, "error in os.Open")
+	}
+	defer file.Close()
+
+	fileInfo, err := file.Stat()
+	if err != nil {
+		return nil, errors.Wrap(err, "error in file.Stat")
+	}
+
+	if !fileInfo.Mode().IsRegular() {
+		return nil, fmt.Errorf("%s is not a regular file", filePath)
+	}
+
+	return delta.NewSignature(file, delta.GetBlockSize(fileInfo.Size()))
+}
+
+// makeDelta rebuilds destination file from its blocks and data of delta,
+// file is replaced only if result matches SHA256 from delta.
+func makeDelta(message Message, body io.Reader) (string, error) {
+	var err error
+
+	if message.FileName, err = getDestinationPath(message.FileName); err != nil {
+		return "", err
+	}
+
+	base, err := os.Open(message.FileName)
+	if os.IsNotExist(err) {
+		return "", errors.Wrap(ErrDeltaBaseChanged, message.FileName)
+	}
+
+	if err != nil {
+		return "", errors.Wrap(err, "error in os.Open")
+	}
+	defer base.Close()
+
+	baseInfo, err := base.Stat()
+	if err != nil {
+		return "", errors.Wrap(err, "error in file.Stat")
+	}
+
+	if !baseInfo.Mode().IsRegular() {
+		return "", errors.Wrapf(ErrDeltaBaseChanged, "%s is not a regular file", message.FileName)
+	}
+
+	baseSHA256, err := utils.NewSHA256Reader(base)
+	if err != nil {
+		return "", errors.Wrap(err, "error in utils.NewSHA256Reader")
+	}
+
+	if baseSHA256 != message.Delta.BaseSHA256 {
+		return "", errors.Wrap(ErrDeltaBaseChanged, message.FileName)
+	}
+
+	file, err := newAtomicFile(message.FileName)
+	if err != nil {
+		return "", errors.Wrap(err, "error in newAtomicFile")
+	}
+	defer file.Abort()
+
+	file.SetMetadata(message)
+
+	err = delta.Apply(file, base, baseInfo.Size(), message.Delta.BlockSize, body)
+	if errors.Is(err, delta.ErrChecksum) {
+		return "", errors.Wrap(ErrSHA256Failed, err.Error())
+	}
+
+	if err != nil {
+		return "", errors.Wrap(err, "error in delta.Apply")
+	}
+
+	if len(message.SHA256) != 0 && message.SHA256 != file.SHA256() {
+		// in strict mode temporary file will be removed, original file will not be changed
+		if *config.Get().SyncStrictSHA256 {
+			return "", ErrSHA256Failed
+		}
+
+		log.
+			WithError(ErrSHA256Failed).
+			WithField("message", message.String()).
+			Warn()
+	}
+
+	err = file.Commit()
+	if err != nil {
+		return "", errors.Wrap(err, "error in file.Commit")
+	}
+
+	log.Infof("%s file %s with delta", message.Type, message.FileName)
+
+	return file.SHA256(), nil
+}
+
+// isDelta returns true if patch can be sent as delta, content of message must be in SourceDir.
+func isDelta(message Message) bool {
+	return message.Type == MessageTypePatch && message.Stream && *config.Get().SyncDeltaSize > 0
+}
+
+// sendDelta sends patch as delta to file on destination, returns errDeltaNotApplied
+// if destination file is missing or was changed and full content must be sent.
+func sendDelta(ctx context.Context, syncURL string, message Message) (Response, error) {
+	signature := delta.Signature{}
+
+	uri := "/api/signature?file=" + url.QueryEscape(message.FileName)
+
+	if err := GetJSON(ctx, message.Destination, uri, &signature); err != nil {
+		return Response{}, errors.Wrap(errDeltaNotApplied, err.Error())
+	}
+
+	req, err := newDeltaRequest(ctx, syncURL, message, &signature)
+	if err != nil {
+		return Response{}, err
+	}
+
+	results, err := doSyncRequest(req, syncURL, message)
+	if err != nil {
+		return results, err
+	}
+
+	if results.StatusCode == StatusDeltaBaseChanged || results.StatusCode == StatusSHA256Failed {
+		return results, errors.Wrap(errDeltaNotApplied, results.StatusText)
+	}
+
+	metrics.SendDeltaCounter.WithLabelValues("delta").Inc()
+
+	return results, nil
+}
+
+// newDeltaRequest sends message in header and delta to destination file as request body,
+// delta is calculated while body is sent.
+func newDeltaRequest(ctx context.Context, syncURL string, message Message, signature *delta.Signature) (*http.Request, error) { //nolint:lll
+	filePath, err := getSourcePath(message.FileName)
+	if err != nil {
+		return nil, err
+	}
+
+	message.Delta = &Delta{
+		BlockSize:  signature.BlockSize,
+		BaseSHA256: signature.SHA256,
+	}
+
+	jsonStr, err := json.Marshal(message)
+	if err != nil {
+		return nil, errors.Wrap(err, "error in json.Marshal")
+	}
+
+	file, err := os.Open(filePath)
+	if err != nil {
+		return nil, errors.Wrap(err, "error in os.Open")
+	}
+
+	fileInfo, err := file.Stat()
+	if err != nil {
+		file.Close()
+
+		return nil, errors.Wrap(err, "error in file.Stat")
+	}
+
+	reader, writer := io.Pipe()
+
+	go func() {
+		defer file.Close()
+
+		_, err := delta.Write(writer, file, signature)
+		writer.CloseWithError(err)
+	}()
+
+	// body will be closed by client.Do
+	req, err := http.NewRequestWithContext(ctx, "POST", syncURL, reader)
+	if err != nil {
+		reader.Close()
+
+		return nil, errors.Wrap(err, "error in http.NewRequestWithContext")
+	}
+
+	req.Header.Set("Content-Type", ContentTypeStream)
+	req.Header.Set(HeaderMessage, base64.StdEncoding.EncodeToString(jsonStr))
+
+	// literal data of delta is compressed
+	if encoding := getEncoding(ctx, message, fileInfo.Size()); len(encoding) > 0 {
+		compressRequest(req, encoding)
+	}
+
+	return req, nil
+}
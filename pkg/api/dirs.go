@@ -0,0 +1,228 @@
+/*
+Copyright paskal.maksim@gmail.com
+Licensed under the Apache License, Version 2.0 (the "License")
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package api
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+
+	"github.com/maksim-paskal/file-sync/pkg/config"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// IsDirType returns true if message changes directory with all files in it.
+func IsDirType(messageType string) bool {
+	switch messageType {
+	case MessageTypeMkdir, MessageTypeDeleteDir, MessageTypeCopyDir, MessageTypeMoveDir:
+		return true
+	default:
+		return false
+	}
+}
+
+// newMkdirMessage creates mkdir message, metadata of directory is read from SourceDir.
+func newMkdirMessage(message Message) (Message, error) {
+	dirPath, err := getSourcePath(message.FileName)
+	if err != nil {
+		return message, err
+	}
+
+	dirInfo, err := os.Stat(dirPath)
+	if os.IsNotExist(err) {
+		return message, errors.Wrap(ErrFileNotFound, dirPath)
+	}
+
+	if err != nil {
+		return message, errors.Wrap(err, "error in os.Stat")
+	}
+
+	if !dirInfo.IsDir() {
+		return message, fmt.Errorf("%s is not a directory", dirPath)
+	}
+
+	parentInfo, err := os.Stat(filepath.Dir(dirPath))
+	if err != nil {
+		return message, errors.Wrap(err, "error in os.Stat")
+	}
+
+	setMetadata(&message, dirInfo, parentInfo)
+
+	return message, nil
+}
+
+// getDirPath returns destination path of existing directory.
+func getDirPath(name string) (string, error) {
+	dirPath, err := getDestinationPath(name)
+	if err != nil {
+		return "", err
+	}
+
+	dirInfo, err := os.Lstat(dirPath)
+	if os.IsNotExist(err) {
+		return "", errors.Wrapf(err, "%s not exists", dirPath)
+	}
+
+	if err != nil {
+		return "", errors.Wrap(err, "error in os.Lstat")
+	}
+
+	if !dirInfo.IsDir() {
+		return "", fmt.Errorf("%s is not a directory", dirPath)
+	}
+
+	return dirPath, nil
+}
+
+func makeMkdir(message Message) error {
+	var err error
+
+	if message.FileName, err = getDestinationPath(message.FileName); err != nil {
+		return err
+	}
+
+	if fileInfo, err := os.Stat(message.FileName); err == nil && !fileInfo.IsDir() {
+		return fmt.Errorf("%s is not a directory", message.FileName)
+	}
+
+	if err := os.MkdirAll(message.FileName, getDirMode(message)); err != nil {
+		return errors.Wrap(err, "error in os.MkdirAll")
+	}
+
+	if err := applyMetadata(message.FileName, message); err != nil {
+		return errors.Wrap(err, "error in applyMetadata")
+	}
+
+	log.Infof("%s directory %s", message.Type, message.FileName)
+
+	return nil
+}
+
+func makeDeleteDir(message Message) error {
+	dirPath, err := getDirPath(message.FileName)
+	if err != nil {
+		return err
+	}
+
+	// destination root is also rejected in getDestinationPath, removing it would remove all synced files
+	if filepath.Clean(dirPath) == filepath.Clean(*config.Get().DestinationDir) {
+		return &PathError{Root: *config.Get().DestinationDir, Path: message.FileName}
+	}
+
+	if err := os.RemoveAll(dirPath); err != nil {
+		return errors.Wrap(err, "error in os.RemoveAll")
+	}
+
+	log.Infof("%s directory %s", message.Type, dirPath)
+
+	return nil
+}
+
+func makeCopyDir(message Message) error {
+	source, err := getDirPath(message.FileName)
+	if err != nil {
+		return err
+	}
+
+	target, err := getDestinationPath(message.NewFileName)
+	if err != nil {
+		return err
+	}
+
+	if isSubPath(source, target) {
+		return fmt.Errorf("can not copy %s into itself", source)
+	}
+
+	err = filepath.WalkDir(source, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(source, path)
+		if err != nil {
+			return errors.Wrap(err, "error in filepath.Rel")
+		}
+
+		info, err := entry.Info()
+		if err != nil {
+			return errors.Wrap(err, "error in entry.Info")
+		}
+
+		return copyDirEntry(path, filepath.Join(target, rel), info)
+	})
+	if err != nil {
+		return errors.Wrap(err, "error in filepath.WalkDir")
+	}
+
+	log.Infof("%s directory %s", message.Type, source)
+
+	return nil
+}
+
+// copyDirEntry copies one directory or regular file of directory tree, metadata of files is preserved.
+func copyDirEntry(path, targetPath string, info fs.FileInfo) error {
+	switch {
+	case info.IsDir():
+		if err := os.MkdirAll(targetPath, info.Mode()&fileModeMask); err != nil {
+			return errors.Wrap(err, "error in os.MkdirAll")
+		}
+	case IsTempFile(path):
+		// unfinished writes are not copied
+		return nil
+	case info.Mode().IsRegular():
+		metadata := Message{}
+		setMetadata(&metadata, info, nil)
+
+		if _, err := copyFile(path, targetPath, &metadata); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("%s is not a regular file", path)
+	}
+
+	return nil
+}
+
+func makeMoveDir(message Message) error {
+	source, err := getDirPath(message.FileName)
+	if err != nil {
+		return err
+	}
+
+	target, err := getDestinationPath(message.NewFileName)
+	if err != nil {
+		return err
+	}
+
+	if isSubPath(source, target) {
+		return fmt.Errorf("can not move %s into itself", source)
+	}
+
+	if _, err := os.Lstat(target); err == nil {
+		return fmt.Errorf("%s already exists", target)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(target), getDirMode(message)); err != nil {
+		return errors.Wrap(err, "error in os.MkdirAll")
+	}
+
+	if err := os.Rename(source, target); err != nil {
+		return errors.Wrap(err, "error in os.Rename")
+	}
+
+	log.Infof("%s directory %s", message.Type, source)
+
+	return nil
+}
@@ -12,11 +12,76 @@ limitations under the License.
 */
 package api
 
-import "errors"
+import (
+	"errors"
+	"fmt"
+	"net/http"
+)
 
 var (
 	ErrFileNotFound      = errors.New("file not found")
 	ErrFileMustNotExists = errors.New("file must not exists")
 	ErrFileMustExists    = errors.New("file must exists")
 	ErrSHA256Failed      = errors.New("file SHA256 check failed")
+	ErrPathNotAllowed    = errors.New("path not allowed")
+	// base file of delta is missing or was changed after signature
+	ErrDeltaBaseChanged = errors.New("delta base file changed")
+	// committed upload was removed or some chunks are missing
+	ErrUploadNotFound = errors.New("upload not found")
 )
+
+// PathError returned when file path is outside of allowed root directory.
+type PathError struct {
+	Root string
+	Path string
+}
+
+func (e *PathError) Error() string {
+	return fmt.Sprintf("path %s is outside of %s", e.Path, e.Root)
+}
+
+func (e *PathError) Is(target error) bool {
+	return target == ErrPathNotAllowed
+}
+
+// ResponseError returned when destination could not process message.
+type ResponseError struct {
+	StatusCode int
+	StatusText string
+}
+
+func (e *ResponseError) Error() string {
+	return e.StatusText
+}
+
+// IsRetryable returns false if destination rejected message and new attempt will fail again.
+func IsRetryable(err error) bool {
+	var responseError *ResponseError
+
+	if errors.As(err, &responseError) {
+		return responseError.StatusCode == StatusSHA256Failed || responseError.StatusCode == StatusUploadNotFound
+	}
+
+	return true
+}
+
+// statusError returned when destination responded with unexpected status.
+type statusError struct {
+	url        string
+	statusCode int
+}
+
+func (e *statusError) Error() string {
+	return fmt.Sprintf("%s returned status %d", e.url, e.statusCode)
+}
+
+// isNotSupported returns true if destination does not have route of request, destination runs previous version.
+func isNotSupported(err error) bool {
+	var statusErr *statusError
+
+	if errors.As(err, &statusErr) {
+		return statusErr.statusCode == http.StatusNotFound || statusErr.statusCode == http.StatusMethodNotAllowed
+	}
+
+	return false
+}
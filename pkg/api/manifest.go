@@ -0,0 +1,179 @@
+/*
+Copyright paskal.maksim@gmail.com
+Licensed under the Apache License, Version 2.0 (the "License")
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package api
+
+import (
+	"context"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/maksim-paskal/file-sync/pkg/config"
+	"github.com/maksim-paskal/file-sync/pkg/utils"
+	"github.com/pkg/errors"
+)
+
+type ManifestItem struct {
+	Path    string `json:"path"`
+	Size    int64  `json:"size"`
+	ModTime int64  `json:"modTime"`
+	SHA256  string `json:"sha256"`
+}
+
+type hashCacheItem struct {
+	size    int64
+	modTime int64
+	sha256  string
+}
+
+// hashCache holds SHA256 of files, file hash is calculated again only if size or mtime was changed.
+var hashCache = struct {
+	sync.Mutex
+	items map[string]hashCacheItem
+}{
+	items: make(map[string]hashCacheItem),
+}
+
+// GetFileSHA256 returns SHA256 of file, result is cached by file size and mtime.
+func GetFileSHA256(filePath string, fileInfo fs.FileInfo) (string, error) {
+	hashCache.Lock()
+	item, ok := hashCache.items[filePath]
+	hashCache.Unlock()
+
+	if ok && item.size == fileInfo.Size() && item.modTime == fileInfo.ModTime().UnixNano() {
+		return item.sha256, nil
+	}
+
+	sha256, err := utils.NewSHA256File(filePath)
+	if err != nil {
+		return "", errors.Wrap(err, "error in utils.NewSHA256File")
+	}
+
+	hashCache.Lock()
+	hashCache.items[filePath] = hashCacheItem{
+		size:    fileInfo.Size(),
+		modTime: fileInfo.ModTime().UnixNano(),
+		sha256:  sha256,
+	}
+	hashCache.Unlock()
+
+	return sha256, nil
+}
+
+// ForgetFileSHA256 removes cached hash of file that was deleted or renamed.
+func ForgetFileSHA256(filePath string) {
+	hashCache.Lock()
+	delete(hashCache.items, filePath)
+	hashCache.Unlock()
+}
+
+// pruneHashCache removes cached hashes of files in root that were not found, files were deleted or renamed.
+func pruneHashCache(root string, found map[string]bool) {
+	prefix := filepath.Clean(root) + string(filepath.Separator)
+
+	hashCache.Lock()
+	defer hashCache.Unlock()
+
+	for filePath := range hashCache.items {
+		if strings.HasPrefix(filePath, prefix) && !found[filePath] {
+			delete(hashCache.items, filePath)
+		}
+	}
+}
+
+// GetManifest returns all regular files in root, paths are relative to root,
+// missing root is an error, empty manifest of source would remove all files on destination.
+func GetManifest(root string) ([]ManifestItem, error) {
+	rootInfo, err := os.Stat(root)
+	if os.IsNotExist(err) {
+		return nil, errors.Wrap(ErrFileNotFound, root)
+	}
+
+	if err != nil {
+		return nil, errors.Wrap(err, "error in os.Stat")
+	}
+
+	if !rootInfo.IsDir() {
+		return nil, errors.Errorf("%s is not a directory", root)
+	}
+
+	result := make([]ManifestItem, 0)
+	found := make(map[string]bool)
+
+	err = filepath.WalkDir(root, func(filePath string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if !d.Type().IsRegular() || IsTempFile(d.Name()) {
+			return nil
+		}
+
+		fileInfo, err := d.Info()
+		if err != nil {
+			return errors.Wrap(err, "error in d.Info")
+		}
+
+		fileName, err := filepath.Rel(root, filePath)
+		if err != nil {
+			return errors.Wrap(err, "error in filepath.Rel")
+		}
+
+		sha256, err := GetFileSHA256(filePath, fileInfo)
+		if err != nil {
+			return err
+		}
+
+		found[filePath] = true
+
+		result = append(result, ManifestItem{
+			Path:    filepath.ToSlash(fileName),
+			Size:    fileInfo.Size(),
+			ModTime: fileInfo.ModTime().UnixNano(),
+			SHA256:  sha256,
+		})
+
+		return nil
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "error in filepath.WalkDir")
+	}
+
+	pruneHashCache(root, found)
+
+	return result, nil
+}
+
+// GetDestinationManifest returns manifest of DestinationDir, it is empty if nothing was synced yet.
+func GetDestinationManifest() ([]ManifestItem, error) {
+	root := *config.Get().DestinationDir
+
+	if _, err := os.Stat(root); os.IsNotExist(err) {
+		return make([]ManifestItem, 0), nil
+	}
+
+	return GetManifest(root)
+}
+
+// GetRemoteManifest returns manifest of destination.
+func GetRemoteManifest(ctx context.Context, destination string) ([]ManifestItem, error) {
+	result := make([]ManifestItem, 0)
+
+	if err := GetJSON(ctx, destination, "/api/manifest", &result); err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
@@ -0,0 +1,87 @@
+/*
+Copyright paskal.maksim@gmail.com
+Licensed under the Apache License, Version 2.0 (the "License")
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package api
+
+import (
+	"io/fs"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/maksim-paskal/file-sync/pkg/config"
+	"github.com/pkg/errors"
+)
+
+const (
+	PreserveMode    = "mode"
+	PreserveModTime = "mtime"
+	PreserveOwner   = "owner"
+
+	fileModeMask = fs.ModePerm | fs.ModeSetuid | fs.ModeSetgid | fs.ModeSticky
+)
+
+// isPreserved returns true if attribute is in sync.preserve list.
+func isPreserved(attribute string) bool {
+	for _, value := range strings.Split(*config.Get().SyncPreserve, ",") {
+		if strings.TrimSpace(value) == attribute {
+			return true
+		}
+	}
+
+	return false
+}
+
+// setMetadata fills message with metadata of source file.
+func setMetadata(message *Message, fileInfo fs.FileInfo, dirInfo fs.FileInfo) {
+	message.Mode = uint32(fileInfo.Mode() & fileModeMask)
+	message.ModTime = fileInfo.ModTime().UnixNano()
+	message.UID, message.GID = getFileOwner(fileInfo)
+
+	if dirInfo != nil {
+		message.DirMode = uint32(dirInfo.Mode() & fileModeMask)
+	}
+}
+
+// getDirMode returns mode for new directories on destination.
+func getDirMode(message Message) fs.FileMode {
+	if message.DirMode != 0 && isPreserved(PreserveMode) {
+		return fs.FileMode(message.DirMode)
+	}
+
+	return defaultFileMode1
+}
+
+// applyMetadata sets metadata from message to file, only attributes from sync.preserve are applied.
+func applyMetadata(fileName string, message Message) error {
+	if message.Mode != 0 && isPreserved(PreserveMode) {
+		if err := os.Chmod(fileName, fs.FileMode(message.Mode)); err != nil {
+			return errors.Wrap(err, "error in os.Chmod")
+		}
+	}
+
+	if message.UID != nil && message.GID != nil && isPreserved(PreserveOwner) {
+		if err := os.Lchown(fileName, *message.UID, *message.GID); err != nil {
+			return errors.Wrap(err, "error in os.Lchown")
+		}
+	}
+
+	if message.ModTime != 0 && isPreserved(PreserveModTime) {
+		modTime := time.Unix(0, message.ModTime)
+
+		if err := os.Chtimes(fileName, time.Now(), modTime); err != nil {
+			return errors.Wrap(err, "error in os.Chtimes")
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,32 @@
+//go:build !windows
+// +build !windows
+
+/*
+Copyright paskal.maksim@gmail.com
+Licensed under the Apache License, Version 2.0 (the "License")
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package api
+
+import (
+	"io/fs"
+	"syscall"
+)
+
+func getFileOwner(fileInfo fs.FileInfo) (*int, *int) {
+	stat, ok := fileInfo.Sys().(*syscall.Stat_t)
+	if !ok {
+		return nil, nil
+	}
+
+	uid, gid := int(stat.Uid), int(stat.Gid)
+
+	return &uid, &gid
+}
@@ -0,0 +1,93 @@
+/*
+Copyright paskal.maksim@gmail.com
+Licensed under the Apache License, Version 2.0 (the "License")
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package api
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/maksim-paskal/file-sync/pkg/config"
+	"github.com/pkg/errors"
+)
+
+// SecureJoin joins name to root, returns *PathError if result is root itself
+// or is outside of root, also checks existing part of path for symlinks that point outside of root.
+func SecureJoin(root, name string) (string, error) {
+	pathError := &PathError{Root: root, Path: name}
+
+	if strings.ContainsRune(name, 0) {
+		return "", pathError
+	}
+
+	root = filepath.Clean(root)
+	fullPath := filepath.Join(root, name)
+
+	if !isSubPath(root, fullPath) {
+		return "", pathError
+	}
+
+	realRoot, err := filepath.EvalSymlinks(root)
+	if os.IsNotExist(err) {
+		// nothing exists inside root yet
+		return fullPath, nil
+	}
+
+	if err != nil {
+		return "", errors.Wrap(err, "error in filepath.EvalSymlinks")
+	}
+
+	existingPath := fullPath
+
+	for {
+		if _, err := os.Lstat(existingPath); err == nil {
+			break
+		}
+
+		existingPath = filepath.Dir(existingPath)
+	}
+
+	realPath, err := filepath.EvalSymlinks(existingPath)
+	if err != nil {
+		// broken symlinks can not be checked
+		return "", pathError
+	}
+
+	if realPath != realRoot && !isSubPath(realRoot, realPath) {
+		return "", pathError
+	}
+
+	return fullPath, nil
+}
+
+// isSubPath returns true if fullPath is inside root, both paths must be cleaned.
+func isSubPath(root, fullPath string) bool {
+	rel, err := filepath.Rel(root, fullPath)
+	if err != nil {
+		return false
+	}
+
+	if rel == "." || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return false
+	}
+
+	return !filepath.IsAbs(rel)
+}
+
+func getSourcePath(name string) (string, error) {
+	return SecureJoin(*config.Get().SourceDir, name)
+}
+
+func getDestinationPath(name string) (string, error) {
+	return SecureJoin(*config.Get().DestinationDir, name)
+}
@@ -0,0 +1,268 @@
+/*
+Copyright paskal.maksim@gmail.com
+Licensed under the Apache License, Version 2.0 (the "License")
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package api
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/maksim-paskal/file-sync/pkg/config"
+	"github.com/maksim-paskal/file-sync/pkg/metrics"
+	"github.com/maksim-paskal/file-sync/pkg/upload"
+	"github.com/maksim-paskal/file-sync/pkg/utils"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// HeaderChunkSHA256 holds SHA256 of chunk content.
+	HeaderChunkSHA256 = "X-File-Sync-Chunk-SHA256"
+
+	// StatusUploadNotFound returned when committed upload was removed on destination, upload must be sent again.
+	StatusUploadNotFound = http.StatusGone
+)
+
+// destination without chunked uploads is checked again after this period.
+const uploadNotSupportedTTL = 5 * time.Minute
+
+// errUploadNotSupported returned when destination runs version without chunked uploads.
+var errUploadNotSupported = errors.New("chunked upload not supported")
+
+var (
+	uploadNotSupportedMutex sync.Mutex
+	uploadNotSupported      = make(map[string]time.Time)
+)
+
+// isUploadSupported returns false if destination did not accept chunked upload recently.
+func isUploadSupported(destination string) bool {
+	uploadNotSupportedMutex.Lock()
+	defer uploadNotSupportedMutex.Unlock()
+
+	checked, ok := uploadNotSupported[destination]
+
+	return !ok || time.Since(checked) >= uploadNotSupportedTTL
+}
+
+func setUploadNotSupported(destination string) {
+	uploadNotSupportedMutex.Lock()
+	defer uploadNotSupportedMutex.Unlock()
+
+	uploadNotSupported[destination] = time.Now()
+}
+
+// isChunked returns true if message content must be uploaded in chunks and destination supports chunked uploads,
+// content of streamed files is read from source, other content is in message.
+func isChunked(message Message) bool {
+	chunkSize := *config.Get().SyncChunkSize
+
+	if (message.Type != MessageTypePut && message.Type != MessageTypePatch) || chunkSize <= 0 {
+		return false
+	}
+
+	if !isUploadSupported(message.Destination) {
+		return false
+	}
+
+	if !message.Stream {
+		return getMessageContentSize(message) > chunkSize
+	}
+
+	filePath, err := getSourcePath(message.FileName)
+	if err != nil {
+		return false
+	}
+
+	fileInfo, err := os.Stat(filePath)
+	if err != nil {
+		return false
+	}
+
+	return fileInfo.Size() > chunkSize
+}
+
+// getChunkedContent returns content of message that is uploaded in chunks and its size.
+func getChunkedContent(message Message) (io.ReaderAt, int64, io.Closer, error) {
+	if !message.Stream {
+		content, err := io.ReadAll(getMessageContent(message))
+		if err != nil {
+			return nil, 0, nil, errors.Wrap(err, "error in io.ReadAll")
+		}
+
+		reader := bytes.NewReader(content)
+
+		return reader, reader.Size(), io.NopCloser(reader), nil
+	}
+
+	filePath, err := getSourcePath(message.FileName)
+	if err != nil {
+		return nil, 0, nil, err
+	}
+
+	file, err := os.Open(filePath)
+	if err != nil {
+		return nil, 0, nil, errors.Wrap(err, "error in os.Open")
+	}
+
+	fileInfo, err := file.Stat()
+	if err != nil {
+		file.Close()
+
+		return nil, 0, nil, errors.Wrap(err, "error in file.Stat")
+	}
+
+	return file, fileInfo.Size(), file, nil
+}
+
+// sendChunked uploads content of message in chunks and commits upload with message,
+// chunks that destination has in store from this or other files are not sent.
+func sendChunked(ctx context.Context, syncURL string, message Message) (Response, error) {
+	content, size, closer, err := getChunkedContent(message)
+	if err != nil {
+		return Response{}, err
+	}
+	defer closer.Close()
+
+	begin := upload.Session{
+		FileName:  message.FileName,
+		SHA256:    message.SHA256,
+		Size:      size,
+		ChunkSize: *config.Get().SyncChunkSize,
+	}
+
+	if begin.Hashes, err = getChunkHashes(content, &begin); err != nil {
+		return Response{}, err
+	}
+
+	session := upload.Session{}
+
+	// destination returns chunks that it has
+	if err := requestJSON(ctx, http.MethodPost, message.Destination, "/api/upload", begin, &session); err != nil {
+		if isNotSupported(err) {
+			setUploadNotSupported(message.Destination)
+
+			return Response{}, errors.Wrap(errUploadNotSupported, err.Error())
+		}
+
+		return Response{}, err
+	}
+
+	begin.ID = session.ID
+	begin.Chunks = session.Chunks
+
+	if err := sendChunks(ctx, message, content, &begin); err != nil {
+		return Response{}, err
+	}
+
+	commit := message
+	commit.Stream = false
+	commit.Upload = session.ID
+	commit.FileContent = ""
+	commit.FileContentBase64 = ""
+
+	req, err := newSyncRequest(ctx, syncURL, commit)
+	if err != nil {
+		return Response{}, err
+	}
+
+	return doSyncRequest(req, syncURL, message)
+}
+
+func getChunkHashes(content io.ReaderAt, session *upload.Session) ([]string, error) {
+	hashes := make([]string, session.Count())
+
+	for index := range hashes {
+		chunk := io.NewSectionReader(content, int64(index)*session.ChunkSize, session.ChunkLen(index))
+
+		hash, err := utils.NewSHA256Reader(chunk)
+		if err != nil {
+			return nil, errors.Wrap(err, "error in utils.NewSHA256Reader")
+		}
+
+		hashes[index] = hash
+	}
+
+	return hashes, nil
+}
+
+func sendChunks(ctx context.Context, message Message, content io.ReaderAt, session *upload.Session) error {
+	// chunks with the same content are sent once
+	sent := make(map[string]bool, len(session.Chunks))
+	for _, index := range session.Chunks {
+		sent[session.Hashes[index]] = true
+	}
+
+	skipped := 0
+
+	for index, hash := range session.Hashes {
+		if sent[hash] {
+			metrics.SendChunkCounter.WithLabelValues("skipped").Inc()
+
+			skipped++
+
+			continue
+		}
+
+		chunk := io.NewSectionReader(content, int64(index)*session.ChunkSize, session.ChunkLen(index))
+
+		if err := sendChunk(ctx, message, session.ID, index, hash, chunk); err != nil {
+			return err
+		}
+
+		metrics.SendChunkCounter.WithLabelValues("sent").Inc()
+
+		sent[hash] = true
+	}
+
+	if skipped > 0 {
+		log.Infof("destination=%s,file=%s,%d of %d chunks are on destination", message.Destination, message.FileName, skipped, session.Count()) //nolint:lll
+	}
+
+	return nil
+}
+
+// sendChunk sends one chunk, every chunk is sent in separate request with sync.timeout.
+func sendChunk(ctx context.Context, message Message, id string, index int, hash string, chunk *io.SectionReader) error { //nolint:lll
+	chunkURL := fmt.Sprintf("https://%s/api/upload/chunk?id=%s&index=%d", message.Destination, url.QueryEscape(id), index)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, chunkURL, io.NopCloser(chunk))
+	if err != nil {
+		return errors.Wrap(err, "error in http.NewRequestWithContext")
+	}
+
+	req.ContentLength = chunk.Size()
+	req.Header.Set("Content-Type", ContentTypeStream)
+	req.Header.Set(HeaderChunkSHA256, hash)
+
+	if encoding := getEncoding(ctx, message, chunk.Size()); len(encoding) > 0 {
+		compressRequest(req, encoding)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return errors.Wrap(err, "error in client.Do")
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return errors.Errorf("%s returned status %d", chunkURL, resp.StatusCode)
+	}
+
+	return nil
+}
@@ -0,0 +1,303 @@
+/*
+Copyright paskal.maksim@gmail.com
+Licensed under the Apache License, Version 2.0 (the "License")
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package applied
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/maksim-paskal/file-sync/pkg/api"
+	"github.com/maksim-paskal/file-sync/pkg/config"
+	"github.com/maksim-paskal/file-sync/pkg/metrics"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+const tmpSuffix = ".tmp"
+
+type record struct {
+	ID       string       `json:"id"`
+	Time     time.Time    `json:"time"`
+	Response api.Response `json:"response"`
+}
+
+// Store keeps results of last successfully applied messages in append-only log,
+// message with the same id is not applied again and gets original result.
+type Store struct {
+	mutex    sync.Mutex
+	path     string
+	size     int
+	file     *os.File
+	records  map[string]record
+	order    []string
+	lines    int
+	inflight map[string]chan struct{}
+}
+
+var store *Store
+
+func Init() error {
+	if *config.Get().SyncAppliedSize <= 0 {
+		return nil
+	}
+
+	var err error
+
+	store, err = New(*config.Get().SyncAppliedFile, *config.Get().SyncAppliedSize)
+
+	return err
+}
+
+// Apply applies message once, result of message with id that was applied before is returned
+// without applying. Messages without id are always applied.
+func Apply(message api.Message, apply func() api.Response) api.Response {
+	return store.Apply(message, apply)
+}
+
+// New opens log of applied messages, log keeps last size messages.
+func New(path string, size int) (*Store, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil { //nolint:gomnd
+		return nil, errors.Wrap(err, "error in os.MkdirAll")
+	}
+
+	s := &Store{
+		path:     path,
+		size:     size,
+		records:  make(map[string]record),
+		order:    make([]string, 0),
+		inflight: make(map[string]chan struct{}),
+	}
+
+	if err := s.load(); err != nil {
+		return nil, err
+	}
+
+	if err := s.compact(); err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+func (s *Store) load() error {
+	file, err := os.Open(s.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+
+	if err != nil {
+		return errors.Wrap(err, "error in os.Open")
+	}
+	defer file.Close()
+
+	reader := bufio.NewReader(file)
+
+	for {
+		line, err := reader.ReadBytes('\n')
+		if errors.Is(err, io.EOF) {
+			// partially written record is ignored
+			return nil
+		}
+
+		if err != nil {
+			return errors.Wrap(err, "error in reader.ReadBytes")
+		}
+
+		value := record{}
+
+		if err := json.Unmarshal(line, &value); err != nil {
+			log.WithError(err).Warnf("ignoring corrupted record in %s", s.path)
+
+			continue
+		}
+
+		s.add(value)
+	}
+}
+
+func (s *Store) add(value record) {
+	if _, ok := s.records[value.ID]; !ok {
+		s.order = append(s.order, value.ID)
+	}
+
+	s.records[value.ID] = value
+
+	for len(s.order) > s.size {
+		delete(s.records, s.order[0])
+		s.order = s.order[1:]
+	}
+}
+
+// compact writes last records to new log and replaces old log with it.
+func (s *Store) compact() error {
+	tmpName := s.path + tmpSuffix
+
+	tmp, err := os.OpenFile(tmpName, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0o644) //nolint:gomnd
+	if err != nil {
+		return errors.Wrap(err, "error in os.OpenFile")
+	}
+
+	writer := bufio.NewWriter(tmp)
+
+	for _, id := range s.order {
+		if err := writeRecord(writer, s.records[id]); err != nil {
+			tmp.Close()
+
+			return err
+		}
+	}
+
+	if err := writer.Flush(); err != nil {
+		tmp.Close()
+
+		return errors.Wrap(err, "error in writer.Flush")
+	}
+
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+
+		return errors.Wrap(err, "error in file.Sync")
+	}
+
+	if err := tmp.Close(); err != nil {
+		return errors.Wrap(err, "error in file.Close")
+	}
+
+	if err := os.Rename(tmpName, s.path); err != nil {
+		return errors.Wrap(err, "error in os.Rename")
+	}
+
+	if s.file != nil {
+		s.file.Close()
+	}
+
+	s.file, err = os.OpenFile(s.path, os.O_APPEND|os.O_WRONLY, 0o644) //nolint:gomnd
+	if err != nil {
+		return errors.Wrap(err, "error in os.OpenFile")
+	}
+
+	s.lines = len(s.order)
+
+	return nil
+}
+
+func writeRecord(w io.Writer, value record) error {
+	recordJSON, err := json.Marshal(value)
+	if err != nil {
+		return errors.Wrap(err, "error in json.Marshal")
+	}
+
+	if _, err := w.Write(append(recordJSON, '\n')); err != nil {
+		return errors.Wrap(err, "error in Write")
+	}
+
+	return nil
+}
+
+// get returns result of applied message, it waits while message with the same id is applied.
+func (s *Store) get(message api.Message) (api.Response, bool) {
+	for {
+		value, ok := s.records[message.ID]
+		if ok && value.Response.Type == message.Type && value.Response.FileName == message.FileName {
+			return value.Response, true
+		}
+
+		wait, ok := s.inflight[message.ID]
+		if !ok {
+			return api.Response{}, false
+		}
+
+		s.mutex.Unlock()
+		<-wait
+		s.mutex.Lock()
+	}
+}
+
+func (s *Store) Apply(message api.Message, apply func() api.Response) api.Response {
+	if s == nil || len(message.ID) == 0 {
+		return apply()
+	}
+
+	s.mutex.Lock()
+
+	if response, ok := s.get(message); ok {
+		s.mutex.Unlock()
+
+		log.
+			WithField("message", message.String()).
+			Infof("message %s was already applied", message.ID)
+
+		metrics.SyncDuplicateCounter.WithLabelValues(message.Type).Inc()
+
+		return response
+	}
+
+	done := make(chan struct{})
+	s.inflight[message.ID] = done
+	s.mutex.Unlock()
+
+	response := apply()
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	delete(s.inflight, message.ID)
+	close(done)
+
+	// failed messages are applied again
+	if response.StatusCode != http.StatusOK {
+		return response
+	}
+
+	if err := s.save(record{ID: message.ID, Time: time.Now(), Response: response}); err != nil {
+		log.
+			WithError(err).
+			WithField("message", message.String()).
+			Error("error in applied.save")
+	}
+
+	return response
+}
+
+func (s *Store) save(value record) error {
+	s.add(value)
+
+	if err := writeRecord(s.file, value); err != nil {
+		return err
+	}
+
+	if err := s.file.Sync(); err != nil {
+		return errors.Wrap(err, "error in file.Sync")
+	}
+
+	s.lines++
+
+	if s.lines > 2*s.size {
+		return s.compact()
+	}
+
+	return nil
+}
+
+func (s *Store) Close() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return s.file.Close()
+}
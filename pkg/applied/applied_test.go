@@ -0,0 +1,145 @@
+/*
+Copyright paskal.maksim@gmail.com
+Licensed under the Apache License, Version 2.0 (the "License")
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package applied_test
+
+import (
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"testing"
+
+	"github.com/maksim-paskal/file-sync/pkg/api"
+	"github.com/maksim-paskal/file-sync/pkg/applied"
+)
+
+func newMessage(id string) api.Message {
+	return api.Message{ID: id, Type: api.MessageTypePut, FileName: "test.txt"}
+}
+
+func applyFunc(calls *int, statusCode int) func() api.Response {
+	return func() api.Response {
+		*calls++
+
+		return api.Response{
+			Type:       api.MessageTypePut,
+			FileName:   "test.txt",
+			StatusCode: statusCode,
+			SHA256:     fmt.Sprintf("sha256-%d", *calls),
+		}
+	}
+}
+
+func TestApplied(t *testing.T) {
+	t.Parallel()
+
+	path := filepath.Join(t.TempDir(), "applied.log")
+
+	store, err := applied.New(path, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	calls := 0
+
+	first := store.Apply(newMessage("1"), applyFunc(&calls, http.StatusOK))
+	second := store.Apply(newMessage("1"), applyFunc(&calls, http.StatusOK))
+
+	if calls != 1 {
+		t.Fatalf("message must be applied once, applied %d", calls)
+	}
+
+	if first != second {
+		t.Fatalf("duplicate must get original result, got %+v", second)
+	}
+
+	// failed message is applied again
+	store.Apply(newMessage("2"), applyFunc(&calls, http.StatusInternalServerError))
+	store.Apply(newMessage("2"), applyFunc(&calls, http.StatusOK))
+
+	if calls != 3 {
+		t.Fatalf("failed message must be applied again, applied %d", calls)
+	}
+
+	// message without id is always applied
+	store.Apply(newMessage(""), applyFunc(&calls, http.StatusOK))
+	store.Apply(newMessage(""), applyFunc(&calls, http.StatusOK))
+
+	if calls != 5 {
+		t.Fatalf("message without id must be applied, applied %d", calls)
+	}
+
+	if err := store.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// applied messages are loaded from log
+	store, err = applied.New(path, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	if result := store.Apply(newMessage("1"), applyFunc(&calls, http.StatusOK)); result != first {
+		t.Fatalf("duplicate must get original result after restart, got %+v", result)
+	}
+
+	store.Apply(newMessage("2"), applyFunc(&calls, http.StatusOK))
+
+	if calls != 5 {
+		t.Fatalf("messages must not be applied after restart, applied %d", calls)
+	}
+
+	// message with the same id and other file is applied
+	other := newMessage("1")
+	other.FileName = "other.txt"
+
+	store.Apply(other, applyFunc(&calls, http.StatusOK))
+
+	if calls != 6 {
+		t.Fatalf("message of other file must be applied, applied %d", calls)
+	}
+}
+
+func TestAppliedSize(t *testing.T) {
+	t.Parallel()
+
+	path := filepath.Join(t.TempDir(), "applied.log")
+
+	const size = 3
+
+	store, err := applied.New(path, size)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	calls := 0
+
+	for i := 0; i < 10; i++ {
+		store.Apply(newMessage(fmt.Sprint(i)), applyFunc(&calls, http.StatusOK))
+	}
+
+	// last messages are kept
+	store.Apply(newMessage("9"), applyFunc(&calls, http.StatusOK))
+
+	if calls != 10 {
+		t.Fatalf("last message must not be applied again, applied %d", calls)
+	}
+
+	// old messages are forgotten
+	store.Apply(newMessage("0"), applyFunc(&calls, http.StatusOK))
+
+	if calls != 11 {
+		t.Fatalf("old message must be applied again, applied %d", calls)
+	}
+}
@@ -28,54 +28,140 @@ type Config struct {
 	LogPretty         *bool
 	HTTPAddress       *string
 	HTTPSAddress      *string
+	HTTPToken         *string
+	HTTPInsecure      *bool
 	MetricsAddress    *string
 	SourceDir         *string
 	DestinationDir    *string
 	SyncAddress       *string
 	SyncTimeout       *time.Duration
-	SyncRetryTimeout  *time.Duration
 	SyncRetryCount    *int
+	SyncStreamSize    *int64
+	SyncStrictSHA256  *bool
+	SyncDeltaSize     *int64
+	SyncChunkSize     *int64
+	SyncUploadDir     *string
+	SyncUploadTimeout *time.Duration
+	SyncChunkMaxAge   *time.Duration
+	SyncCompress      *string
+	SyncCompressSize  *int64
+	SyncCompressSkip  *string
+	SyncPreserve      *string
+	SyncAppliedFile   *string
+	SyncAppliedSize   *int
 	SSLCrt            *string
 	SSLKey            *string
+	QueueType         *string
+	QueueDir          *string
+	QueueBackoffMin   *time.Duration
+	QueueBackoffMax   *time.Duration
+	QueueMaxAge       *time.Duration
+	QueueWorkers      *int
+	QueueCoalesce     *bool
+	BreakerFailures   *int
+	BreakerTimeout    *time.Duration
+	JobsRetention     *time.Duration
 	RedisEnabled      *bool
 	RedisAddress      *string
 	RedisPassword     *string
 	RedisTLS          *bool
 	RedisTLSInsecure  *bool
 	ExecuteRedisQueue *bool
+	RedisConsumer     *string
+	RedisClaimTimeout *time.Duration
+	RedisPrefix       *string
+	WatchEnabled      *bool
+	WatchDebounce     *time.Duration
+	WatchInclude      *string
+	WatchExclude      *string
+	WatchInitialScan  *bool
+	ResyncInterval    *time.Duration
+	MerkleInterval    *time.Duration
 	SentryDSN         *string
 }
 
 const (
 	syncTimeoutDefault = 30 * time.Second
-	syncRetryTimeout   = 5 * time.Second
 	syncRetryCount     = 3
+	syncStreamSize     = 10 * 1024 * 1024
+	syncDeltaSize      = 1024 * 1024
+	syncChunkSize      = syncStreamSize // only streamed files are uploaded in chunks by default
+	syncUploadTimeout  = 24 * time.Hour
+	syncChunkMaxAge    = 7 * 24 * time.Hour
+	syncCompressSize   = 1024
+	syncCompressSkip   = ".gz,.tgz,.bz2,.xz,.zst,.zip,.7z,.rar,.jpg,.jpeg,.png,.gif,.webp,.mp3,.mp4,.mkv,.mov,.pdf"
+	syncAppliedSize    = 10000
+	watchDebounce      = time.Second
+	redisClaimTimeout  = 5 * time.Minute
+	queueBackoffMin    = time.Second
+	queueBackoffMax    = 5 * time.Minute
+	queueMaxAge        = 24 * time.Hour
+	queueWorkers       = 4
+	breakerFailures    = 5
+	breakerTimeout     = 30 * time.Second
+	jobsRetention      = time.Hour
 )
 
 var (
 	gitVersion = "dev"
-	appConfig  = Config{
+	// period between retries of first versions, retries are delayed by queue.backoff.min
+	syncRetryTimeout = flag.Duration("sync.retry.timeout", 0, "deprecated, use queue.backoff.min")
+	appConfig        = Config{
 		ConfigPath:        flag.String("config", getEnvDefault("CONFIG", "config.yaml"), "config"),
 		LogPretty:         flag.Bool("log.pretty", false, "logging level"),
 		LogLevel:          flag.String("log.level", "INFO", "logging level"),
 		HTTPAddress:       flag.String("http.address", ":9336", "address"),
 		HTTPSAddress:      flag.String("https.address", ":9335", "address"),
+		HTTPToken:         flag.String("http.token", os.Getenv("HTTP_TOKEN"), "bearer token of queue management requests"),
+		HTTPInsecure:      flag.Bool("http.insecure", false, "allow queue management requests without http.token"),
 		MetricsAddress:    flag.String("metrics.address", ":9334", "address"),
 		SourceDir:         flag.String("dir.src", "data", "folder"),
 		DestinationDir:    flag.String("dir.dest", "data", "folder"),
 		SyncAddress:       flag.String("sync.address", "localhost:9335", "destination server"),
 		SyncTimeout:       flag.Duration("sync.timeout", syncTimeoutDefault, "http request timeout"),
-		SyncRetryTimeout:  flag.Duration("sync.retry.timeout", syncRetryTimeout, "period on retry"),
 		SyncRetryCount:    flag.Int("sync.retry.count", syncRetryCount, "max retry count"),
+		SyncStrictSHA256:  flag.Bool("sync.sha256.strict", false, "reject files with wrong SHA256 and retry send"),
+		SyncPreserve:      flag.String("sync.preserve", "mode,mtime", "file attributes to preserve on destination: mode,mtime,owner"),                                  //nolint:lll
+		SyncStreamSize:    flag.Int64("sync.stream.size", syncStreamSize, "send files larger than this size as raw stream, 0 to disable"),                              //nolint:lll
+		SyncDeltaSize:     flag.Int64("sync.delta.size", syncDeltaSize, "send patch of files larger than this size as difference with destination file, 0 to disable"), //nolint:lll
+		SyncChunkSize:     flag.Int64("sync.chunk.size", syncChunkSize, "upload files larger than this size in chunks deduplicated on destination, 0 to disable"),      //nolint:lll
+		SyncUploadDir:     flag.String("sync.upload.dir", "uploads", "folder of chunked uploads and store of their chunks on destination"),
+		SyncUploadTimeout: flag.Duration("sync.upload.timeout", syncUploadTimeout, "incomplete uploads not changed for this period are removed"),                   //nolint:lll
+		SyncChunkMaxAge:   flag.Duration("sync.chunk.maxAge", syncChunkMaxAge, "chunks not used by uploads for this period are removed from store on destination"), //nolint:lll
+		SyncCompress:      flag.String("sync.compress", "zstd,gzip", "comma separated preferred compression of sync payloads, empty to disable"),                   //nolint:lll
+		SyncCompressSize:  flag.Int64("sync.compress.size", syncCompressSize, "compress payloads larger than this size"),
+		SyncCompressSkip:  flag.String("sync.compress.skip", syncCompressSkip, "comma separated extensions of compressed files that are sent without compression"), //nolint:lll
+		SyncAppliedFile:   flag.String("sync.applied.file", "applied.log", "log of applied message ids on destination"),
+		SyncAppliedSize:   flag.Int("sync.applied.size", syncAppliedSize, "number of applied message ids that are not applied again, 0 to disable"), //nolint:lll
 		SentryDSN:         flag.String("sentry.dsn", os.Getenv("SENTRY_DSN"), "Sentry DSN"),
 		SSLCrt:            flag.String("ssl.crt", "", "path to CA cert"),
 		SSLKey:            flag.String("ssl.key", "", "path to CA key"),
+		QueueType:         flag.String("queue.type", "memory", "queue backend: memory, disk, redis"),
+		QueueDir:          flag.String("queue.dir", "queue", "folder of disk queue"),
+		QueueBackoffMin:   flag.Duration("queue.backoff.min", queueBackoffMin, "delay of first retry, grows exponentially"),
+		QueueBackoffMax:   flag.Duration("queue.backoff.max", queueBackoffMax, "max delay between retries"),
+		QueueMaxAge:       flag.Duration("queue.maxAge", queueMaxAge, "messages older than this are moved to dead-letter queue after failure"), //nolint:lll
+		QueueWorkers:      flag.Int("queue.workers", queueWorkers, "number of concurrent workers of every destination"),
+		QueueCoalesce:     flag.Bool("queue.coalesce", true, "merge pending messages of the same file"),
+		BreakerFailures:   flag.Int("queue.breaker.failures", breakerFailures, "destination is down after this number of failures in a row"), //nolint:lll
+		BreakerTimeout:    flag.Duration("queue.breaker.timeout", breakerTimeout, "delivery to down destination is paused for this period"),  //nolint:lll
+		JobsRetention:     flag.Duration("jobs.retention", jobsRetention, "status of message is kept for this period after last change"),     //nolint:lll
 		RedisEnabled:      flag.Bool("redis.enabled", false, "use redis"),
 		RedisAddress:      flag.String("redis.address", "127.0.0.1:6379", "redis address"),
 		RedisPassword:     flag.String("redis.password", "", "redis password"),
 		RedisTLS:          flag.Bool("redis.tls", false, "use TLS in redis connection"),
 		RedisTLSInsecure:  flag.Bool("redis.tls.insecure", false, "allow insecure tls connection"),
 		ExecuteRedisQueue: flag.Bool("redis.executeQueue", true, "process redis queue, false in distributed mode"),
+		RedisConsumer:     flag.String("redis.consumer", getHostname(), "name of consumer in redis consumer group"),
+		RedisPrefix:       flag.String("redis.prefix", "file-sync", "prefix of all redis keys"),
+		RedisClaimTimeout: flag.Duration("redis.claimTimeout", redisClaimTimeout, "messages of dead consumers are reclaimed after this idle period"), //nolint:lll
+		WatchEnabled:      flag.Bool("watch.enabled", false, "watch changes in source folder"),
+		WatchDebounce:     flag.Duration("watch.debounce", watchDebounce, "send changes after this quiet period"),
+		WatchInclude:      flag.String("watch.include", "", "comma separated globs of files to watch, empty for all"),
+		WatchExclude:      flag.String("watch.exclude", "", "comma separated globs of files and folders to ignore"),
+		ResyncInterval:    flag.Duration("resync.interval", 0, "period of full resync with destinations, 0 to disable"),
+		MerkleInterval:    flag.Duration("merkle.interval", 0, "period of hash tree check with destinations, 0 to disable"),
+		WatchInitialScan:  flag.Bool("watch.initialScan", true, "send all files from source folder on start"),
 	}
 )
 
@@ -88,6 +174,34 @@ func Load() error {
 	return yaml.Unmarshal(config, &appConfig)
 }
 
+// ApplyDeprecated sets values of deprecated flags to flags that replaced them,
+// it returns warnings about deprecated flags that are set.
+func ApplyDeprecated() []string {
+	warnings := make([]string, 0)
+
+	if *syncRetryTimeout > 0 {
+		warnings = append(warnings, "sync.retry.timeout is deprecated, use queue.backoff.min")
+
+		if !isFlagSet("queue.backoff.min") {
+			appConfig.QueueBackoffMin = syncRetryTimeout
+		}
+	}
+
+	return warnings
+}
+
+func isFlagSet(name string) bool {
+	result := false
+
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			result = true
+		}
+	})
+
+	return result
+}
+
 func GetVersion() string {
 	return gitVersion
 }
@@ -119,3 +233,12 @@ func getEnvDefault(name string, defaultValue string) string {
 
 	return r
 }
+
+func getHostname() string {
+	hostname, err := os.Hostname()
+	if err != nil || len(hostname) == 0 {
+		return "file-sync"
+	}
+
+	return hostname
+}
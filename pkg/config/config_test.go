@@ -13,7 +13,9 @@ limitations under the License.
 package config_test
 
 import (
+	"flag"
 	"testing"
+	"time"
 
 	"github.com/maksim-paskal/file-sync/pkg/config"
 )
@@ -29,3 +31,24 @@ func TestConfig(t *testing.T) {
 		t.Fatalf("want=%s got=%s", want, *config.Get().SSLCrt)
 	}
 }
+
+func TestApplyDeprecated(t *testing.T) { //nolint:paralleltest
+	defer func(value *time.Duration) { config.Get().QueueBackoffMin = value }(config.Get().QueueBackoffMin)
+	defer flag.Set("sync.retry.timeout", "0") //nolint:errcheck
+
+	if warnings := config.ApplyDeprecated(); len(warnings) != 0 {
+		t.Fatalf("no warnings expected, got %v", warnings)
+	}
+
+	if err := flag.Set("sync.retry.timeout", "2s"); err != nil {
+		t.Fatal(err)
+	}
+
+	if warnings := config.ApplyDeprecated(); len(warnings) != 1 {
+		t.Fatalf("one warning expected, got %v", warnings)
+	}
+
+	if want := 2 * time.Second; *config.Get().QueueBackoffMin != want {
+		t.Fatalf("want=%s got=%s", want, *config.Get().QueueBackoffMin)
+	}
+}
@@ -0,0 +1,44 @@
+/*
+Copyright paskal.maksim@gmail.com
+Licensed under the Apache License, Version 2.0 (the "License")
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package delta
+
+const rollingMask = 0xffff
+
+// rollingChecksum is weak checksum of rsync, checksum of window moved by one byte
+// is calculated from previous checksum.
+type rollingChecksum struct {
+	a    uint32
+	b    uint32
+	size uint32
+}
+
+func newRollingChecksum(data []byte) rollingChecksum {
+	sum := rollingChecksum{size: uint32(len(data))}
+
+	for i, value := range data {
+		sum.a += uint32(value)
+		sum.b += uint32(len(data)-i) * uint32(value)
+	}
+
+	return sum
+}
+
+// roll moves window by one byte, out is removed from window and in is added.
+func (r *rollingChecksum) roll(out, in byte) {
+	r.a = r.a - uint32(out) + uint32(in)
+	r.b = r.b - r.size*uint32(out) + r.a
+}
+
+func (r rollingChecksum) digest() uint32 {
+	return r.a&rollingMask | (r.b&rollingMask)<<16
+}
@@ -0,0 +1,464 @@
+/*
+Copyright paskal.maksim@gmail.com
+Licensed under the Apache License, Version 2.0 (the "License")
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package delta
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"io"
+	"math"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	blockSizeMin = 2 * 1024
+	blockSizeMax = 128 * 1024
+	// size of strong checksum of block, it is checked only when weak checksum matches
+	// and result is checked with SHA256 of whole file.
+	strongSize = 16
+	// literal data is sent in parts of this size.
+	maxLiteral = 1024 * 1024
+
+	// copy blocks from base: index and count of blocks
+	opCopy byte = 'C'
+	// literal data: length and data
+	opData byte = 'D'
+	// end of delta: SHA256 of result
+	opEnd byte = 'E'
+)
+
+var (
+	ErrInvalid  = errors.New("invalid delta")
+	ErrChecksum = errors.New("delta result checksum mismatch")
+)
+
+// Block is checksums of one block of base file.
+type Block struct {
+	Weak   uint32 `json:"weak"`
+	Strong string `json:"strong"`
+}
+
+// Signature is checksums of blocks of base file, last block can be shorter than BlockSize.
+type Signature struct {
+	Size      int64   `json:"size"`
+	SHA256    string  `json:"sha256"`
+	BlockSize int     `json:"blockSize"`
+	Blocks    []Block `json:"blocks"`
+}
+
+// GetBlockSize returns block size for file, it is about square root of file size as in rsync.
+func GetBlockSize(size int64) int {
+	blockSize := int(math.Sqrt(float64(size)))
+
+	if blockSize < blockSizeMin {
+		return blockSizeMin
+	}
+
+	if blockSize > blockSizeMax {
+		return blockSizeMax
+	}
+
+	return blockSize
+}
+
+// NewSignature reads base file and returns checksums of its blocks.
+func NewSignature(base io.Reader, blockSize int) (*Signature, error) {
+	if blockSize <= 0 {
+		return nil, errors.Errorf("invalid block size %d", blockSize)
+	}
+
+	signature := &Signature{
+		BlockSize: blockSize,
+		Blocks:    make([]Block, 0),
+	}
+
+	hash := sha256.New()
+	buf := make([]byte, blockSize)
+
+	for {
+		n, err := io.ReadFull(base, buf)
+		if n > 0 {
+			hash.Write(buf[:n])
+
+			signature.Size += int64(n)
+			signature.Blocks = append(signature.Blocks, Block{
+				Weak:   newRollingChecksum(buf[:n]).digest(),
+				Strong: strongChecksum(buf[:n]),
+			})
+		}
+
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			break
+		}
+
+		if err != nil {
+			return nil, errors.Wrap(err, "error in io.ReadFull")
+		}
+	}
+
+	signature.SHA256 = hex.EncodeToString(hash.Sum(nil))
+
+	return signature, nil
+}
+
+func strongChecksum(data []byte) string {
+	hash := sha256.Sum256(data)
+
+	return hex.EncodeToString(hash[:strongSize])
+}
+
+// blockLen returns length of block, last block can be shorter.
+func (s *Signature) blockLen(index int) int {
+	if index == len(s.Blocks)-1 {
+		return int(s.Size - int64(index)*int64(s.BlockSize))
+	}
+
+	return s.BlockSize
+}
+
+// blockIndex is index of blocks by weak checksum.
+type blockIndex struct {
+	signature *Signature
+	blocks    map[uint32][]int
+}
+
+func newBlockIndex(signature *Signature) *blockIndex {
+	index := &blockIndex{
+		signature: signature,
+		blocks:    make(map[uint32][]int, len(signature.Blocks)),
+	}
+
+	for i, block := range signature.Blocks {
+		index.blocks[block.Weak] = append(index.blocks[block.Weak], i)
+	}
+
+	return index
+}
+
+// find returns index of block with the same content as data.
+func (b *blockIndex) find(weak uint32, data []byte) (int, bool) {
+	candidates, ok := b.blocks[weak]
+	if !ok {
+		return 0, false
+	}
+
+	strong := ""
+
+	for _, i := range candidates {
+		if b.signature.blockLen(i) != len(data) {
+			continue
+		}
+
+		if len(strong) == 0 {
+			strong = strongChecksum(data)
+		}
+
+		if b.signature.Blocks[i].Strong == strong {
+			return i, true
+		}
+	}
+
+	return 0, false
+}
+
+// encoder writes operations of delta, adjacent blocks are copied with one operation.
+type encoder struct {
+	w         *bufio.Writer
+	copyStart int
+	copyCount int
+}
+
+func (e *encoder) copyBlock(index int) error {
+	if e.copyCount > 0 && e.copyStart+e.copyCount == index {
+		e.copyCount++
+
+		return nil
+	}
+
+	if err := e.flushCopy(); err != nil {
+		return err
+	}
+
+	e.copyStart = index
+	e.copyCount = 1
+
+	return nil
+}
+
+func (e *encoder) flushCopy() error {
+	if e.copyCount == 0 {
+		return nil
+	}
+
+	count := e.copyCount
+	e.copyCount = 0
+
+	return e.write(opCopy, uint64(e.copyStart), uint64(count))
+}
+
+func (e *encoder) data(data []byte) error {
+	if len(data) == 0 {
+		return nil
+	}
+
+	if err := e.flushCopy(); err != nil {
+		return err
+	}
+
+	if err := e.write(opData, uint64(len(data))); err != nil {
+		return err
+	}
+
+	if _, err := e.w.Write(data); err != nil {
+		return errors.Wrap(err, "error in Write")
+	}
+
+	return nil
+}
+
+func (e *encoder) end(sum []byte) error {
+	if err := e.flushCopy(); err != nil {
+		return err
+	}
+
+	if err := e.w.WriteByte(opEnd); err != nil {
+		return errors.Wrap(err, "error in WriteByte")
+	}
+
+	if _, err := e.w.Write(sum); err != nil {
+		return errors.Wrap(err, "error in Write")
+	}
+
+	if err := e.w.Flush(); err != nil {
+		return errors.Wrap(err, "error in Flush")
+	}
+
+	return nil
+}
+
+func (e *encoder) write(op byte, values ...uint64) error {
+	if err := e.w.WriteByte(op); err != nil {
+		return errors.Wrap(err, "error in WriteByte")
+	}
+
+	for _, value := range values {
+		if err := binary.Write(e.w, binary.BigEndian, value); err != nil {
+			return errors.Wrap(err, "error in binary.Write")
+		}
+	}
+
+	return nil
+}
+
+// Write reads source and writes delta that makes source from base with signature,
+// source is read once, memory usage does not depend on size of source.
+// Returns SHA256 of source.
+func Write(w io.Writer, source io.Reader, signature *Signature) (string, error) { //nolint:funlen,cyclop
+	if signature.BlockSize <= 0 {
+		return "", errors.Wrapf(ErrInvalid, "block size %d", signature.BlockSize)
+	}
+
+	hash := sha256.New()
+	reader := io.TeeReader(source, hash)
+	index := newBlockIndex(signature)
+	out := &encoder{w: bufio.NewWriter(w)}
+	blockSize := signature.BlockSize
+
+	// buf[literal:start] is not matched data, buf[start:start+blockSize] is checked window
+	buf := make([]byte, 0, maxLiteral+2*blockSize)
+	literal, start := 0, 0
+	eof := false
+
+	var (
+		sum         rollingChecksum
+		sumValid    bool
+		tailChecked bool
+	)
+
+	for {
+		if len(buf)-start < blockSize && !eof {
+			if start-literal >= maxLiteral {
+				if err := out.data(buf[literal:start]); err != nil {
+					return "", err
+				}
+
+				literal = start
+			}
+
+			// not processed data is moved to the beginning of buffer
+			n := copy(buf[:cap(buf)], buf[literal:])
+			start -= literal
+			literal = 0
+
+			read, err := io.ReadFull(reader, buf[n:cap(buf)])
+			buf = buf[:n+read]
+
+			if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+				eof = true
+			} else if err != nil {
+				return "", errors.Wrap(err, "error in io.ReadFull")
+			}
+
+			continue
+		}
+
+		window := buf[start:]
+		if len(window) > blockSize {
+			window = window[:blockSize]
+		}
+
+		if len(window) == 0 {
+			break
+		}
+
+		if len(window) < blockSize {
+			// tail can match only last block of base with the same length, it is checked once
+			if tailChecked {
+				break
+			}
+
+			tailChecked = true
+
+			if last := len(signature.Blocks) - 1; last >= 0 && signature.blockLen(last) < len(window) {
+				start = len(buf) - signature.blockLen(last)
+				window = buf[start:]
+			}
+
+			sumValid = false
+		}
+
+		if !sumValid {
+			sum = newRollingChecksum(window)
+			sumValid = true
+		}
+
+		if i, ok := index.find(sum.digest(), window); ok {
+			if err := out.data(buf[literal:start]); err != nil {
+				return "", err
+			}
+
+			if err := out.copyBlock(i); err != nil {
+				return "", err
+			}
+
+			start += len(window)
+			literal = start
+			sumValid = false
+
+			continue
+		}
+
+		if len(window) < blockSize {
+			break
+		}
+
+		if start+blockSize < len(buf) {
+			sum.roll(buf[start], buf[start+blockSize])
+		} else {
+			// next byte is not read yet
+			sumValid = false
+		}
+
+		start++
+	}
+
+	if err := out.data(buf[literal:]); err != nil {
+		return "", err
+	}
+
+	result := hash.Sum(nil)
+
+	if err := out.end(result); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(result), nil
+}
+
+// Apply writes result of delta to w, blocks are copied from base with blockSize,
+// returns ErrChecksum if result does not match SHA256 from delta.
+func Apply(w io.Writer, base io.ReaderAt, baseSize int64, blockSize int, delta io.Reader) error { //nolint:cyclop
+	if blockSize <= 0 {
+		return errors.Wrapf(ErrInvalid, "block size %d", blockSize)
+	}
+
+	blocks := (baseSize + int64(blockSize) - 1) / int64(blockSize)
+	hash := sha256.New()
+	out := io.MultiWriter(w, hash)
+	reader := bufio.NewReader(delta)
+
+	for {
+		op, err := reader.ReadByte()
+		if errors.Is(err, io.EOF) {
+			return errors.Wrap(ErrInvalid, "delta is incomplete")
+		}
+
+		if err != nil {
+			return errors.Wrap(err, "error in ReadByte")
+		}
+
+		switch op {
+		case opCopy:
+			var values [2]uint64
+
+			if err := binary.Read(reader, binary.BigEndian, &values); err != nil {
+				return errors.Wrap(err, "error in binary.Read")
+			}
+
+			first, count := values[0], values[1]
+
+			if count == 0 || first >= uint64(blocks) || count > uint64(blocks)-first {
+				return errors.Wrapf(ErrInvalid, "blocks %d-%d are not in base", first, first+count)
+			}
+
+			offset := int64(first) * int64(blockSize)
+
+			length := int64(count) * int64(blockSize)
+			if offset+length > baseSize {
+				length = baseSize - offset
+			}
+
+			if _, err := io.Copy(out, io.NewSectionReader(base, offset, length)); err != nil {
+				return errors.Wrap(err, "error in io.Copy")
+			}
+		case opData:
+			var length uint64
+
+			if err := binary.Read(reader, binary.BigEndian, &length); err != nil {
+				return errors.Wrap(err, "error in binary.Read")
+			}
+
+			if _, err := io.CopyN(out, reader, int64(length)); err != nil {
+				return errors.Wrap(err, "error in io.CopyN")
+			}
+		case opEnd:
+			sum := make([]byte, sha256.Size)
+
+			if _, err := io.ReadFull(reader, sum); err != nil {
+				return errors.Wrap(err, "error in io.ReadFull")
+			}
+
+			if !bytes.Equal(sum, hash.Sum(nil)) {
+				return ErrChecksum
+			}
+
+			return nil
+		default:
+			return errors.Wrapf(ErrInvalid, "unknown operation %d", op)
+		}
+	}
+}
@@ -0,0 +1,139 @@
+/*
+Copyright paskal.maksim@gmail.com
+Licensed under the Apache License, Version 2.0 (the "License")
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package delta_test
+
+import (
+	"bytes"
+	"errors"
+	"math/rand"
+	"testing"
+
+	"github.com/maksim-paskal/file-sync/pkg/delta"
+)
+
+func randomBytes(size int) []byte {
+	data := make([]byte, size)
+	rand.Read(data) //nolint:gosec
+
+	return data
+}
+
+func join(parts ...[]byte) []byte {
+	return bytes.Join(parts, nil)
+}
+
+// roundTrip returns delta from base to source and checks that it makes source.
+func roundTrip(t *testing.T, base, source []byte) []byte {
+	t.Helper()
+
+	signature, err := delta.NewSignature(bytes.NewReader(base), delta.GetBlockSize(int64(len(base))))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+
+	if _, err := delta.Write(&buf, bytes.NewReader(source), signature); err != nil {
+		t.Fatal(err)
+	}
+
+	deltaBytes := buf.Bytes()
+
+	var result bytes.Buffer
+
+	err = delta.Apply(&result, bytes.NewReader(base), int64(len(base)), signature.BlockSize, bytes.NewReader(deltaBytes))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(result.Bytes(), source) {
+		t.Fatalf("result of delta does not match source, %d bytes, must be %d", result.Len(), len(source))
+	}
+
+	return deltaBytes
+}
+
+func TestDelta(t *testing.T) {
+	t.Parallel()
+
+	base := randomBytes(1024*1024 + 100)
+	change := randomBytes(10)
+
+	tests := []struct {
+		name     string
+		base     []byte
+		source   []byte
+		maxDelta int
+	}{
+		{"same", base, base, 1024},
+		{"append", base, join(base, change), 1024},
+		{"insert", base, join(base[:5000], change, base[5000:]), 10 * 1024},
+		{"replace", base, join(base[:5000], change, base[5010:]), 10 * 1024},
+		{"delete", base, join(base[:5000], base[6000:]), 10 * 1024},
+		{"truncate", base, base[:len(base)-50], 10 * 1024},
+		{"prepend tail", base, join(change, base[len(base)-100:]), 1024},
+		{"empty base", []byte{}, base, len(base) + 1024},
+		{"empty source", base, []byte{}, 1024},
+		{"long literal", base, randomBytes(3*1024*1024 + 7), 3*1024*1024 + 1024},
+	}
+
+	for _, test := range tests {
+		deltaBytes := roundTrip(t, test.base, test.source)
+
+		if len(deltaBytes) > test.maxDelta {
+			t.Errorf("%s: delta size %d is bigger than %d", test.name, len(deltaBytes), test.maxDelta)
+		}
+	}
+}
+
+func TestDeltaInvalid(t *testing.T) {
+	t.Parallel()
+
+	base := randomBytes(100 * 1024)
+	source := join(base[:1000], randomBytes(10), base[1000:])
+
+	signature, err := delta.NewSignature(bytes.NewReader(base), delta.GetBlockSize(int64(len(base))))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+
+	if _, err := delta.Write(&buf, bytes.NewReader(source), signature); err != nil {
+		t.Fatal(err)
+	}
+
+	// base was changed after signature
+	changed := join(base[:50000], randomBytes(10), base[50010:])
+
+	err = delta.Apply(&bytes.Buffer{}, bytes.NewReader(changed), int64(len(changed)), signature.BlockSize, bytes.NewReader(buf.Bytes())) //nolint:lll
+	if !errors.Is(err, delta.ErrChecksum) {
+		t.Fatalf("error %v, must be %v", err, delta.ErrChecksum)
+	}
+
+	// transfer was interrupted
+	truncated := buf.Bytes()[:buf.Len()-10]
+
+	err = delta.Apply(&bytes.Buffer{}, bytes.NewReader(base), int64(len(base)), signature.BlockSize, bytes.NewReader(truncated))
+	if err == nil {
+		t.Fatal("truncated delta must fail")
+	}
+
+	// base is shorter than delta expects
+	short := base[:1000]
+
+	err = delta.Apply(&bytes.Buffer{}, bytes.NewReader(short), int64(len(short)), signature.BlockSize, bytes.NewReader(buf.Bytes()))
+	if !errors.Is(err, delta.ErrInvalid) {
+		t.Fatalf("error %v, must be %v", err, delta.ErrInvalid)
+	}
+}
@@ -0,0 +1,620 @@
+/*
+Copyright paskal.maksim@gmail.com
+Licensed under the Apache License, Version 2.0 (the "License")
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package merkle
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/maksim-paskal/file-sync/pkg/api"
+	"github.com/maksim-paskal/file-sync/pkg/config"
+	"github.com/maksim-paskal/file-sync/pkg/metrics"
+	"github.com/maksim-paskal/file-sync/pkg/resync"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// Node is file or directory in hash tree, directory hash is calculated from sorted children.
+type Node struct {
+	Name     string  `json:"name"`
+	IsDir    bool    `json:"isDir"`
+	Hash     string  `json:"hash"`
+	Children []*Node `json:"children,omitempty"`
+}
+
+// GetNodeFunc returns node by slash separated path relative to tree root, "" is root.
+type GetNodeFunc func(ctx context.Context, nodePath string) (*Node, error)
+
+// Tree holds hash tree of directory, tree is built once and then updated with changed paths.
+type Tree struct {
+	root string
+	// missing root is empty tree, otherwise it is an error
+	missingIsEmpty bool
+	mutex          sync.RWMutex
+	node           *Node
+}
+
+var (
+	destinationTree     *Tree
+	destinationTreeOnce sync.Once
+	sourceTree          *Tree
+	sourceTreeOnce      sync.Once
+)
+
+// NewTree creates tree of directory that must exist.
+func NewTree(root string) *Tree {
+	return &Tree{root: filepath.Clean(root)}
+}
+
+func getDestinationTree() *Tree {
+	destinationTreeOnce.Do(func() {
+		// nothing synced yet
+		destinationTree = &Tree{root: filepath.Clean(*config.Get().DestinationDir), missingIsEmpty: true}
+	})
+
+	return destinationTree
+}
+
+func getSourceTree() *Tree {
+	sourceTreeOnce.Do(func() {
+		sourceTree = NewTree(*config.Get().SourceDir)
+	})
+
+	return sourceTree
+}
+
+// Build walks directory and builds new hash tree, file hashes are cached by size and mtime.
+func (t *Tree) Build() error {
+	if _, err := os.Stat(t.root); os.IsNotExist(err) && !t.missingIsEmpty {
+		return errors.Wrap(api.ErrFileNotFound, t.root)
+	}
+
+	node, err := buildNode(t.root, "")
+	if err != nil {
+		return err
+	}
+
+	t.mutex.Lock()
+	t.node = node
+	t.mutex.Unlock()
+
+	return nil
+}
+
+// build builds tree if it was not built yet.
+func (t *Tree) build() error {
+	if t.isBuilt() {
+		return nil
+	}
+
+	return t.Build()
+}
+
+func (t *Tree) isBuilt() bool {
+	t.mutex.RLock()
+	defer t.mutex.RUnlock()
+
+	return t.node != nil
+}
+
+// Update updates tree with current state of file or directory, path is relative to tree root.
+// Tree that was not built yet is not changed, it will be built with current state.
+func (t *Tree) Update(fileName string) error {
+	if !t.isBuilt() {
+		return nil
+	}
+
+	fileName = filepath.Clean(fileName)
+	if fileName == "." {
+		return t.Build()
+	}
+
+	fileName = t.getUpdatePath(fileName)
+
+	fullPath, err := api.SecureJoin(t.root, fileName)
+	if err != nil {
+		return errors.Wrap(err, "error in api.SecureJoin")
+	}
+
+	node, err := newNode(fullPath)
+	if err != nil {
+		return err
+	}
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	if t.node == nil {
+		return nil
+	}
+
+	names := strings.Split(filepath.ToSlash(fileName), "/")
+	parents := []*Node{t.node}
+
+	for _, name := range names[:len(names)-1] {
+		parent := parents[len(parents)-1]
+
+		child := parent.child(name)
+		if child == nil || !child.IsDir {
+			if node == nil {
+				// nothing to remove
+				return nil
+			}
+
+			// tree was changed after path was checked
+			child = &Node{Name: name, IsDir: true, Children: make([]*Node, 0)}
+			t.forget(parent.setChild(child), path.Join(names[:len(parents)]...))
+		}
+
+		parents = append(parents, child)
+	}
+
+	parent := parents[len(parents)-1]
+
+	if node == nil {
+		t.forget(parent.removeChild(names[len(names)-1]), filepath.ToSlash(fileName))
+	} else {
+		node.Name = names[len(names)-1]
+		t.forget(parent.setChild(node), filepath.ToSlash(fileName))
+	}
+
+	for i := len(parents) - 1; i >= 0; i-- {
+		parents[i].updateHash()
+	}
+
+	return nil
+}
+
+// getUpdatePath returns path of first parent directory that is not in tree,
+// directory is added with all its content, otherwise it returns fileName.
+func (t *Tree) getUpdatePath(fileName string) string {
+	t.mutex.RLock()
+	defer t.mutex.RUnlock()
+
+	node := t.node
+	if node == nil {
+		return fileName
+	}
+
+	names := strings.Split(filepath.ToSlash(fileName), "/")
+
+	for i, name := range names[:len(names)-1] {
+		if node = node.child(name); node == nil || !node.IsDir {
+			return filepath.Join(names[:i+1]...)
+		}
+	}
+
+	return fileName
+}
+
+// forget removes cached hashes of files of replaced node.
+func (t *Tree) forget(node *Node, nodePath string) {
+	if node == nil {
+		return
+	}
+
+	if !node.IsDir {
+		api.ForgetFileSHA256(filepath.Join(t.root, filepath.FromSlash(nodePath)))
+
+		return
+	}
+
+	for _, child := range node.Children {
+		t.forget(child, path.Join(nodePath, child.Name))
+	}
+}
+
+// Get returns node with direct children only.
+func (t *Tree) Get(ctx context.Context, nodePath string) (*Node, error) {
+	t.mutex.RLock()
+	defer t.mutex.RUnlock()
+
+	node := t.node
+	if node == nil {
+		return nil, errors.New("tree is not built")
+	}
+
+	if len(nodePath) > 0 {
+		for _, name := range strings.Split(nodePath, "/") {
+			node = node.child(name)
+			if node == nil {
+				return &Node{Name: name}, nil
+			}
+		}
+	}
+
+	result := &Node{
+		Name:     node.Name,
+		IsDir:    node.IsDir,
+		Hash:     node.Hash,
+		Children: make([]*Node, 0, len(node.Children)),
+	}
+
+	for _, child := range node.Children {
+		result.Children = append(result.Children, &Node{
+			Name:  child.Name,
+			IsDir: child.IsDir,
+			Hash:  child.Hash,
+		})
+	}
+
+	return result, nil
+}
+
+func (n *Node) search(name string) int {
+	return sort.Search(len(n.Children), func(i int) bool {
+		return n.Children[i].Name >= name
+	})
+}
+
+func (n *Node) child(name string) *Node {
+	i := n.search(name)
+
+	if i < len(n.Children) && n.Children[i].Name == name {
+		return n.Children[i]
+	}
+
+	return nil
+}
+
+// setChild adds or replaces child, children are sorted by name, returns replaced child.
+func (n *Node) setChild(child *Node) *Node {
+	i := n.search(child.Name)
+
+	if i < len(n.Children) && n.Children[i].Name == child.Name {
+		replaced := n.Children[i]
+		n.Children[i] = child
+
+		return replaced
+	}
+
+	n.Children = append(n.Children, nil)
+	copy(n.Children[i+1:], n.Children[i:])
+	n.Children[i] = child
+
+	return nil
+}
+
+// removeChild removes child and returns it.
+func (n *Node) removeChild(name string) *Node {
+	i := n.search(name)
+
+	if i < len(n.Children) && n.Children[i].Name == name {
+		removed := n.Children[i]
+		n.Children = append(n.Children[:i], n.Children[i+1:]...)
+
+		return removed
+	}
+
+	return nil
+}
+
+// updateHash calculates directory hash from sorted children.
+func (n *Node) updateHash() {
+	hash := sha256.New()
+
+	for _, child := range n.Children {
+		fmt.Fprintf(hash, "%s\x00%t\x00%s\n", child.Name, child.IsDir, child.Hash)
+	}
+
+	n.Hash = hex.EncodeToString(hash.Sum(nil))
+}
+
+// newNode returns node of file or directory, nil if it does not exist or is not synced.
+func newNode(fullPath string) (*Node, error) {
+	fileInfo, err := os.Lstat(fullPath)
+	if os.IsNotExist(err) {
+		return nil, nil //nolint:nilnil
+	}
+
+	if err != nil {
+		return nil, errors.Wrap(err, "error in os.Lstat")
+	}
+
+	switch {
+	case fileInfo.IsDir():
+		return buildNode(fullPath, fileInfo.Name())
+	case fileInfo.Mode().IsRegular() && !api.IsTempFile(fileInfo.Name()):
+		fileHash, err := api.GetFileSHA256(fullPath, fileInfo)
+		if err != nil {
+			return nil, errors.Wrap(err, "error in api.GetFileSHA256")
+		}
+
+		return &Node{Name: fileInfo.Name(), Hash: fileHash}, nil
+	default:
+		return nil, nil //nolint:nilnil
+	}
+}
+
+func buildNode(dir, name string) (*Node, error) {
+	node := &Node{
+		Name:     name,
+		IsDir:    true,
+		Children: make([]*Node, 0),
+	}
+
+	// directory can be removed while tree is built
+	entries, err := os.ReadDir(dir)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, errors.Wrap(err, "error in os.ReadDir")
+	}
+
+	// entries are sorted by name
+	for _, entry := range entries {
+		entryPath := filepath.Join(dir, entry.Name())
+
+		var child *Node
+
+		switch {
+		case entry.IsDir():
+			child, err = buildNode(entryPath, entry.Name())
+			if err != nil {
+				return nil, err
+			}
+		case entry.Type().IsRegular() && !api.IsTempFile(entry.Name()):
+			fileInfo, err := entry.Info()
+			if err != nil {
+				return nil, errors.Wrap(err, "error in entry.Info")
+			}
+
+			fileHash, err := api.GetFileSHA256(entryPath, fileInfo)
+			if err != nil {
+				return nil, errors.Wrap(err, "error in api.GetFileSHA256")
+			}
+
+			child = &Node{Name: entry.Name(), Hash: fileHash}
+		default:
+			continue
+		}
+
+		node.Children = append(node.Children, child)
+	}
+
+	node.updateHash()
+
+	return node, nil
+}
+
+// Compare descends only into subtrees with different hashes and returns messages
+// that make remote tree equal to local, put and patch messages are without content.
+func Compare(ctx context.Context, local, remote GetNodeFunc) ([]api.Message, error) {
+	result := make([]api.Message, 0)
+
+	if err := compareNode(ctx, local, remote, "", &result); err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
+
+func compareNode(ctx context.Context, local, remote GetNodeFunc, nodePath string, result *[]api.Message) error { //nolint:cyclop,lll
+	localNode, err := local(ctx, nodePath)
+	if err != nil {
+		return err
+	}
+
+	remoteNode, err := remote(ctx, nodePath)
+	if err != nil {
+		return err
+	}
+
+	if localNode.Hash == remoteNode.Hash {
+		return nil
+	}
+
+	remoteChildren := make(map[string]*Node, len(remoteNode.Children))
+	for _, child := range remoteNode.Children {
+		remoteChildren[child.Name] = child
+	}
+
+	for _, localChild := range localNode.Children {
+		childPath := path.Join(nodePath, localChild.Name)
+		remoteChild, ok := remoteChildren[localChild.Name]
+
+		delete(remoteChildren, localChild.Name)
+
+		switch {
+		case ok && localChild.Hash == remoteChild.Hash && localChild.IsDir == remoteChild.IsDir:
+			continue
+		case ok && localChild.IsDir && remoteChild.IsDir:
+			err = compareNode(ctx, local, remote, childPath, result)
+		case localChild.IsDir:
+			if ok {
+				*result = append(*result, api.Message{Type: api.MessageTypeDelete, FileName: childPath})
+			}
+
+			err = collectFiles(ctx, local, childPath, api.MessageTypePut, result)
+		case ok && remoteChild.IsDir:
+			log.Warnf("%s is directory on destination", childPath)
+		case ok:
+			*result = append(*result, api.Message{Type: api.MessageTypePatch, FileName: childPath})
+		default:
+			*result = append(*result, api.Message{Type: api.MessageTypePut, FileName: childPath})
+		}
+
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, remoteChild := range remoteNode.Children {
+		if _, ok := remoteChildren[remoteChild.Name]; !ok {
+			continue
+		}
+
+		childPath := path.Join(nodePath, remoteChild.Name)
+
+		if !remoteChild.IsDir {
+			*result = append(*result, api.Message{Type: api.MessageTypeDelete, FileName: childPath})
+
+			continue
+		}
+
+		if err := collectFiles(ctx, remote, childPath, api.MessageTypeDelete, result); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// collectFiles adds message for every file in subtree.
+func collectFiles(ctx context.Context, getNode GetNodeFunc, nodePath, messageType string, result *[]api.Message) error {
+	node, err := getNode(ctx, nodePath)
+	if err != nil {
+		return err
+	}
+
+	for _, child := range node.Children {
+		childPath := path.Join(nodePath, child.Name)
+
+		if child.IsDir {
+			if err := collectFiles(ctx, getNode, childPath, messageType, result); err != nil {
+				return err
+			}
+
+			continue
+		}
+
+		*result = append(*result, api.Message{Type: messageType, FileName: childPath})
+	}
+
+	return nil
+}
+
+// GetRemoteNode returns node from destination hash tree.
+func GetRemoteNode(destination string) GetNodeFunc {
+	return func(ctx context.Context, nodePath string) (*Node, error) {
+		node := &Node{}
+
+		uri := "/api/merkle?path=" + url.QueryEscape(nodePath)
+
+		if err := api.GetJSON(ctx, destination, uri, node); err != nil {
+			return nil, errors.Wrap(err, "error in api.GetJSON")
+		}
+
+		return node, nil
+	}
+}
+
+// GetDestinationNode returns node from DestinationDir hash tree, tree is built on first request
+// and then updated with applied messages.
+func GetDestinationNode(ctx context.Context, nodePath string) (*Node, error) {
+	tree := getDestinationTree()
+
+	if err := tree.build(); err != nil {
+		return nil, err
+	}
+
+	return tree.Get(ctx, nodePath)
+}
+
+// getMessagePaths returns paths that are changed by message.
+func getMessagePaths(message api.Message) []string {
+	result := []string{message.FileName}
+
+	if len(message.NewFileName) > 0 {
+		result = append(result, message.NewFileName)
+	}
+
+	return result
+}
+
+// UpdateDestination updates DestinationDir hash tree with paths of applied message.
+func UpdateDestination(message api.Message) {
+	for _, fileName := range getMessagePaths(message) {
+		if err := getDestinationTree().Update(fileName); err != nil {
+			log.WithError(err).WithField("message", message.String()).Error("error in merkle.Tree.Update")
+		}
+	}
+}
+
+// UpdateSource updates SourceDir hash tree with paths of message that was sent.
+func UpdateSource(message api.Message) {
+	for _, fileName := range getMessagePaths(message) {
+		if err := getSourceTree().Update(fileName); err != nil {
+			log.WithError(err).WithField("message", message.String()).Error("error in merkle.Tree.Update")
+		}
+	}
+}
+
+// Run compares SourceDir hash tree with destination and sends messages to fix differences.
+func Run(ctx context.Context, destination string) (int, error) {
+	sourceTree := getSourceTree()
+
+	// SourceDir can be removed after tree was built
+	if _, err := os.Stat(sourceTree.root); os.IsNotExist(err) {
+		return 0, errors.Wrap(api.ErrFileNotFound, sourceTree.root)
+	}
+
+	if err := sourceTree.build(); err != nil {
+		return 0, err
+	}
+
+	messages, err := Compare(ctx, sourceTree.Get, GetRemoteNode(destination))
+	if err != nil {
+		return 0, err
+	}
+
+	metrics.MerkleDrift.WithLabelValues(destination).Set(float64(len(messages)))
+
+	if len(messages) > 0 {
+		log.Infof("merkle destination=%s,drift=%d", destination, len(messages))
+	}
+
+	for _, message := range messages {
+		if err := resync.Send(destination, message); err != nil {
+			return len(messages), err
+		}
+	}
+
+	return len(messages), nil
+}
+
+// Schedule compares hash trees with all destinations every merkle.interval.
+func Schedule(ctx context.Context, destinations []string) {
+	interval := *config.Get().MerkleInterval
+	if interval <= 0 {
+		return
+	}
+
+	log.Infof("merkle check scheduled every %s", interval)
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				for _, destination := range destinations {
+					if _, err := Run(ctx, destination); err != nil {
+						log.WithError(err).WithField("destination", destination).Error("error in merkle.Run")
+					}
+				}
+			}
+		}
+	}()
+}
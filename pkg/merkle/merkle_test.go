@@ -0,0 +1,203 @@
+/*
+Copyright paskal.maksim@gmail.com
+Licensed under the Apache License, Version 2.0 (the "License")
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package merkle_test
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/maksim-paskal/file-sync/pkg/api"
+	"github.com/maksim-paskal/file-sync/pkg/merkle"
+)
+
+func newTree(t *testing.T, files map[string]string) *merkle.Tree {
+	t.Helper()
+
+	return newTreeIn(t, t.TempDir(), files)
+}
+
+func newTreeIn(t *testing.T, root string, files map[string]string) *merkle.Tree {
+	t.Helper()
+
+	for fileName, content := range files {
+		filePath := filepath.Join(root, fileName)
+
+		if err := os.MkdirAll(filepath.Dir(filePath), 0o755); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := ioutil.WriteFile(filePath, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tree := merkle.NewTree(root)
+
+	if err := tree.Build(); err != nil {
+		t.Fatal(err)
+	}
+
+	return tree
+}
+
+func TestCompare(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+
+	local := newTree(t, map[string]string{
+		"same.txt":         "same",
+		"changed.txt":      "new",
+		"new.txt":          "new",
+		"dir/same.txt":     "same",
+		"dir/sub/new.txt":  "new",
+		"newdir/a/new.txt": "new",
+	})
+
+	remote := newTree(t, map[string]string{
+		"same.txt":          "same",
+		"changed.txt":       "old",
+		"deleted.txt":       "old",
+		"dir/same.txt":      "same",
+		"olddir/a/old1.txt": "old",
+		"olddir/old2.txt":   "old",
+	})
+
+	messages, err := merkle.Compare(ctx, local.Get, remote.Get)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []api.Message{
+		{Type: api.MessageTypePatch, FileName: "changed.txt"},
+		{Type: api.MessageTypePut, FileName: "dir/sub/new.txt"},
+		{Type: api.MessageTypePut, FileName: "new.txt"},
+		{Type: api.MessageTypePut, FileName: "newdir/a/new.txt"},
+		{Type: api.MessageTypeDelete, FileName: "deleted.txt"},
+		{Type: api.MessageTypeDelete, FileName: "olddir/a/old1.txt"},
+		{Type: api.MessageTypeDelete, FileName: "olddir/old2.txt"},
+	}
+
+	if !reflect.DeepEqual(messages, want) {
+		t.Fatalf("got=%+v,want=%+v", messages, want)
+	}
+
+	messages, err = merkle.Compare(ctx, local.Get, local.Get)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(messages) != 0 {
+		t.Fatalf("no changes expected, got=%+v", messages)
+	}
+}
+
+func TestTreeUpdate(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+
+	files := map[string]string{
+		"changed.txt":     "old",
+		"deleted.txt":     "old",
+		"dir/a.txt":       "a",
+		"olddir/a/b.txt":  "b",
+		"moved/file1.txt": "1",
+	}
+
+	root := t.TempDir()
+	tree := newTreeIn(t, root, files)
+
+	changes := map[string]string{
+		"changed.txt":        "new",
+		"new.txt":            "new",
+		"newdir/sub/new.txt": "new",
+	}
+
+	for fileName, content := range changes {
+		filePath := filepath.Join(root, fileName)
+
+		if err := os.MkdirAll(filepath.Dir(filePath), 0o755); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := ioutil.WriteFile(filePath, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := os.Remove(filepath.Join(root, "deleted.txt")); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.RemoveAll(filepath.Join(root, "olddir")); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.Rename(filepath.Join(root, "moved"), filepath.Join(root, "dir/moved")); err != nil {
+		t.Fatal(err)
+	}
+
+	// parent directory of new file is added with its content
+	for _, fileName := range []string{"changed.txt", "new.txt", "newdir/sub/new.txt", "deleted.txt", "olddir", "moved", "dir/moved"} { //nolint:lll
+		if err := tree.Update(fileName); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	built := merkle.NewTree(root)
+
+	if err := built.Build(); err != nil {
+		t.Fatal(err)
+	}
+
+	messages, err := merkle.Compare(ctx, tree.Get, built.Get)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(messages) != 0 {
+		t.Fatalf("updated tree must be equal to built tree, got=%+v", messages)
+	}
+
+	// tree with the same files has the same hash
+	updatedRoot, err := tree.Get(ctx, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	builtRoot, err := built.Get(ctx, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if updatedRoot.Hash != builtRoot.Hash {
+		t.Fatalf("hash %s must be %s", updatedRoot.Hash, builtRoot.Hash)
+	}
+}
+
+func TestBuildNotExists(t *testing.T) {
+	t.Parallel()
+
+	tree := merkle.NewTree(filepath.Join(t.TempDir(), "not-exists"))
+
+	// missing source would remove all files on destination
+	if err := tree.Build(); !errors.Is(err, api.ErrFileNotFound) {
+		t.Fatalf("must be file not found error, got %v", err)
+	}
+}
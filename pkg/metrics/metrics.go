@@ -71,6 +71,130 @@ var (
 			Help:      "Number communication errors",
 		},
 	)
+	MerkleDrift = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: moduleName,
+			Name:      "merkle_drift_files",
+			Help:      "Number of files that differ from destination on last hash tree check",
+		},
+		[]string{"destination"}, // labels
+	)
+	SendSHA256Errors = promauto.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: moduleName,
+			Name:      "send_sha256_errors_total",
+			Help:      "Number of files rejected by destination with SHA256 mismatch",
+		},
+	)
+	DeadLetterSize = promauto.NewGauge(
+		prometheus.GaugeOpts{
+			Namespace: moduleName,
+			Name:      "dlq_messages",
+			Help:      "Number of messages in dead-letter queue",
+		},
+	)
+	DeadLetterCounter = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: moduleName,
+			Name:      "dlq_added_total",
+			Help:      "Number of messages moved to dead-letter queue",
+		},
+		[]string{"type"}, // labels
+	)
+	DeadLetterRequeueCounter = promauto.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: moduleName,
+			Name:      "dlq_requeued_total",
+			Help:      "Number of messages requeued from dead-letter queue",
+		},
+	)
+	DeadLetterPurgeCounter = promauto.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: moduleName,
+			Name:      "dlq_purged_total",
+			Help:      "Number of messages purged from dead-letter queue",
+		},
+	)
+	QueueBacklog = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: moduleName,
+			Name:      "queue_backlog_messages",
+			Help:      "Number of messages in queue of destination",
+		},
+		[]string{"destination"}, // labels
+	)
+	QueueLag = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: moduleName,
+			Name:      "queue_lag_seconds",
+			Help:      "Age of oldest message in queue of destination",
+		},
+		[]string{"destination"}, // labels
+	)
+	DestinationState = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: moduleName,
+			Name:      "destination_state",
+			Help:      "Health of destination (0 = healthy, 1 = degraded, 2 = down)",
+		},
+		[]string{"destination"}, // labels
+	)
+	QueueWorkers = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: moduleName,
+			Name:      "queue_workers",
+			Help:      "Number of delivery workers of destination",
+		},
+		[]string{"destination"}, // labels
+	)
+	QueueWorkersBusy = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: moduleName,
+			Name:      "queue_workers_busy",
+			Help:      "Number of delivery workers of destination that deliver message",
+		},
+		[]string{"destination"}, // labels
+	)
+	QueueCoalescedCounter = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: moduleName,
+			Name:      "queue_coalesced_total",
+			Help:      "Number of messages merged with pending message of the same file",
+		},
+		[]string{"type"}, // labels
+	)
+	SyncDuplicateCounter = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: moduleName,
+			Name:      "sync_duplicate_total",
+			Help:      "Number of messages that were already applied on destination",
+		},
+		[]string{"type"}, // labels
+	)
+	SendDeltaCounter = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: moduleName,
+			Name:      "send_delta_total",
+			Help:      "Number of patches sent as delta and patches sent with full content after delta failure",
+		},
+		[]string{"result"}, // labels
+	)
+	SendCompressSavedBytes = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: moduleName,
+			Name:      "send_compress_saved_bytes_total",
+			Help:      "Number of bytes that were not sent because of compression",
+		},
+		[]string{"encoding"}, // labels
+	)
+	SendChunkCounter = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: moduleName,
+			Name:      "send_chunk_total",
+			Help:      "Number of sent chunks of uploads and chunks that destination already has",
+		},
+		[]string{"result"}, // labels
+	)
 )
 
 func GetHandler() http.Handler {
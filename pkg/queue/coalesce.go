@@ -0,0 +1,124 @@
+/*
+Copyright paskal.maksim@gmail.com
+Licensed under the Apache License, Version 2.0 (the "License")
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package queue
+
+import (
+	"strings"
+
+	"github.com/maksim-paskal/file-sync/pkg/api"
+	"github.com/maksim-paskal/file-sync/pkg/config"
+	"github.com/maksim-paskal/file-sync/pkg/metrics"
+)
+
+// results of coalesce.
+const (
+	// next item is added to queue
+	coalesceAdd = "add"
+	// pending item is replaced with merged item, next item is not added
+	coalesceReplace = "replace"
+	// pending item is removed, next item is added
+	coalesceCancel = "cancel"
+)
+
+// isWrite returns true if item writes full content of one file.
+func isWrite(item *Item) bool {
+	return (item.Message.Type == api.MessageTypePut || item.Message.Type == api.MessageTypePatch) &&
+		len(item.Message.NewFileName) == 0
+}
+
+// coalesce merges next item with pending write of the same file that was not consumed yet.
+// Newer put or patch replaces content of pending write, delete cancels pending write,
+// delete is still added, put can overwrite file that exists on destination.
+func coalesce(pending, next *Item) (string, *Item) {
+	if pending == nil || !*config.Get().QueueCoalesce {
+		return coalesceAdd, nil
+	}
+
+	switch next.Message.Type {
+	case api.MessageTypePut, api.MessageTypePatch:
+		merged := *next
+		// file must be created if it was not created yet
+		if pending.Message.Type == api.MessageTypePut {
+			merged.Message.Type = api.MessageTypePut
+		}
+
+		merged.Message.Force = pending.Message.Force || next.Message.Force
+		merged.Created = pending.Created
+		merged.receipt = pending.receipt
+
+		return coalesceReplace, &merged
+	case api.MessageTypeDelete:
+		return coalesceCancel, nil
+	default:
+		return coalesceAdd, nil
+	}
+}
+
+// observeCoalesce records result of coalesce of next item with pending item.
+func observeCoalesce(result, pendingID string, next *Item) {
+	if result == coalesceAdd {
+		return
+	}
+
+	metrics.QueueCoalescedCounter.WithLabelValues(next.Message.Type).Inc()
+
+	setJobCoalesced(pendingID, next)
+}
+
+func getID(item *Item) string {
+	if item == nil {
+		return ""
+	}
+
+	return item.ID
+}
+
+// pendingWrites is index of last not consumed write of every file, item can be merged
+// with pending write only if there are no other items of the file after pending write.
+type pendingWrites map[string]*Item
+
+// get returns pending write of file that can be merged with next item.
+func (p pendingWrites) get(next *Item) *Item {
+	if len(next.Message.NewFileName) > 0 {
+		return nil
+	}
+
+	return p[next.Message.FileName]
+}
+
+// add updates index with item that is added to the end of queue.
+func (p pendingWrites) add(item *Item) {
+	for _, fileName := range []string{item.Message.FileName, item.Message.NewFileName} {
+		delete(p, fileName)
+
+		// pending writes of files in directory can not be merged with items after directory operation
+		if api.IsDirType(item.Message.Type) && len(fileName) > 0 {
+			for name := range p {
+				if strings.HasPrefix(name, strings.TrimSuffix(fileName, "/")+"/") {
+					delete(p, name)
+				}
+			}
+		}
+	}
+
+	if isWrite(item) {
+		p[item.Message.FileName] = item
+	}
+}
+
+// remove removes item from index, item was consumed or removed.
+func (p pendingWrites) remove(item *Item) {
+	if p[item.Message.FileName] == item {
+		delete(p, item.Message.FileName)
+	}
+}
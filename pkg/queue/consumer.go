@@ -0,0 +1,444 @@
+/*
+Copyright paskal.maksim@gmail.com
+Licensed under the Apache License, Version 2.0 (the "License")
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package queue
+
+import (
+	"context"
+	"hash/fnv"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/maksim-paskal/file-sync/pkg/api"
+	"github.com/maksim-paskal/file-sync/pkg/config"
+	"github.com/maksim-paskal/file-sync/pkg/metrics"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+type blockedFile struct {
+	id    string
+	until time.Time
+	// directory operation blocks all files in directory
+	isDir bool
+}
+
+// activeFile is file of items that are dispatched to worker and not processed yet.
+type activeFile struct {
+	worker int
+	count  int
+	// number of directory operations with this file
+	dirs int
+}
+
+// consumer delivers items from queue with concurrent workers, items of one file are
+// delivered by one worker in queue order. Failed items are retried later with backoff
+// and do not block delivery of other items.
+type consumer struct {
+	queue       Queue
+	health      *Health
+	destination string
+	workers     []chan *Item
+
+	mutex sync.Mutex
+	// files with delayed retry, next changes of these files are delayed after retry to keep order
+	blocked map[string]blockedFile
+	active  map[string]activeFile
+	// notifies dispatcher that worker processed item
+	done chan struct{}
+}
+
+func newConsumer(destination *destinationQueue) *consumer {
+	workers := *config.Get().QueueWorkers
+	if workers < 1 {
+		workers = 1
+	}
+
+	c := &consumer{
+		queue:       destination.queue,
+		health:      destination.health,
+		destination: destination.name,
+		workers:     make([]chan *Item, workers),
+		blocked:     make(map[string]blockedFile),
+		active:      make(map[string]activeFile),
+		done:        make(chan struct{}, 1),
+	}
+
+	for i := range c.workers {
+		c.workers[i] = make(chan *Item, 1)
+	}
+
+	return c
+}
+
+func (c *consumer) run(ctx context.Context) {
+	metrics.QueueWorkers.WithLabelValues(c.destination).Set(float64(len(c.workers)))
+
+	var wg sync.WaitGroup
+
+	for i := range c.workers {
+		wg.Add(1)
+
+		go func(worker int) {
+			defer wg.Done()
+
+			for item := range c.workers[worker] {
+				c.work(ctx, item)
+			}
+		}(i)
+	}
+
+	c.dispatch(ctx)
+
+	for _, worker := range c.workers {
+		close(worker)
+	}
+
+	wg.Wait()
+}
+
+func (c *consumer) dispatch(ctx context.Context) {
+	for {
+		// delivery is paused while destination is down
+		c.health.wait(ctx)
+
+		item, err := c.queue.Consume(ctx)
+		if ctx.Err() != nil {
+			// consumer was stopped, item stays in queue
+			if item != nil {
+				c.nack(context.Background(), item)
+			}
+
+			return
+		}
+
+		if err != nil {
+			log.WithError(err).Error("error in queue.Consume")
+
+			select {
+			case <-ctx.Done():
+			case <-time.After(*config.Get().QueueBackoffMin):
+			}
+
+			continue
+		}
+
+		worker, ok := c.acquire(ctx, item)
+		if !ok {
+			c.nack(context.Background(), item)
+
+			return
+		}
+
+		select {
+		case <-ctx.Done():
+			c.release(item)
+			c.nack(context.Background(), item)
+
+			return
+		case c.workers[worker] <- item:
+		}
+	}
+}
+
+// acquire returns worker of item, item waits while its files are processed by other worker,
+// it happens when copy or move changes file of other worker.
+func (c *consumer) acquire(ctx context.Context, item *Item) (int, bool) {
+	fileKeys := getFileKeys(item)
+	worker := getWorker(fileKeys[0], len(c.workers))
+
+	for {
+		if c.tryAcquire(fileKeys, api.IsDirType(item.Message.Type), worker) {
+			return worker, true
+		}
+
+		select {
+		case <-ctx.Done():
+			return 0, false
+		case <-c.done:
+		}
+	}
+}
+
+func (c *consumer) tryAcquire(fileKeys []string, isDir bool, worker int) bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	// there are not more active files than items in workers
+	for activeKey, active := range c.active {
+		if active.worker == worker {
+			continue
+		}
+
+		for _, fileKey := range fileKeys {
+			if isConflict(fileKey, isDir, activeKey, active.dirs > 0) {
+				return false
+			}
+		}
+	}
+
+	for _, fileKey := range fileKeys {
+		active := c.active[fileKey]
+		active.worker = worker
+		active.count++
+
+		if isDir {
+			active.dirs++
+		}
+
+		c.active[fileKey] = active
+	}
+
+	return true
+}
+
+func (c *consumer) release(item *Item) {
+	c.mutex.Lock()
+
+	for _, fileKey := range getFileKeys(item) {
+		active := c.active[fileKey]
+		active.count--
+
+		if api.IsDirType(item.Message.Type) {
+			active.dirs--
+		}
+
+		if active.count <= 0 {
+			delete(c.active, fileKey)
+		} else {
+			c.active[fileKey] = active
+		}
+	}
+
+	c.mutex.Unlock()
+
+	select {
+	case c.done <- struct{}{}:
+	default:
+	}
+}
+
+func (c *consumer) work(ctx context.Context, item *Item) {
+	defer c.release(item)
+
+	// consumer was stopped, item stays in queue
+	if ctx.Err() != nil {
+		c.nack(context.Background(), item)
+
+		return
+	}
+
+	metrics.QueueWorkersBusy.WithLabelValues(c.destination).Inc()
+	defer metrics.QueueWorkersBusy.WithLabelValues(c.destination).Dec()
+
+	c.process(ctx, item)
+}
+
+func (c *consumer) process(ctx context.Context, item *Item) {
+	if until, ok := c.blockedUntil(item); ok {
+		// previous change of file will be retried first
+		item.NotBefore = until.Add(time.Millisecond)
+		c.nack(ctx, item)
+
+		return
+	}
+
+	setJobState(item, JobInflight, nil)
+
+	err := onNewValue(item.Message)
+	if err != nil {
+		item.Attempts++
+		item.LastError = err.Error()
+		item.LastAttempt = time.Now()
+
+		log.
+			WithError(err).
+			WithField("message", item.Message.String()).
+			WithField("attempts", item.Attempts).
+			Error("error in queue.onNewValue")
+
+		if api.IsRetryable(err) {
+			c.health.Failure(err)
+		} else {
+			// destination is available, message is rejected
+			c.health.Success()
+		}
+
+		if c.isRetryable(item, err) {
+			c.retry(ctx, item)
+
+			return
+		}
+
+		if err := addDeadLetter(item); err != nil {
+			log.
+				WithError(err).
+				WithField("message", item.Message.String()).
+				Error("error in queue.addDeadLetter")
+
+			// item is acknowledged only after destination or dead-letter queue processed it
+			c.retry(ctx, item)
+
+			return
+		}
+	}
+
+	if err == nil {
+		c.health.Success()
+
+		setJobState(item, JobDelivered, nil)
+	}
+
+	c.unblock(item)
+
+	if err := c.queue.Ack(ctx, item); err != nil {
+		log.WithError(err).Error("error in queue.Ack")
+	}
+}
+
+// isRetryable returns false if item reached retry count or max age.
+func (c *consumer) isRetryable(item *Item, err error) bool {
+	if !api.IsRetryable(err) {
+		return false
+	}
+
+	if item.Attempts < *config.Get().SyncRetryCount && time.Since(item.Created) < *config.Get().QueueMaxAge {
+		return true
+	}
+
+	metrics.QueueMaxRetryCountCounter.WithLabelValues(item.Message.Type).Inc()
+
+	return false
+}
+
+func (c *consumer) retry(ctx context.Context, item *Item) {
+	item.NotBefore = time.Now().Add(getBackoff(item.Attempts))
+
+	setJobState(item, JobRetrying, errors.New(item.LastError))
+
+	c.mutex.Lock()
+	for _, fileKey := range getFileKeys(item) {
+		c.blocked[fileKey] = blockedFile{id: item.ID, until: item.NotBefore, isDir: api.IsDirType(item.Message.Type)}
+	}
+	c.mutex.Unlock()
+
+	c.nack(ctx, item)
+}
+
+func (c *consumer) nack(ctx context.Context, item *Item) {
+	if err := c.queue.Nack(ctx, item); err != nil {
+		log.
+			WithError(err).
+			WithField("message", item.Message.String()).
+			Error("error in queue.Nack")
+	}
+}
+
+// blockedUntil returns time of retry of previous change of item files.
+func (c *consumer) blockedUntil(item *Item) (time.Time, bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	result := time.Time{}
+
+	for _, fileKey := range c.getBlockingKeys(item) {
+		blocked := c.blocked[fileKey]
+		if blocked.id == item.ID {
+			continue
+		}
+
+		// blocking item was processed by other consumer
+		if time.Since(blocked.until) > *config.Get().QueueBackoffMax {
+			delete(c.blocked, fileKey)
+
+			continue
+		}
+
+		if blocked.until.After(result) {
+			result = blocked.until
+		}
+	}
+
+	return result, !result.IsZero()
+}
+
+func (c *consumer) unblock(item *Item) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	for _, fileKey := range getFileKeys(item) {
+		if c.blocked[fileKey].id == item.ID {
+			delete(c.blocked, fileKey)
+		}
+	}
+}
+
+// getBlockingKeys returns blocked files that conflict with files of item.
+func (c *consumer) getBlockingKeys(item *Item) []string {
+	isDir := api.IsDirType(item.Message.Type)
+	result := make([]string, 0)
+
+	for _, fileKey := range getFileKeys(item) {
+		// file and its parent directories
+		for parentKey := fileKey; ; parentKey = parentKey[:strings.LastIndex(parentKey, "/")] {
+			if blocked, ok := c.blocked[parentKey]; ok && isConflict(fileKey, isDir, parentKey, blocked.isDir) {
+				result = append(result, parentKey)
+			}
+
+			if !strings.Contains(parentKey, "/") {
+				break
+			}
+		}
+
+		if !isDir {
+			continue
+		}
+
+		// files in directory
+		for blockedKey := range c.blocked {
+			if strings.HasPrefix(blockedKey, fileKey+"/") {
+				result = append(result, blockedKey)
+			}
+		}
+	}
+
+	return result
+}
+
+// isConflict returns true if changes of files must be delivered in order,
+// directory operation conflicts with all files in directory.
+func isConflict(fileKey string, isDir bool, otherKey string, otherIsDir bool) bool {
+	return fileKey == otherKey ||
+		(isDir && strings.HasPrefix(otherKey, fileKey+"/")) ||
+		(otherIsDir && strings.HasPrefix(fileKey, otherKey+"/"))
+}
+
+// getWorker returns worker of file, all changes of file are delivered by one worker.
+func getWorker(fileKey string, workers int) int {
+	hash := fnv.New32a()
+	_, _ = hash.Write([]byte(fileKey))
+
+	return int(hash.Sum32() % uint32(workers))
+}
+
+// getFileKeys returns files of destination that are changed by item.
+func getFileKeys(item *Item) []string {
+	result := []string{item.Message.Destination + ":" + filepath.Clean(item.Message.FileName)}
+
+	if len(item.Message.NewFileName) > 0 {
+		result = append(result, item.Message.Destination+":"+filepath.Clean(item.Message.NewFileName))
+	}
+
+	return result
+}
@@ -0,0 +1,201 @@
+/*
+Copyright paskal.maksim@gmail.com
+Licensed under the Apache License, Version 2.0 (the "License")
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package queue_test
+
+import (
+	"fmt"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/maksim-paskal/file-sync/pkg/api"
+	"github.com/maksim-paskal/file-sync/pkg/config"
+	"github.com/maksim-paskal/file-sync/pkg/queue"
+)
+
+func TestConsumerOrder(t *testing.T) { //nolint:paralleltest
+	const (
+		files    = 8
+		changes  = 20
+		workers  = 4
+		messages = files * changes
+	)
+
+	queueType := queue.TypeMemory
+	queueWorkers := workers
+	queueCoalesce := false
+
+	config.Get().QueueType = &queueType
+	config.Get().QueueWorkers = &queueWorkers
+
+	// every change must be delivered
+	defer func(value *bool) { config.Get().QueueCoalesce = value }(config.Get().QueueCoalesce)
+	config.Get().QueueCoalesce = &queueCoalesce
+
+	var (
+		mutex      sync.Mutex
+		last       = make(map[string]int)
+		running    int
+		maxRunning int
+		delivered  = make(chan struct{}, messages)
+	)
+
+	queue.OnNewValue = func(m api.Message) error {
+		mutex.Lock()
+		running++
+		if running > maxRunning {
+			maxRunning = running
+		}
+
+		change, _ := strconv.Atoi(m.ID)
+		if change <= last[m.FileName] {
+			t.Errorf("file %s change %d delivered after %d", m.FileName, change, last[m.FileName])
+		}
+
+		last[m.FileName] = change
+		mutex.Unlock()
+
+		time.Sleep(time.Millisecond)
+
+		mutex.Lock()
+		running--
+		mutex.Unlock()
+
+		delivered <- struct{}{}
+
+		return nil
+	}
+	defer func() { queue.OnNewValue = nil }()
+
+	if err := queue.Init(); err != nil {
+		t.Fatal(err)
+	}
+	defer queue.GracefullShutdown()
+
+	for change := 1; change <= changes; change++ {
+		for file := 0; file < files; file++ {
+			message := api.Message{
+				ID:       strconv.Itoa(change),
+				Type:     api.MessageTypePut,
+				FileName: fmt.Sprintf("file-%d.txt", file),
+			}
+
+			if _, err := queue.Send(message, []string{"test-order"}); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	for i := 0; i < messages; i++ {
+		select {
+		case <-delivered:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("delivered %d messages of %d", i, messages)
+		}
+	}
+
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	if maxRunning < 2 {
+		t.Fatalf("messages were delivered by %d workers", maxRunning)
+	}
+}
+
+func TestConsumerDirOrder(t *testing.T) { //nolint:paralleltest
+	const (
+		rounds  = 5
+		files   = 6
+		workers = 4
+	)
+
+	queueType := queue.TypeMemory
+	queueWorkers := workers
+	queueCoalesce := false
+
+	config.Get().QueueType = &queueType
+	config.Get().QueueWorkers = &queueWorkers
+
+	defer func(value *bool) { config.Get().QueueCoalesce = value }(config.Get().QueueCoalesce)
+	config.Get().QueueCoalesce = &queueCoalesce
+
+	var (
+		mutex   sync.Mutex
+		lastDir int
+		maxSeen int
+	)
+
+	messages := make([]api.Message, 0)
+
+	for round := 0; round < rounds; round++ {
+		for file := 0; file < files; file++ {
+			messages = append(messages, api.Message{Type: api.MessageTypePut, FileName: fmt.Sprintf("dir/sub/file-%d.txt", file)}) //nolint:lll
+		}
+
+		messages = append(messages, api.Message{Type: api.MessageTypeDeleteDir, FileName: "dir"})
+	}
+
+	delivered := make(chan struct{}, len(messages))
+
+	// files in directory are changed in queue order with directory operations
+	queue.OnNewValue = func(m api.Message) error {
+		seq, _ := strconv.Atoi(m.ID)
+
+		mutex.Lock()
+		if m.Type == api.MessageTypeDeleteDir && seq < maxSeen {
+			t.Errorf("directory change %d delivered after file change %d", seq, maxSeen)
+		}
+
+		if m.Type != api.MessageTypeDeleteDir && seq < lastDir {
+			t.Errorf("file change %d delivered after directory change %d", seq, lastDir)
+		}
+
+		if m.Type == api.MessageTypeDeleteDir {
+			lastDir = seq
+		}
+
+		if seq > maxSeen {
+			maxSeen = seq
+		}
+		mutex.Unlock()
+
+		time.Sleep(time.Millisecond)
+
+		delivered <- struct{}{}
+
+		return nil
+	}
+	defer func() { queue.OnNewValue = nil }()
+
+	if err := queue.Init(); err != nil {
+		t.Fatal(err)
+	}
+	defer queue.GracefullShutdown()
+
+	for i, message := range messages {
+		message.ID = strconv.Itoa(i + 1)
+
+		if _, err := queue.Send(message, []string{"test-dir-order"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for i := range messages {
+		select {
+		case <-delivered:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("delivered %d messages of %d", i, len(messages))
+		}
+	}
+}
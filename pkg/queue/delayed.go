@@ -0,0 +1,128 @@
+/*
+Copyright paskal.maksim@gmail.com
+Licensed under the Apache License, Version 2.0 (the "License")
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package queue
+
+import (
+	"context"
+	"math/rand"
+	"sort"
+	"time"
+
+	"github.com/maksim-paskal/file-sync/pkg/config"
+)
+
+// delayedItems are sorted by NotBefore, items with equal NotBefore keep order of adding.
+type delayedItems []*Item
+
+func (d *delayedItems) add(item *Item) {
+	i := sort.Search(len(*d), func(i int) bool {
+		return (*d)[i].NotBefore.After(item.NotBefore)
+	})
+
+	*d = append(*d, nil)
+	copy((*d)[i+1:], (*d)[i:])
+	(*d)[i] = item
+}
+
+// popDue removes and returns items with NotBefore before now.
+func (d *delayedItems) popDue(now time.Time) []*Item {
+	i := sort.Search(len(*d), func(i int) bool {
+		return (*d)[i].NotBefore.After(now)
+	})
+
+	result := make([]*Item, i)
+	copy(result, (*d)[:i])
+	*d = (*d)[i:]
+
+	return result
+}
+
+// next returns NotBefore of first item or zero time.
+func (d delayedItems) next() time.Time {
+	if len(d) == 0 {
+		return time.Time{}
+	}
+
+	return d[0].NotBefore
+}
+
+// waitUntil returns after notify, context done or until time if it's not zero.
+func waitUntil(ctx context.Context, notify <-chan struct{}, until time.Time) {
+	var timer <-chan time.Time
+
+	if !until.IsZero() {
+		t := time.NewTimer(time.Until(until))
+		defer t.Stop()
+
+		timer = t.C
+	}
+
+	select {
+	case <-ctx.Done():
+	case <-notify:
+	case <-timer:
+	}
+}
+
+// getBackoff returns exponential delay with jitter for next attempt.
+func getBackoff(attempts int) time.Duration {
+	backoffMin := *config.Get().QueueBackoffMin
+	backoffMax := *config.Get().QueueBackoffMax
+
+	delay := backoffMin
+
+	for i := 1; i < attempts && delay < backoffMax; i++ {
+		delay *= 2
+	}
+
+	if delay > backoffMax {
+		delay = backoffMax
+	}
+
+	if delay <= 0 {
+		return 0
+	}
+
+	// jitter spreads retries of many failed messages, delay is in [delay/2, delay]
+	half := delay / 2 //nolint:gomnd
+
+	return half + time.Duration(rand.Int63n(int64(delay-half)+1)) //nolint:gosec
+}
+
+// listItems returns copy of items page, limit 0 returns all items after offset.
+func listItems(items []*Item, offset, limit int64) []*Item {
+	result := make([]*Item, 0)
+
+	for i := offset; i < int64(len(items)) && (limit <= 0 || i < offset+limit); i++ {
+		item := *items[i]
+		result = append(result, &item)
+	}
+
+	return result
+}
+
+// splitItems returns items that do not match and items that match, order of items is kept.
+func splitItems(items []*Item, match func(*Item) bool) ([]*Item, []*Item) {
+	kept := make([]*Item, 0, len(items))
+	matched := make([]*Item, 0)
+
+	for _, item := range items {
+		if match(item) {
+			matched = append(matched, item)
+		} else {
+			kept = append(kept, item)
+		}
+	}
+
+	return kept, matched
+}
@@ -0,0 +1,225 @@
+/*
+Copyright paskal.maksim@gmail.com
+Licensed under the Apache License, Version 2.0 (the "License")
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package queue
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/maksim-paskal/file-sync/pkg/metrics"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// period of backlog and lag metrics update.
+const destinationMetricsInterval = 5 * time.Second
+
+// destinationQueue is queue of one destination, every destination has own consumer,
+// so slow or dead destination does not delay delivery to other destinations.
+type destinationQueue struct {
+	name   string
+	queue  Queue
+	health *Health
+}
+
+var (
+	destinationsMutex sync.Mutex
+	destinations      = make(map[string]*destinationQueue)
+	// creates queue of destination
+	newQueue func(destination string) (Queue, error)
+	// consumers are started for new destinations if true
+	destinationsConsume bool
+	destinationsCtx     = context.Background()
+	// consumers and metrics of destinations, they are stopped on shutdown
+	destinationsWaitGroup sync.WaitGroup
+)
+
+// stopDestinations stops consumers of destinations and waits until they are stopped.
+func stopDestinations(cancel func()) {
+	cancel()
+
+	destinationsWaitGroup.Wait()
+}
+
+func initDestinations(ctx context.Context, consume bool) {
+	destinationsMutex.Lock()
+	defer destinationsMutex.Unlock()
+
+	destinations = make(map[string]*destinationQueue)
+	destinationsConsume = consume
+	destinationsCtx = ctx
+}
+
+// getDestination returns queue of destination, queue is created on first use.
+func getDestination(name string) (*destinationQueue, error) {
+	destinationsMutex.Lock()
+	defer destinationsMutex.Unlock()
+
+	if destination, ok := destinations[name]; ok {
+		return destination, nil
+	}
+
+	if newQueue == nil {
+		return nil, errors.New("queue is not initialized")
+	}
+
+	q, err := newQueue(name)
+	if err != nil {
+		return nil, errors.Wrapf(err, "error in queue.newQueue %s", name)
+	}
+
+	destination := &destinationQueue{
+		name:   name,
+		queue:  q,
+		health: NewHealth(name),
+	}
+
+	destinations[name] = destination
+
+	if destinationsConsume {
+		destinationsWaitGroup.Add(1)
+
+		go func() {
+			defer destinationsWaitGroup.Done()
+
+			newConsumer(destination).run(destinationsCtx)
+		}()
+	}
+
+	destinationsWaitGroup.Add(1)
+
+	go func() {
+		defer destinationsWaitGroup.Done()
+
+		destination.updateMetrics(destinationsCtx)
+	}()
+
+	log.Debugf("queue of destination %s created", name)
+
+	return destination, nil
+}
+
+// getDestinations returns queues of all destinations ordered by name.
+func getDestinations() []*destinationQueue {
+	destinationsMutex.Lock()
+	defer destinationsMutex.Unlock()
+
+	result := make([]*destinationQueue, 0, len(destinations))
+
+	for _, destination := range destinations {
+		result = append(result, destination)
+	}
+
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].name < result[j].name
+	})
+
+	return result
+}
+
+// backlog returns number of queued items and age of oldest item.
+func (d *destinationQueue) backlog(ctx context.Context) (int64, time.Duration, error) {
+	length, err := d.queue.Len(ctx)
+	if err != nil {
+		return 0, 0, errors.Wrap(err, "error in queue.Len")
+	}
+
+	items, err := d.queue.List(ctx, 0, 1)
+	if err != nil {
+		return 0, 0, errors.Wrap(err, "error in queue.List")
+	}
+
+	lag := time.Duration(0)
+
+	if len(items) > 0 && !items[0].Created.IsZero() {
+		lag = time.Since(items[0].Created)
+	}
+
+	return length, lag, nil
+}
+
+func (d *destinationQueue) stats(ctx context.Context) (*DestinationStats, error) {
+	items, err := d.queue.List(ctx, 0, 0)
+	if err != nil {
+		return nil, errors.Wrapf(err, "error in queue.List %s", d.name)
+	}
+
+	length, err := d.queue.Len(ctx)
+	if err != nil {
+		return nil, errors.Wrapf(err, "error in queue.Len %s", d.name)
+	}
+
+	info, err := d.queue.Info(ctx)
+	if err != nil {
+		return nil, errors.Wrapf(err, "error in queue.Info %s", d.name)
+	}
+
+	result := &DestinationStats{
+		Destination: d.name,
+		State:       d.health.State(),
+		Depth:       length,
+		Info:        info,
+	}
+
+	for _, item := range items {
+		result.Bytes += getContentSize(item.Message)
+
+		// retried messages can be older than first message in queue
+		if !item.Created.IsZero() && time.Since(item.Created).Seconds() > result.OldestAge {
+			result.OldestAge = time.Since(item.Created).Seconds()
+		}
+	}
+
+	return result, nil
+}
+
+func (d *destinationQueue) updateMetrics(ctx context.Context) {
+	for {
+		length, lag, err := d.backlog(ctx)
+		if err != nil {
+			log.WithError(err).Errorf("error in backlog of destination %s", d.name)
+		} else {
+			metrics.QueueBacklog.WithLabelValues(d.name).Set(float64(length))
+			metrics.QueueLag.WithLabelValues(d.name).Set(lag.Seconds())
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(destinationMetricsInterval):
+		}
+	}
+}
+
+// GetDestinationsHealth returns state and backlog of all destinations.
+func GetDestinationsHealth() ([]HealthStatus, error) {
+	result := make([]HealthStatus, 0)
+
+	for _, destination := range getDestinations() {
+		status := destination.health.Status()
+
+		length, lag, err := destination.backlog(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		status.Backlog = length
+		status.Lag = lag.Seconds()
+
+		result = append(result, status)
+	}
+
+	return result, nil
+}
@@ -0,0 +1,677 @@
+/*
+Copyright paskal.maksim@gmail.com
+Licensed under the Apache License, Version 2.0 (the "License")
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package queue
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	diskLogName    = "queue.log"
+	diskLogTmpName = "queue.log.tmp"
+	// dead-letter queue folder in queue.dir
+	diskDeadLetterDir = "dlq"
+	diskDeadLetterExt = ".json"
+	// folder in queue.dir with queue of every destination
+	diskDestinationsDir = "destinations"
+	// prefix of destination folder, it makes folder name not empty and not "." or ".."
+	diskDestinationPrefix = "~"
+	// log is compacted when it has more acknowledged records than this value and than live items.
+	diskCompactRecords = 1000
+
+	diskOpAdd  = "add"
+	diskOpAck  = "ack"
+	diskOpNack = "nack"
+	// content of pending item is replaced by coalesce
+	diskOpUpdate = "update"
+)
+
+type diskRecord struct {
+	Op   string `json:"op"`
+	Seq  uint64 `json:"seq"`
+	Item *Item  `json:"item,omitempty"`
+}
+
+// DiskQueue keeps items in append-only log, every change is synced to disk before return.
+// Items that were consumed but not acknowledged are returned to queue after restart.
+type DiskQueue struct {
+	mutex    sync.Mutex
+	dir      string
+	file     *os.File
+	seq      uint64
+	pending  []*Item
+	delayed  delayedItems
+	inflight map[string]*Item
+	writes   pendingWrites
+	garbage  int
+	notify   chan struct{}
+}
+
+func NewDiskQueue(dir string) (*DiskQueue, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil { //nolint:gomnd
+		return nil, errors.Wrap(err, "error in os.MkdirAll")
+	}
+
+	q := &DiskQueue{
+		dir:      dir,
+		pending:  make([]*Item, 0),
+		delayed:  make(delayedItems, 0),
+		inflight: make(map[string]*Item),
+		writes:   make(pendingWrites),
+		notify:   make(chan struct{}, 1),
+	}
+
+	if err := q.replay(); err != nil {
+		return nil, err
+	}
+
+	// log is rewritten on start to remove acknowledged and partially written records
+	if err := q.compact(); err != nil {
+		return nil, err
+	}
+
+	return q, nil
+}
+
+func (q *DiskQueue) replay() error {
+	file, err := os.Open(filepath.Join(q.dir, diskLogName))
+	if os.IsNotExist(err) {
+		return nil
+	}
+
+	if err != nil {
+		return errors.Wrap(err, "error in os.Open")
+	}
+	defer file.Close()
+
+	items := make(map[uint64]*Item)
+	reader := bufio.NewReader(file)
+
+	for offset := 0; ; {
+		line, err := reader.ReadBytes('\n')
+		if errors.Is(err, io.EOF) {
+			if len(line) > 0 {
+				log.Warnf("ignoring partially written record at offset %d", offset)
+			}
+
+			break
+		}
+
+		if err != nil {
+			return errors.Wrap(err, "error in reader.ReadBytes")
+		}
+
+		record := diskRecord{}
+
+		if err := json.Unmarshal(line, &record); err != nil {
+			return errors.Wrapf(err, "corrupted record at offset %d", offset)
+		}
+
+		switch record.Op {
+		case diskOpAdd, diskOpNack, diskOpUpdate:
+			if record.Item == nil || (record.Op != diskOpAdd && items[record.Seq] == nil) {
+				break
+			}
+
+			record.Item.receipt = strconv.FormatUint(record.Seq, 10)
+			items[record.Seq] = record.Item
+		case diskOpAck:
+			delete(items, record.Seq)
+		}
+
+		if record.Seq > q.seq {
+			q.seq = record.Seq
+		}
+
+		offset += len(line)
+	}
+
+	seqs := make([]uint64, 0, len(items))
+	for seq := range items {
+		seqs = append(seqs, seq)
+	}
+
+	sort.Slice(seqs, func(i, j int) bool { return seqs[i] < seqs[j] })
+
+	now := time.Now()
+
+	for _, seq := range seqs {
+		if items[seq].NotBefore.After(now) {
+			q.delayed.add(items[seq])
+		} else {
+			q.pending = append(q.pending, items[seq])
+		}
+	}
+
+	// retried items are not merged with next items
+	for _, item := range q.pending {
+		if item.Attempts == 0 {
+			q.writes.add(item)
+		}
+	}
+
+	return nil
+}
+
+// compact writes live items to new log and replaces old log with it.
+func (q *DiskQueue) compact() error {
+	tmpName := filepath.Join(q.dir, diskLogTmpName)
+
+	tmp, err := os.OpenFile(tmpName, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0o644) //nolint:gomnd
+	if err != nil {
+		return errors.Wrap(err, "error in os.OpenFile")
+	}
+
+	inflight := make([]*Item, 0, len(q.inflight))
+	for _, item := range q.inflight {
+		inflight = append(inflight, item)
+	}
+
+	sort.Slice(inflight, func(i, j int) bool { return receiptSeq(inflight[i]) < receiptSeq(inflight[j]) })
+
+	writer := bufio.NewWriter(tmp)
+
+	live := append(append(inflight, q.pending...), q.delayed...)
+
+	for _, item := range live {
+		if err := writeRecord(writer, diskRecord{Op: diskOpAdd, Seq: receiptSeq(item), Item: item}); err != nil {
+			tmp.Close()
+
+			return err
+		}
+	}
+
+	if err := writer.Flush(); err != nil {
+		tmp.Close()
+
+		return errors.Wrap(err, "error in writer.Flush")
+	}
+
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+
+		return errors.Wrap(err, "error in file.Sync")
+	}
+
+	if err := tmp.Close(); err != nil {
+		return errors.Wrap(err, "error in file.Close")
+	}
+
+	logName := filepath.Join(q.dir, diskLogName)
+
+	if err := os.Rename(tmpName, logName); err != nil {
+		return errors.Wrap(err, "error in os.Rename")
+	}
+
+	if err := syncDir(q.dir); err != nil {
+		return err
+	}
+
+	if q.file != nil {
+		q.file.Close()
+	}
+
+	q.file, err = os.OpenFile(logName, os.O_APPEND|os.O_WRONLY, 0o644) //nolint:gomnd
+	if err != nil {
+		return errors.Wrap(err, "error in os.OpenFile")
+	}
+
+	q.garbage = 0
+
+	return nil
+}
+
+func receiptSeq(item *Item) uint64 {
+	seq, _ := strconv.ParseUint(item.receipt, 10, 64)
+
+	return seq
+}
+
+func writeRecord(w io.Writer, record diskRecord) error {
+	recordJSON, err := json.Marshal(record)
+	if err != nil {
+		return errors.Wrap(err, "error in json.Marshal")
+	}
+
+	if _, err := w.Write(append(recordJSON, '\n')); err != nil {
+		return errors.Wrap(err, "error in Write")
+	}
+
+	return nil
+}
+
+func (q *DiskQueue) append(record diskRecord) error {
+	if err := writeRecord(q.file, record); err != nil {
+		return err
+	}
+
+	if err := q.file.Sync(); err != nil {
+		return errors.Wrap(err, "error in file.Sync")
+	}
+
+	return nil
+}
+
+func (q *DiskQueue) wakeup() {
+	select {
+	case q.notify <- struct{}{}:
+	default:
+	}
+}
+
+func (q *DiskQueue) Add(ctx context.Context, item *Item) error {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	pending := q.writes.get(item)
+	result, merged := coalesce(pending, item)
+	pendingID := getID(pending)
+
+	switch result {
+	case coalesceReplace:
+		if err := q.append(diskRecord{Op: diskOpUpdate, Seq: receiptSeq(pending), Item: merged}); err != nil {
+			return err
+		}
+
+		*pending = *merged
+		q.garbage++
+	case coalesceCancel:
+		if err := q.append(diskRecord{Op: diskOpAck, Seq: receiptSeq(pending)}); err != nil {
+			return err
+		}
+
+		q.remove(pending)
+		q.garbage += 2
+	}
+
+	observeCoalesce(result, pendingID, item)
+
+	if result == coalesceReplace {
+		return q.compactIfNeeded()
+	}
+
+	seq := q.seq + 1
+
+	if err := q.append(diskRecord{Op: diskOpAdd, Seq: seq, Item: item}); err != nil {
+		return err
+	}
+
+	q.seq = seq
+	item.receipt = strconv.FormatUint(seq, 10)
+	q.pending = append(q.pending, item)
+	q.writes.add(item)
+
+	q.wakeup()
+
+	return nil
+}
+
+func (q *DiskQueue) Consume(ctx context.Context) (*Item, error) {
+	for {
+		q.mutex.Lock()
+
+		// retries are delivered before new items
+		if due := q.delayed.popDue(time.Now()); len(due) > 0 {
+			q.pending = append(due, q.pending...)
+		}
+
+		if len(q.pending) > 0 {
+			item := q.pending[0]
+			q.pending = q.pending[1:]
+			q.writes.remove(item)
+			q.inflight[item.receipt] = item
+			hasMore := len(q.pending) > 0
+			q.mutex.Unlock()
+
+			// other consumers can take next item
+			if hasMore {
+				q.wakeup()
+			}
+
+			return item, nil
+		}
+
+		next := q.delayed.next()
+		q.mutex.Unlock()
+
+		waitUntil(ctx, q.notify, next)
+
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+	}
+}
+
+func (q *DiskQueue) remove(item *Item) {
+	q.writes.remove(item)
+
+	for i := range q.pending {
+		if q.pending[i] == item {
+			q.pending = append(q.pending[:i], q.pending[i+1:]...)
+
+			return
+		}
+	}
+}
+
+func (q *DiskQueue) Ack(ctx context.Context, item *Item) error {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	if _, ok := q.inflight[item.receipt]; !ok {
+		return nil
+	}
+
+	if err := q.append(diskRecord{Op: diskOpAck, Seq: receiptSeq(item)}); err != nil {
+		return err
+	}
+
+	delete(q.inflight, item.receipt)
+
+	// add and ack records of item
+	q.garbage += 2
+
+	return q.compactIfNeeded()
+}
+
+func (q *DiskQueue) compactIfNeeded() error {
+	if q.garbage > diskCompactRecords && q.garbage > len(q.pending)+len(q.delayed)+len(q.inflight) {
+		if err := q.compact(); err != nil {
+			return errors.Wrap(err, "error in queue.compact")
+		}
+	}
+
+	return nil
+}
+
+func (q *DiskQueue) Nack(ctx context.Context, item *Item) error {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	if _, ok := q.inflight[item.receipt]; !ok {
+		return nil
+	}
+
+	// attempts, last error and next attempt time of item are persisted
+	if err := q.append(diskRecord{Op: diskOpNack, Seq: receiptSeq(item), Item: item}); err != nil {
+		return err
+	}
+
+	q.garbage++
+
+	delete(q.inflight, item.receipt)
+
+	if item.NotBefore.After(time.Now()) {
+		q.delayed.add(item)
+	} else {
+		q.pending = append([]*Item{item}, q.pending...)
+	}
+
+	q.wakeup()
+
+	return nil
+}
+
+func (q *DiskQueue) Len(ctx context.Context) (int64, error) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	return int64(len(q.pending) + len(q.delayed)), nil
+}
+
+func (q *DiskQueue) List(ctx context.Context, offset, limit int64) ([]*Item, error) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	return listItems(append(q.pending[:len(q.pending):len(q.pending)], q.delayed...), offset, limit), nil
+}
+
+func (q *DiskQueue) Delete(ctx context.Context, match func(*Item) bool) ([]*Item, error) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	pending, removed := splitItems(q.pending, match)
+	delayed, removedDelayed := splitItems(q.delayed, match)
+	removed = append(removed, removedDelayed...)
+
+	for _, item := range removed {
+		if err := q.append(diskRecord{Op: diskOpAck, Seq: receiptSeq(item)}); err != nil {
+			return nil, err
+		}
+	}
+
+	q.pending = pending
+	q.delayed = delayed
+
+	for _, item := range removed {
+		q.writes.remove(item)
+	}
+
+	// add and ack records of every item
+	q.garbage += 2 * len(removed)
+
+	return removed, q.compactIfNeeded()
+}
+
+func (q *DiskQueue) Flush(ctx context.Context) error {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	q.pending = make([]*Item, 0)
+	q.delayed = make(delayedItems, 0)
+	q.inflight = make(map[string]*Item)
+	q.writes = make(pendingWrites)
+
+	return q.compact()
+}
+
+func (q *DiskQueue) Info(ctx context.Context) (map[string]interface{}, error) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	fileInfo, err := q.file.Stat()
+	if err != nil {
+		return nil, errors.Wrap(err, "error in file.Stat")
+	}
+
+	return map[string]interface{}{
+		"type":     TypeDisk,
+		"dir":      q.dir,
+		"inflight": len(q.inflight),
+		"logSize":  fileInfo.Size(),
+	}, nil
+}
+
+// Close closes log file, queue can not be used after close.
+func (q *DiskQueue) Close() error {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	return q.file.Close()
+}
+
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return errors.Wrap(err, "error in os.Open")
+	}
+	defer d.Close()
+
+	if err := d.Sync(); err != nil {
+		return errors.Wrap(err, "error in dir.Sync")
+	}
+
+	return nil
+}
+
+func getDiskQueueDir(dir, destination string) string {
+	return filepath.Join(dir, diskDestinationsDir, url.QueryEscape(diskDestinationPrefix+destination))
+}
+
+// getDiskDestinations returns destinations that have queue in dir.
+func getDiskDestinations(dir string) ([]string, error) {
+	entries, err := os.ReadDir(filepath.Join(dir, diskDestinationsDir))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+
+	if err != nil {
+		return nil, errors.Wrap(err, "error in os.ReadDir")
+	}
+
+	result := make([]string, 0, len(entries))
+
+	for _, entry := range entries {
+		name, err := url.QueryUnescape(entry.Name())
+		if !entry.IsDir() || err != nil || !strings.HasPrefix(name, diskDestinationPrefix) {
+			log.Warnf("unknown folder %s in %s", entry.Name(), diskDestinationsDir)
+
+			continue
+		}
+
+		result = append(result, strings.TrimPrefix(name, diskDestinationPrefix))
+	}
+
+	return result, nil
+}
+
+// DiskDeadLetterQueue keeps every item in separate file.
+type DiskDeadLetterQueue struct {
+	mutex sync.Mutex
+	dir   string
+}
+
+func NewDiskDeadLetterQueue(dir string) (*DiskDeadLetterQueue, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil { //nolint:gomnd
+		return nil, errors.Wrap(err, "error in os.MkdirAll")
+	}
+
+	return &DiskDeadLetterQueue{dir: dir}, nil
+}
+
+// item id can contain any characters.
+func (q *DiskDeadLetterQueue) fileName(id string) string {
+	hash := sha256.Sum256([]byte(id))
+
+	return filepath.Join(q.dir, hex.EncodeToString(hash[:])+diskDeadLetterExt)
+}
+
+func (q *DiskDeadLetterQueue) Add(ctx context.Context, item *Item) error {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	itemJSON, err := json.Marshal(item)
+	if err != nil {
+		return errors.Wrap(err, "error in json.Marshal")
+	}
+
+	fileName := q.fileName(item.ID)
+	tmpName := fileName + ".tmp"
+
+	if err := os.WriteFile(tmpName, itemJSON, 0o644); err != nil { //nolint:gomnd
+		return errors.Wrap(err, "error in os.WriteFile")
+	}
+
+	if err := os.Rename(tmpName, fileName); err != nil {
+		return errors.Wrap(err, "error in os.Rename")
+	}
+
+	return syncDir(q.dir)
+}
+
+func (q *DiskDeadLetterQueue) Get(ctx context.Context, id string) (*Item, error) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	return q.read(q.fileName(id))
+}
+
+func (q *DiskDeadLetterQueue) read(fileName string) (*Item, error) {
+	itemJSON, err := os.ReadFile(fileName)
+	if os.IsNotExist(err) {
+		return nil, ErrNotFound
+	}
+
+	if err != nil {
+		return nil, errors.Wrap(err, "error in os.ReadFile")
+	}
+
+	item := &Item{}
+
+	if err := json.Unmarshal(itemJSON, item); err != nil {
+		return nil, errors.Wrapf(err, "error in json.Unmarshal %s", fileName)
+	}
+
+	return item, nil
+}
+
+func (q *DiskDeadLetterQueue) List(ctx context.Context) ([]*Item, error) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	fileNames, err := filepath.Glob(filepath.Join(q.dir, "*"+diskDeadLetterExt))
+	if err != nil {
+		return nil, errors.Wrap(err, "error in filepath.Glob")
+	}
+
+	result := make([]*Item, 0, len(fileNames))
+
+	for _, fileName := range fileNames {
+		item, err := q.read(fileName)
+		if err != nil {
+			return nil, err
+		}
+
+		result = append(result, item)
+	}
+
+	sortByFailed(result)
+
+	return result, nil
+}
+
+func (q *DiskDeadLetterQueue) Remove(ctx context.Context, id string) error {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	if err := os.Remove(q.fileName(id)); err != nil && !os.IsNotExist(err) {
+		return errors.Wrap(err, "error in os.Remove")
+	}
+
+	return nil
+}
+
+func (q *DiskDeadLetterQueue) Len(ctx context.Context) (int64, error) {
+	fileNames, err := filepath.Glob(filepath.Join(q.dir, "*"+diskDeadLetterExt))
+	if err != nil {
+		return 0, errors.Wrap(err, "error in filepath.Glob")
+	}
+
+	return int64(len(fileNames)), nil
+}
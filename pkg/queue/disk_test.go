@@ -0,0 +1,288 @@
+/*
+Copyright paskal.maksim@gmail.com
+Licensed under the Apache License, Version 2.0 (the "License")
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package queue_test
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/maksim-paskal/file-sync/pkg/api"
+	"github.com/maksim-paskal/file-sync/pkg/queue"
+)
+
+func TestDiskQueueReplay(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	dir := t.TempDir()
+
+	q, err := queue.NewDiskQueue(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 4; i++ {
+		item := &queue.Item{
+			ID:      strconv.Itoa(i),
+			Message: api.Message{Type: api.MessageTypePut, FileName: strconv.Itoa(i)},
+		}
+
+		if err := q.Add(ctx, item); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// first item is delivered
+	item, err := q.Consume(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := q.Ack(ctx, item); err != nil {
+		t.Fatal(err)
+	}
+
+	// second item failed
+	item, err = q.Consume(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	item.Attempts++
+
+	if err := q.Nack(ctx, item); err != nil {
+		t.Fatal(err)
+	}
+
+	// process was killed while delivering second item
+	if _, err = q.Consume(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := q.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// partially written record
+	logFile, err := os.OpenFile(filepath.Join(dir, "queue.log"), os.O_APPEND|os.O_WRONLY, 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := logFile.WriteString(`{"op":"add","seq":5,"ite`); err != nil {
+		t.Fatal(err)
+	}
+
+	logFile.Close()
+
+	q, err = queue.NewDiskQueue(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.Close()
+
+	if length, _ := q.Len(ctx); length != 3 {
+		t.Fatalf("length %d must be 3", length)
+	}
+
+	for i := 1; i < 4; i++ {
+		item, err := q.Consume(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if item.ID != strconv.Itoa(i) {
+			t.Fatalf("wrong order %s, must be %d", item.ID, i)
+		}
+
+		if i == 1 && item.Attempts != 1 {
+			t.Fatalf("attempts %d must be 1", item.Attempts)
+		}
+	}
+}
+
+func TestDiskQueueCompact(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	dir := t.TempDir()
+
+	q, err := queue.NewDiskQueue(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.Close()
+
+	for i := 0; i < 2000; i++ {
+		if err := q.Add(ctx, &queue.Item{ID: strconv.Itoa(i)}); err != nil {
+			t.Fatal(err)
+		}
+
+		item, err := q.Consume(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := q.Ack(ctx, item); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	fileInfo, err := os.Stat(filepath.Join(dir, "queue.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// log must contain only records after last compaction
+	if fileInfo.Size() > 200*1024 {
+		t.Fatalf("log size %d is too big", fileInfo.Size())
+	}
+}
+
+func TestDiskQueueCoalesce(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	dir := t.TempDir()
+
+	q, err := queue.NewDiskQueue(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	messages := []api.Message{
+		{ID: "1", Type: api.MessageTypePut, FileName: "a.txt", FileContent: "1"},
+		{ID: "2", Type: api.MessageTypePut, FileName: "b.txt", FileContent: "1", Force: true},
+		{ID: "3", Type: api.MessageTypePatch, FileName: "a.txt", FileContent: "2"},
+		{ID: "4", Type: api.MessageTypeDelete, FileName: "b.txt"},
+	}
+
+	for _, message := range messages {
+		if err := q.Add(ctx, &queue.Item{ID: message.ID, Message: message}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := q.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// merged items are restored from log
+	q, err = queue.NewDiskQueue(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.Close()
+
+	items, err := q.List(ctx, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(items) != 2 {
+		t.Fatalf("length %d must be 2", len(items))
+	}
+
+	if items[0].ID != "3" || items[0].Message.Type != api.MessageTypePut || items[0].Message.FileContent != "2" {
+		t.Fatalf("wrong item %+v", items[0].Message)
+	}
+
+	if items[1].ID != "4" || items[1].Message.Type != api.MessageTypeDelete {
+		t.Fatalf("wrong item %+v", items[1].Message)
+	}
+}
+
+func TestDiskQueueDelete(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	dir := t.TempDir()
+
+	q, err := queue.NewDiskQueue(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	messages := []api.Message{
+		{ID: "1", Type: api.MessageTypePut, FileName: "a.txt"},
+		{ID: "2", Type: api.MessageTypePut, FileName: "b.txt"},
+		{ID: "3", Type: api.MessageTypeDelete, FileName: "c.txt"},
+	}
+
+	for _, message := range messages {
+		if err := q.Add(ctx, &queue.Item{ID: message.ID, Message: message}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// first item is delayed
+	item, err := q.Consume(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	item.NotBefore = time.Now().Add(time.Hour)
+
+	if err := q.Nack(ctx, item); err != nil {
+		t.Fatal(err)
+	}
+
+	removed, err := q.Delete(ctx, func(item *queue.Item) bool {
+		return item.Message.Type == api.MessageTypePut
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(removed) != 2 {
+		t.Fatalf("removed %d items, must be 2", len(removed))
+	}
+
+	// new write is not merged with removed item
+	next := &queue.Item{ID: "4", Message: api.Message{Type: api.MessageTypePatch, FileName: "b.txt"}}
+
+	if err := q.Add(ctx, next); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := q.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	q, err = queue.NewDiskQueue(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.Close()
+
+	items, err := q.List(ctx, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(items) != 2 || items[0].ID != "3" || items[1].ID != "4" {
+		t.Fatalf("wrong items %+v", items)
+	}
+}
@@ -0,0 +1,267 @@
+/*
+Copyright paskal.maksim@gmail.com
+Licensed under the Apache License, Version 2.0 (the "License")
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package queue
+
+import (
+	"context"
+	"path"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/maksim-paskal/file-sync/pkg/metrics"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+var ErrNotFound = errors.New("item not found")
+
+// DeadLetterQueue keeps items that can not be delivered.
+type DeadLetterQueue interface {
+	Add(ctx context.Context, item *Item) error
+	// Get returns ErrNotFound if item does not exists.
+	Get(ctx context.Context, id string) (*Item, error)
+	// List returns all items ordered by failed time.
+	List(ctx context.Context) ([]*Item, error)
+	Remove(ctx context.Context, id string) error
+	Len(ctx context.Context) (int64, error)
+}
+
+var deadLetters DeadLetterQueue
+
+// Filter selects items, empty fields match all items, File is path.Match pattern.
+type Filter struct {
+	ID          string
+	Type        string
+	Destination string
+	File        string
+}
+
+func (f Filter) IsEmpty() bool {
+	return f == Filter{}
+}
+
+func (f Filter) Match(item *Item) bool {
+	if len(f.ID) > 0 && f.ID != item.ID {
+		return false
+	}
+
+	if len(f.Type) > 0 && f.Type != item.Message.Type {
+		return false
+	}
+
+	if len(f.Destination) > 0 && f.Destination != item.Message.Destination {
+		return false
+	}
+
+	if len(f.File) > 0 {
+		matched, _ := path.Match(f.File, item.Message.FileName)
+		if !matched {
+			return false
+		}
+	}
+
+	return true
+}
+
+func sortByFailed(items []*Item) {
+	sort.SliceStable(items, func(i, j int) bool {
+		return items[i].Failed.Before(items[j].Failed)
+	})
+}
+
+func updateDeadLetterMetrics() {
+	length, err := deadLetters.Len(ctx)
+	if err != nil {
+		log.WithError(err).Error("error in deadLetters.Len")
+
+		return
+	}
+
+	metrics.DeadLetterSize.Set(float64(length))
+}
+
+func addDeadLetter(item *Item) error {
+	item.Failed = time.Now()
+
+	if err := deadLetters.Add(ctx, item); err != nil {
+		return err
+	}
+
+	setJobState(item, JobDeadLettered, errors.New(item.LastError))
+
+	log.
+		WithField("message", item.Message.String()).
+		WithField("attempts", item.Attempts).
+		Warnf("message moved to dead-letter queue: %s", item.LastError)
+
+	metrics.DeadLetterCounter.WithLabelValues(item.Message.Type).Inc()
+
+	updateDeadLetterMetrics()
+
+	return nil
+}
+
+// ListDeadLetters returns items from dead-letter queue that match filter.
+func ListDeadLetters(filter Filter, offset, limit int) ([]*Item, error) {
+	items, err := deadLetters.List(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	result := make([]*Item, 0)
+
+	for _, item := range items {
+		if !filter.Match(item) {
+			continue
+		}
+
+		if offset > 0 {
+			offset--
+
+			continue
+		}
+
+		if limit > 0 && len(result) >= limit {
+			break
+		}
+
+		result = append(result, item)
+	}
+
+	return result, nil
+}
+
+func GetDeadLetter(id string) (*Item, error) {
+	return deadLetters.Get(ctx, id)
+}
+
+// RequeueDeadLetters adds items that match filter to queue, attempts of items are reset.
+func RequeueDeadLetters(filter Filter) (int, error) {
+	items, err := ListDeadLetters(filter, 0, 0)
+	if err != nil {
+		return 0, err
+	}
+
+	defer updateDeadLetterMetrics()
+
+	for i, item := range items {
+		item.Attempts = 0
+		item.Failed = time.Time{}
+
+		setJobState(item, JobQueued, nil)
+
+		if err := addItem(item); err != nil {
+			return i, err
+		}
+
+		// item can be duplicated if process is killed here
+		if err := deadLetters.Remove(ctx, item.ID); err != nil {
+			return i, errors.Wrap(err, "error in deadLetters.Remove")
+		}
+
+		metrics.DeadLetterRequeueCounter.Inc()
+	}
+
+	return len(items), nil
+}
+
+// PurgeDeadLetters removes items that match filter.
+func PurgeDeadLetters(filter Filter) (int, error) {
+	items, err := ListDeadLetters(filter, 0, 0)
+	if err != nil {
+		return 0, err
+	}
+
+	defer updateDeadLetterMetrics()
+
+	for i, item := range items {
+		if err := deadLetters.Remove(ctx, item.ID); err != nil {
+			return i, errors.Wrap(err, "error in deadLetters.Remove")
+		}
+
+		setJobState(item, JobFailed, errors.New(item.LastError))
+
+		metrics.DeadLetterPurgeCounter.Inc()
+	}
+
+	return len(items), nil
+}
+
+// MemoryDeadLetterQueue keeps items in process memory.
+type MemoryDeadLetterQueue struct {
+	mutex sync.Mutex
+	items map[string]*Item
+}
+
+func NewMemoryDeadLetterQueue() *MemoryDeadLetterQueue {
+	return &MemoryDeadLetterQueue{
+		items: make(map[string]*Item),
+	}
+}
+
+func (q *MemoryDeadLetterQueue) Add(ctx context.Context, item *Item) error {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	value := *item
+	q.items[item.ID] = &value
+
+	return nil
+}
+
+func (q *MemoryDeadLetterQueue) Get(ctx context.Context, id string) (*Item, error) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	item, ok := q.items[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+
+	value := *item
+
+	return &value, nil
+}
+
+func (q *MemoryDeadLetterQueue) List(ctx context.Context) ([]*Item, error) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	result := make([]*Item, 0, len(q.items))
+
+	for _, item := range q.items {
+		value := *item
+		result = append(result, &value)
+	}
+
+	sortByFailed(result)
+
+	return result, nil
+}
+
+func (q *MemoryDeadLetterQueue) Remove(ctx context.Context, id string) error {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	delete(q.items, id)
+
+	return nil
+}
+
+func (q *MemoryDeadLetterQueue) Len(ctx context.Context) (int64, error) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	return int64(len(q.items)), nil
+}
@@ -0,0 +1,124 @@
+/*
+Copyright paskal.maksim@gmail.com
+Licensed under the Apache License, Version 2.0 (the "License")
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package queue_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/maksim-paskal/file-sync/pkg/api"
+	"github.com/maksim-paskal/file-sync/pkg/queue"
+)
+
+func TestFilter(t *testing.T) {
+	t.Parallel()
+
+	item := &queue.Item{
+		ID: "1",
+		Message: api.Message{
+			Type:        api.MessageTypePut,
+			Destination: "10.10.10.10",
+			FileName:    "tests/test.txt",
+		},
+	}
+
+	tests := []struct {
+		filter queue.Filter
+		match  bool
+	}{
+		{queue.Filter{}, true},
+		{queue.Filter{ID: "1"}, true},
+		{queue.Filter{ID: "2"}, false},
+		{queue.Filter{Type: api.MessageTypePut, Destination: "10.10.10.10"}, true},
+		{queue.Filter{Type: api.MessageTypeDelete}, false},
+		{queue.Filter{Destination: "11.11.11.11"}, false},
+		{queue.Filter{File: "tests/*.txt"}, true},
+		{queue.Filter{File: "*.txt"}, false},
+	}
+
+	for _, test := range tests {
+		if match := test.filter.Match(item); match != test.match {
+			t.Errorf("filter %+v match=%t, must be %t", test.filter, match, test.match)
+		}
+	}
+}
+
+func testDeadLetterQueue(t *testing.T, q queue.DeadLetterQueue) {
+	t.Helper()
+
+	ctx := context.Background()
+	now := time.Now()
+
+	for _, id := range []string{"b", "a", "c/../d"} {
+		item := &queue.Item{
+			ID:      id,
+			Failed:  now,
+			Message: api.Message{Type: api.MessageTypePut},
+		}
+
+		if err := q.Add(ctx, item); err != nil {
+			t.Fatal(err)
+		}
+
+		now = now.Add(time.Second)
+	}
+
+	items, err := q.List(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(items) != 3 || items[0].ID != "b" || items[2].ID != "c/../d" {
+		t.Fatalf("wrong list %+v", items)
+	}
+
+	item, err := q.Get(ctx, "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if item.Message.Type != api.MessageTypePut {
+		t.Fatalf("wrong item %+v", item)
+	}
+
+	if err := q.Remove(ctx, "a"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := q.Get(ctx, "a"); !errors.Is(err, queue.ErrNotFound) {
+		t.Fatalf("error %v must be ErrNotFound", err)
+	}
+
+	if length, _ := q.Len(ctx); length != 2 {
+		t.Fatalf("length %d must be 2", length)
+	}
+}
+
+func TestMemoryDeadLetterQueue(t *testing.T) {
+	t.Parallel()
+
+	testDeadLetterQueue(t, queue.NewMemoryDeadLetterQueue())
+}
+
+func TestDiskDeadLetterQueue(t *testing.T) {
+	t.Parallel()
+
+	q, err := queue.NewDiskDeadLetterQueue(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testDeadLetterQueue(t, q)
+}
@@ -0,0 +1,155 @@
+/*
+Copyright paskal.maksim@gmail.com
+Licensed under the Apache License, Version 2.0 (the "License")
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package queue
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/maksim-paskal/file-sync/pkg/config"
+	"github.com/maksim-paskal/file-sync/pkg/metrics"
+	log "github.com/sirupsen/logrus"
+)
+
+type State string
+
+const (
+	StateHealthy  State = "healthy"
+	StateDegraded State = "degraded"
+	StateDown     State = "down"
+)
+
+func (s State) metricValue() float64 {
+	switch s {
+	case StateHealthy:
+		return 0
+	case StateDegraded:
+		return 1
+	default:
+		return 2 //nolint:gomnd
+	}
+}
+
+// Health is circuit breaker of destination, destination is down after
+// queue.breaker.failures failures in a row, delivery is paused for queue.breaker.timeout
+// and after timeout one attempt is made to check destination.
+type Health struct {
+	mutex       sync.Mutex
+	destination string
+	failures    int
+	lastSuccess time.Time
+	lastFailure time.Time
+	lastError   string
+	openUntil   time.Time
+}
+
+// HealthStatus is state of destination with queue statistics.
+type HealthStatus struct {
+	Destination string    `json:"destination"`
+	State       State     `json:"state"`
+	Failures    int       `json:"failures"`
+	LastSuccess time.Time `json:"lastSuccess"`
+	LastFailure time.Time `json:"lastFailure"`
+	LastError   string    `json:"lastError,omitempty"`
+	Backlog     int64     `json:"backlog"`
+	Lag         float64   `json:"lagSeconds"`
+}
+
+func NewHealth(destination string) *Health {
+	h := &Health{destination: destination}
+
+	metrics.DestinationState.WithLabelValues(destination).Set(StateHealthy.metricValue())
+
+	return h
+}
+
+func (h *Health) state() State {
+	switch {
+	case h.failures >= *config.Get().BreakerFailures:
+		return StateDown
+	case h.failures > 0:
+		return StateDegraded
+	default:
+		return StateHealthy
+	}
+}
+
+func (h *Health) State() State {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	return h.state()
+}
+
+func (h *Health) Success() {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	if h.state() == StateDown {
+		log.Infof("destination %s is up", h.destination)
+	}
+
+	h.failures = 0
+	h.openUntil = time.Time{}
+	h.lastSuccess = time.Now()
+
+	metrics.DestinationState.WithLabelValues(h.destination).Set(h.state().metricValue())
+}
+
+func (h *Health) Failure(err error) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	wasDown := h.state() == StateDown
+
+	h.failures++
+	h.lastFailure = time.Now()
+	h.lastError = err.Error()
+
+	if h.state() == StateDown {
+		h.openUntil = time.Now().Add(*config.Get().BreakerTimeout)
+
+		if !wasDown {
+			log.WithError(err).Warnf("destination %s is down, delivery is paused for %s",
+				h.destination, config.Get().BreakerTimeout.String())
+		}
+	}
+
+	metrics.DestinationState.WithLabelValues(h.destination).Set(h.state().metricValue())
+}
+
+// wait blocks while circuit breaker is open.
+func (h *Health) wait(ctx context.Context) {
+	h.mutex.Lock()
+	openUntil := h.openUntil
+	h.mutex.Unlock()
+
+	if openUntil.After(time.Now()) {
+		waitUntil(ctx, nil, openUntil)
+	}
+}
+
+func (h *Health) Status() HealthStatus {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	return HealthStatus{
+		Destination: h.destination,
+		State:       h.state(),
+		Failures:    h.failures,
+		LastSuccess: h.lastSuccess,
+		LastFailure: h.lastFailure,
+		LastError:   h.lastError,
+	}
+}
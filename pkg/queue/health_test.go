@@ -0,0 +1,54 @@
+/*
+Copyright paskal.maksim@gmail.com
+Licensed under the Apache License, Version 2.0 (the "License")
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package queue_test
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/maksim-paskal/file-sync/pkg/config"
+	"github.com/maksim-paskal/file-sync/pkg/queue"
+)
+
+func TestHealth(t *testing.T) {
+	t.Parallel()
+
+	health := queue.NewHealth("test-health")
+
+	if state := health.State(); state != queue.StateHealthy {
+		t.Fatalf("state %s must be %s", state, queue.StateHealthy)
+	}
+
+	for i := 1; i <= *config.Get().BreakerFailures; i++ {
+		health.Failure(errors.New("test error"))
+
+		state := health.State()
+
+		switch {
+		case i < *config.Get().BreakerFailures && state != queue.StateDegraded:
+			t.Fatalf("state %s after %d failures must be %s", state, i, queue.StateDegraded)
+		case i == *config.Get().BreakerFailures && state != queue.StateDown:
+			t.Fatalf("state %s after %d failures must be %s", state, i, queue.StateDown)
+		}
+	}
+
+	if status := health.Status(); status.LastError != "test error" || status.LastFailure.IsZero() {
+		t.Fatalf("wrong status %+v", status)
+	}
+
+	health.Success()
+
+	if status := health.Status(); status.State != queue.StateHealthy || status.Failures != 0 {
+		t.Fatalf("wrong status %+v", status)
+	}
+}
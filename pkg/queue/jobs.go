@@ -0,0 +1,319 @@
+/*
+Copyright paskal.maksim@gmail.com
+Licensed under the Apache License, Version 2.0 (the "License")
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package queue
+
+import (
+	"context"
+	"path"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/maksim-paskal/file-sync/pkg/config"
+	log "github.com/sirupsen/logrus"
+)
+
+// states of job.
+const (
+	JobQueued       = "queued"
+	JobInflight     = "inflight"
+	JobRetrying     = "retrying"
+	JobDelivered    = "delivered"
+	JobDeadLettered = "deadLettered"
+	// job was purged from dead-letter queue or was not queued
+	JobFailed = "failed"
+	// job was merged with next job of the same file
+	JobCoalesced = "coalesced"
+)
+
+// number of last state changes that are kept in job.
+const jobHistorySize = 20
+
+// period of removing of expired jobs.
+const jobCleanupInterval = time.Minute
+
+// JobEvent is state change of job.
+type JobEvent struct {
+	State string    `json:"state"`
+	Time  time.Time `json:"time"`
+	Error string    `json:"error,omitempty"`
+}
+
+// Job is delivery status of message to destination, job id is id of queued message.
+type Job struct {
+	ID          string     `json:"id"`
+	Destination string     `json:"destination"`
+	Type        string     `json:"type"`
+	FileName    string     `json:"fileName"`
+	NewFileName string     `json:"newFileName,omitempty"`
+	State       string     `json:"state"`
+	Attempts    int        `json:"attempts"`
+	LastError   string     `json:"lastError,omitempty"`
+	NextAttempt time.Time  `json:"nextAttempt,omitempty"`
+	ReplacedBy  string     `json:"replacedBy,omitempty"`
+	Created     time.Time  `json:"created"`
+	Updated     time.Time  `json:"updated"`
+	History     []JobEvent `json:"history"`
+}
+
+// IsDone returns true if job state will not be changed.
+func (j *Job) IsDone() bool {
+	switch j.State {
+	case JobDelivered, JobFailed, JobCoalesced:
+		return true
+	default:
+		return false
+	}
+}
+
+// JobStore keeps jobs for jobs.retention after last update.
+type JobStore interface {
+	// Get returns ErrNotFound if job does not exists.
+	Get(ctx context.Context, id string) (*Job, error)
+	Set(ctx context.Context, job *Job) error
+	// List returns all jobs ordered by created time.
+	List(ctx context.Context) ([]*Job, error)
+}
+
+var (
+	jobs      JobStore = NewMemoryJobStore()
+	jobsMutex sync.Mutex
+)
+
+// JobFilter selects jobs, empty fields match all jobs, File is path.Match pattern.
+type JobFilter struct {
+	IDs         []string
+	State       string
+	Type        string
+	Destination string
+	File        string
+}
+
+func (f JobFilter) Match(job *Job) bool {
+	if len(f.IDs) > 0 && !containsString(f.IDs, job.ID) {
+		return false
+	}
+
+	if len(f.State) > 0 && f.State != job.State {
+		return false
+	}
+
+	if len(f.Type) > 0 && f.Type != job.Type {
+		return false
+	}
+
+	if len(f.Destination) > 0 && f.Destination != job.Destination {
+		return false
+	}
+
+	if len(f.File) > 0 {
+		matched, _ := path.Match(f.File, job.FileName)
+		if !matched {
+			return false
+		}
+	}
+
+	return true
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+
+	return false
+}
+
+// setJobState records state of item delivery, errors of job store are only logged.
+func setJobState(item *Item, state string, stateErr error) {
+	jobsMutex.Lock()
+	defer jobsMutex.Unlock()
+
+	job, err := jobs.Get(ctx, item.ID)
+	if err != nil {
+		job = &Job{
+			ID:      item.ID,
+			Created: item.Created,
+			History: make([]JobEvent, 0),
+		}
+	}
+
+	now := time.Now()
+
+	event := JobEvent{State: state, Time: now}
+	if stateErr != nil {
+		event.Error = stateErr.Error()
+		job.LastError = event.Error
+	}
+
+	job.Destination = item.Message.Destination
+	job.Type = item.Message.Type
+	job.FileName = item.Message.FileName
+	job.NewFileName = item.Message.NewFileName
+	job.State = state
+	job.Attempts = item.Attempts
+	job.NextAttempt = time.Time{}
+	job.Updated = now
+
+	if state == JobRetrying {
+		job.NextAttempt = item.NotBefore
+	}
+
+	if job.Created.IsZero() {
+		job.Created = now
+	}
+
+	job.History = append(job.History, event)
+	if len(job.History) > jobHistorySize {
+		job.History = job.History[len(job.History)-jobHistorySize:]
+	}
+
+	if err := jobs.Set(ctx, job); err != nil {
+		log.WithError(err).Errorf("error in jobs.Set %s", job.ID)
+	}
+}
+
+// setJobCoalesced records that job was merged with next job.
+func setJobCoalesced(id string, next *Item) {
+	jobsMutex.Lock()
+	defer jobsMutex.Unlock()
+
+	job, err := jobs.Get(ctx, id)
+	if err != nil {
+		log.WithError(err).Debugf("error in jobs.Get %s", id)
+
+		return
+	}
+
+	now := time.Now()
+
+	job.State = JobCoalesced
+	job.Updated = now
+
+	if next.ID != id {
+		job.ReplacedBy = next.ID
+	}
+
+	job.History = append(job.History, JobEvent{State: JobCoalesced, Time: now})
+
+	if err := jobs.Set(ctx, job); err != nil {
+		log.WithError(err).Errorf("error in jobs.Set %s", job.ID)
+	}
+}
+
+func GetJob(id string) (*Job, error) {
+	return jobs.Get(ctx, id)
+}
+
+// ListJobs returns jobs that match filter.
+func ListJobs(filter JobFilter, offset, limit int) ([]*Job, error) {
+	items, err := jobs.List(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	result := make([]*Job, 0)
+
+	for _, job := range items {
+		if !filter.Match(job) {
+			continue
+		}
+
+		if offset > 0 {
+			offset--
+
+			continue
+		}
+
+		if limit > 0 && len(result) >= limit {
+			break
+		}
+
+		result = append(result, job)
+	}
+
+	return result, nil
+}
+
+func sortByCreated(items []*Job) {
+	sort.SliceStable(items, func(i, j int) bool {
+		return items[i].Created.Before(items[j].Created)
+	})
+}
+
+// MemoryJobStore keeps jobs in process memory.
+type MemoryJobStore struct {
+	mutex       sync.Mutex
+	items       map[string]*Job
+	lastCleanup time.Time
+}
+
+func NewMemoryJobStore() *MemoryJobStore {
+	return &MemoryJobStore{
+		items:       make(map[string]*Job),
+		lastCleanup: time.Now(),
+	}
+}
+
+func (s *MemoryJobStore) Get(ctx context.Context, id string) (*Job, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	job, ok := s.items[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+
+	value := *job
+	value.History = append([]JobEvent(nil), job.History...)
+
+	return &value, nil
+}
+
+func (s *MemoryJobStore) Set(ctx context.Context, job *Job) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	value := *job
+	s.items[job.ID] = &value
+
+	if time.Since(s.lastCleanup) > jobCleanupInterval {
+		s.lastCleanup = time.Now()
+
+		for id, item := range s.items {
+			if time.Since(item.Updated) > *config.Get().JobsRetention {
+				delete(s.items, id)
+			}
+		}
+	}
+
+	return nil
+}
+
+func (s *MemoryJobStore) List(ctx context.Context) ([]*Job, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	result := make([]*Job, 0, len(s.items))
+
+	for _, job := range s.items {
+		value := *job
+		result = append(result, &value)
+	}
+
+	sortByCreated(result)
+
+	return result, nil
+}
@@ -0,0 +1,98 @@
+/*
+Copyright paskal.maksim@gmail.com
+Licensed under the Apache License, Version 2.0 (the "License")
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package queue_test
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/maksim-paskal/file-sync/pkg/api"
+	"github.com/maksim-paskal/file-sync/pkg/config"
+	"github.com/maksim-paskal/file-sync/pkg/queue"
+)
+
+func TestJobs(t *testing.T) { //nolint:paralleltest
+	queueType := queue.TypeMemory
+	backoffMin := 10 * time.Millisecond
+
+	config.Get().QueueType = &queueType
+
+	defer func(value *time.Duration) { config.Get().QueueBackoffMin = value }(config.Get().QueueBackoffMin)
+	config.Get().QueueBackoffMin = &backoffMin
+
+	attempts := 0
+
+	queue.OnNewValue = func(m api.Message) error {
+		attempts++
+		if attempts == 1 {
+			return errors.New("test error")
+		}
+
+		return nil
+	}
+	defer func() { queue.OnNewValue = nil }()
+
+	if err := queue.Init(); err != nil {
+		t.Fatal(err)
+	}
+	defer queue.GracefullShutdown()
+
+	ids, err := queue.Send(api.Message{Type: api.MessageTypePut, FileName: "test-jobs.txt"}, []string{"test-jobs"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var job *queue.Job
+
+	for start := time.Now(); time.Since(start) < 5*time.Second; time.Sleep(10 * time.Millisecond) {
+		if job, err = queue.GetJob(ids[0]); err != nil {
+			t.Fatal(err)
+		}
+
+		if job.IsDone() {
+			break
+		}
+	}
+
+	if job.State != queue.JobDelivered || job.Destination != "test-jobs" || job.LastError != "test error" {
+		t.Fatalf("wrong job %+v", job)
+	}
+
+	states := []string{
+		queue.JobQueued,
+		queue.JobInflight,
+		queue.JobRetrying,
+		queue.JobInflight,
+		queue.JobDelivered,
+	}
+
+	if len(job.History) != len(states) {
+		t.Fatalf("wrong history %+v", job.History)
+	}
+
+	for i, event := range job.History {
+		if event.State != states[i] {
+			t.Fatalf("state %d is %s, must be %s", i, event.State, states[i])
+		}
+	}
+
+	jobs, err := queue.ListJobs(queue.JobFilter{Destination: "test-jobs", State: queue.JobDelivered}, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(jobs) != 1 || jobs[0].ID != ids[0] {
+		t.Fatalf("wrong jobs %+v", jobs)
+	}
+}
@@ -0,0 +1,131 @@
+/*
+Copyright paskal.maksim@gmail.com
+Licensed under the Apache License, Version 2.0 (the "License")
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package queue_test
+
+import (
+	"encoding/base64"
+	"errors"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/maksim-paskal/file-sync/pkg/api"
+	"github.com/maksim-paskal/file-sync/pkg/config"
+	"github.com/maksim-paskal/file-sync/pkg/queue"
+)
+
+func TestList(t *testing.T) { //nolint:paralleltest,cyclop
+	queueType := queue.TypeMemory
+	backoff := time.Hour
+
+	config.Get().QueueType = &queueType
+
+	defer func(value *time.Duration) { config.Get().QueueBackoffMin = value }(config.Get().QueueBackoffMin)
+	config.Get().QueueBackoffMin = &backoff
+
+	// messages stay in queue until test ends
+	queue.OnNewValue = func(m api.Message) error {
+		return errors.New("test error")
+	}
+	defer func() { queue.OnNewValue = nil }()
+
+	if err := queue.Init(); err != nil {
+		t.Fatal(err)
+	}
+	defer queue.GracefullShutdown()
+
+	content := base64.StdEncoding.EncodeToString([]byte("test1"))
+
+	messages := []api.Message{
+		{Type: api.MessageTypePut, FileName: "list/a.txt", FileContent: "test"},
+		{Type: api.MessageTypePut, FileName: "list/b.txt", FileContentBase64: content},
+		{Type: api.MessageTypeDelete, FileName: "list/c.log"},
+	}
+
+	for _, message := range messages {
+		if _, err := queue.Send(message, []string{"test-list"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for start := time.Now(); time.Since(start) < 5*time.Second; time.Sleep(10 * time.Millisecond) {
+		jobs, err := queue.ListJobs(queue.JobFilter{Destination: "test-list", State: queue.JobRetrying}, 0, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(jobs) == len(messages) {
+			break
+		}
+	}
+
+	tests := []struct {
+		filter queue.Filter
+		offset int
+		limit  int
+		// empty file name matches any file
+		files []string
+	}{
+		{queue.Filter{Destination: "test-list"}, 0, 0, []string{"list/a.txt", "list/b.txt", "list/c.log"}},
+		{queue.Filter{Destination: "test-list", File: "list/b.txt"}, 0, 1, []string{"list/b.txt"}},
+		{queue.Filter{Destination: "test-list", Type: api.MessageTypeDelete}, 0, 0, []string{"list/c.log"}},
+		{queue.Filter{Destination: "test-list", File: "list/*.txt"}, 0, 0, []string{"list/a.txt", "list/b.txt"}},
+		{queue.Filter{Destination: "test-list", File: "list/*.txt"}, 1, 0, []string{""}},
+		{queue.Filter{Destination: "test-list"}, 1, 1, []string{""}},
+		{queue.Filter{Destination: "not-exists"}, 0, 0, []string{}},
+	}
+
+	for _, test := range tests {
+		items, err := queue.List(test.filter, test.offset, test.limit)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		files := make([]string, 0)
+		for _, item := range items {
+			files = append(files, item.File)
+		}
+
+		if len(files) != len(test.files) {
+			t.Fatalf("%+v returned %v, must be %v", test.filter, files, test.files)
+		}
+
+		// retried messages are ordered by time of next attempt
+		sort.Strings(files)
+
+		for i := range files {
+			if len(test.files[i]) > 0 && files[i] != test.files[i] {
+				t.Fatalf("%+v returned %v, must be %v", test.filter, files, test.files)
+			}
+		}
+	}
+
+	stats, err := queue.GetStats()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, destination := range stats.Destinations {
+		if destination.Destination != "test-list" {
+			continue
+		}
+
+		if destination.Depth != int64(len(messages)) || destination.Bytes != 9 || destination.OldestAge <= 0 {
+			t.Fatalf("wrong stats %+v", destination)
+		}
+
+		return
+	}
+
+	t.Fatal("destination not found in stats")
+}
@@ -0,0 +1,187 @@
+/*
+Copyright paskal.maksim@gmail.com
+Licensed under the Apache License, Version 2.0 (the "License")
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package queue
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// MemoryQueue keeps items in process memory, items are lost on restart.
+type MemoryQueue struct {
+	mutex   sync.Mutex
+	items   []*Item
+	delayed delayedItems
+	writes  pendingWrites
+	notify  chan struct{}
+}
+
+func NewMemoryQueue() *MemoryQueue {
+	return &MemoryQueue{
+		items:   make([]*Item, 0),
+		delayed: make(delayedItems, 0),
+		writes:  make(pendingWrites),
+		notify:  make(chan struct{}, 1),
+	}
+}
+
+func (q *MemoryQueue) wakeup() {
+	select {
+	case q.notify <- struct{}{}:
+	default:
+	}
+}
+
+func (q *MemoryQueue) Add(ctx context.Context, item *Item) error {
+	q.mutex.Lock()
+
+	pending := q.writes.get(item)
+	result, merged := coalesce(pending, item)
+	pendingID := getID(pending)
+
+	switch result {
+	case coalesceReplace:
+		*pending = *merged
+	case coalesceCancel:
+		q.remove(pending)
+	}
+
+	if result == coalesceAdd || result == coalesceCancel {
+		q.writes.add(item)
+		q.items = append(q.items, item)
+	}
+
+	q.mutex.Unlock()
+
+	observeCoalesce(result, pendingID, item)
+
+	q.wakeup()
+
+	return nil
+}
+
+func (q *MemoryQueue) Consume(ctx context.Context) (*Item, error) {
+	for {
+		q.mutex.Lock()
+
+		// retries are delivered before new items
+		if due := q.delayed.popDue(time.Now()); len(due) > 0 {
+			q.items = append(due, q.items...)
+		}
+
+		if len(q.items) > 0 {
+			item := q.items[0]
+			q.items = q.items[1:]
+			q.writes.remove(item)
+			hasMore := len(q.items) > 0
+			q.mutex.Unlock()
+
+			// other consumers can take next item
+			if hasMore {
+				q.wakeup()
+			}
+
+			return item, nil
+		}
+
+		next := q.delayed.next()
+		q.mutex.Unlock()
+
+		waitUntil(ctx, q.notify, next)
+
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+	}
+}
+
+func (q *MemoryQueue) remove(item *Item) {
+	q.writes.remove(item)
+
+	for i := range q.items {
+		if q.items[i] == item {
+			q.items = append(q.items[:i], q.items[i+1:]...)
+
+			return
+		}
+	}
+}
+
+// Ack does nothing, item is removed from queue in Consume.
+func (q *MemoryQueue) Ack(ctx context.Context, item *Item) error {
+	return nil
+}
+
+// Nack returns item to the head of queue or to delayed items if NotBefore is set.
+func (q *MemoryQueue) Nack(ctx context.Context, item *Item) error {
+	q.mutex.Lock()
+	if item.NotBefore.After(time.Now()) {
+		q.delayed.add(item)
+	} else {
+		q.items = append([]*Item{item}, q.items...)
+	}
+	q.mutex.Unlock()
+
+	q.wakeup()
+
+	return nil
+}
+
+func (q *MemoryQueue) Len(ctx context.Context) (int64, error) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	return int64(len(q.items) + len(q.delayed)), nil
+}
+
+func (q *MemoryQueue) List(ctx context.Context, offset, limit int64) ([]*Item, error) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	return listItems(append(q.items[:len(q.items):len(q.items)], q.delayed...), offset, limit), nil
+}
+
+func (q *MemoryQueue) Delete(ctx context.Context, match func(*Item) bool) ([]*Item, error) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	items, removed := splitItems(q.items, match)
+	delayed, removedDelayed := splitItems(q.delayed, match)
+
+	q.items = items
+	q.delayed = delayed
+	removed = append(removed, removedDelayed...)
+
+	for _, item := range removed {
+		q.writes.remove(item)
+	}
+
+	return removed, nil
+}
+
+func (q *MemoryQueue) Flush(ctx context.Context) error {
+	q.mutex.Lock()
+	q.items = make([]*Item, 0)
+	q.delayed = make(delayedItems, 0)
+	q.writes = make(pendingWrites)
+	q.mutex.Unlock()
+
+	return nil
+}
+
+func (q *MemoryQueue) Info(ctx context.Context) (map[string]interface{}, error) {
+	return map[string]interface{}{
+		"type": TypeMemory,
+	}, nil
+}
@@ -0,0 +1,250 @@
+/*
+Copyright paskal.maksim@gmail.com
+Licensed under the Apache License, Version 2.0 (the "License")
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package queue_test
+
+import (
+	"context"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/maksim-paskal/file-sync/pkg/api"
+	"github.com/maksim-paskal/file-sync/pkg/queue"
+)
+
+func TestMemoryQueue(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	q := queue.NewMemoryQueue()
+
+	const queueSize = 10
+
+	for i := 0; i < queueSize; i++ {
+		item := &queue.Item{
+			ID:      strconv.Itoa(i),
+			Message: api.Message{Type: api.MessageTypePut, FileName: strconv.Itoa(i)},
+		}
+
+		if err := q.Add(ctx, item); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if length, _ := q.Len(ctx); length != queueSize {
+		t.Fatalf("length %d must be %d", length, queueSize)
+	}
+
+	list, err := q.List(ctx, 2, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(list) != 3 || list[0].ID != "2" || list[2].ID != "4" {
+		t.Fatalf("wrong list %+v", list)
+	}
+
+	item, err := q.Consume(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// not processed item must be consumed again
+	if err := q.Nack(ctx, item); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < queueSize; i++ {
+		item, err := q.Consume(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if item.ID != strconv.Itoa(i) {
+			t.Fatalf("wrong order %s, must be %d", item.ID, i)
+		}
+
+		if err := q.Ack(ctx, item); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if length, _ := q.Len(ctx); length != 0 {
+		t.Fatalf("length %d must be 0", length)
+	}
+}
+
+func TestMemoryQueueConsumeWait(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	q := queue.NewMemoryQueue()
+
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+
+		_ = q.Add(ctx, &queue.Item{ID: "test"})
+	}()
+
+	item, err := q.Consume(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if item.ID != "test" {
+		t.Fatalf("wrong item %s", item.ID)
+	}
+
+	stopCtx, stop := context.WithCancel(ctx)
+	stop()
+
+	if _, err := q.Consume(stopCtx); err == nil {
+		t.Fatal("must be error on stopped context")
+	}
+}
+
+func TestMemoryQueueDelayed(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	q := queue.NewMemoryQueue()
+
+	for _, id := range []string{"failed", "next"} {
+		if err := q.Add(ctx, &queue.Item{ID: id}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	item, err := q.Consume(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	notBefore := time.Now().Add(200 * time.Millisecond)
+	item.NotBefore = notBefore
+
+	if err := q.Nack(ctx, item); err != nil {
+		t.Fatal(err)
+	}
+
+	if length, _ := q.Len(ctx); length != 2 {
+		t.Fatalf("length %d must be 2", length)
+	}
+
+	// delayed item does not block next item
+	item, err = q.Consume(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if item.ID != "next" {
+		t.Fatalf("wrong item %s", item.ID)
+	}
+
+	item, err = q.Consume(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if item.ID != "failed" || time.Now().Before(notBefore) {
+		t.Fatalf("wrong item %s or consumed before %s", item.ID, notBefore)
+	}
+}
+
+func TestMemoryQueueCoalesce(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	q := queue.NewMemoryQueue()
+
+	messages := []api.Message{
+		{ID: "1", Type: api.MessageTypePut, FileName: "a.txt", FileContent: "1"},
+		{ID: "2", Type: api.MessageTypePatch, FileName: "a.txt", FileContent: "2"},
+		{ID: "3", Type: api.MessageTypePatch, FileName: "b.txt", FileContent: "1"},
+		{ID: "4", Type: api.MessageTypeMove, FileName: "b.txt", NewFileName: "c.txt"},
+		// move is between writes, writes are not merged
+		{ID: "5", Type: api.MessageTypePatch, FileName: "b.txt", FileContent: "2"},
+		{ID: "6", Type: api.MessageTypePatch, FileName: "d.txt", FileContent: "1"},
+		{ID: "7", Type: api.MessageTypeDelete, FileName: "d.txt"},
+		// put can overwrite existing file, delete is delivered
+		{ID: "8", Type: api.MessageTypePut, FileName: "e.txt", FileContent: "1"},
+		{ID: "9", Type: api.MessageTypeDelete, FileName: "e.txt"},
+		{ID: "10", Type: api.MessageTypePatch, FileName: "f/g.txt", FileContent: "1"},
+		{ID: "11", Type: api.MessageTypeMoveDir, FileName: "f", NewFileName: "h"},
+		// directory operation is between writes of file in directory, writes are not merged
+		{ID: "12", Type: api.MessageTypePatch, FileName: "f/g.txt", FileContent: "2"},
+	}
+
+	for _, message := range messages {
+		if err := q.Add(ctx, &queue.Item{ID: message.ID, Message: message}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	expected := []struct {
+		id          string
+		messageType string
+		content     string
+	}{
+		{"2", api.MessageTypePut, "2"},
+		{"3", api.MessageTypePatch, "1"},
+		{"4", api.MessageTypeMove, ""},
+		{"5", api.MessageTypePatch, "2"},
+		{"7", api.MessageTypeDelete, ""},
+		{"9", api.MessageTypeDelete, ""},
+		{"10", api.MessageTypePatch, "1"},
+		{"11", api.MessageTypeMoveDir, ""},
+		{"12", api.MessageTypePatch, "2"},
+	}
+
+	items, err := q.List(ctx, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(items) != len(expected) {
+		t.Fatalf("length %d must be %d", len(items), len(expected))
+	}
+
+	for i, item := range items {
+		if item.ID != expected[i].id ||
+			item.Message.Type != expected[i].messageType ||
+			item.Message.FileContent != expected[i].content {
+			t.Fatalf("wrong item %d %+v", i, item.Message)
+		}
+	}
+
+	// consumed item is not merged with next items
+	item, err := q.Consume(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	next := &queue.Item{ID: "13", Message: api.Message{Type: api.MessageTypePatch, FileName: item.Message.FileName}}
+
+	if err := q.Add(ctx, next); err != nil {
+		t.Fatal(err)
+	}
+
+	if length, _ := q.Len(ctx); length != int64(len(expected)) {
+		t.Fatalf("length %d must be %d", length, len(expected))
+	}
+}
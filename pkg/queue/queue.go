@@ -14,105 +14,218 @@ package queue
 
 import (
 	"context"
-	"crypto/tls"
-	"encoding/json"
-	"sync"
+	"encoding/base64"
+	"path/filepath"
+	"strings"
 	"time"
 
 	"github.com/go-redis/redis/v8"
 	"github.com/google/uuid"
 	"github.com/maksim-paskal/file-sync/pkg/api"
 	"github.com/maksim-paskal/file-sync/pkg/config"
+	"github.com/maksim-paskal/file-sync/pkg/metrics"
 	"github.com/pkg/errors"
 	log "github.com/sirupsen/logrus"
 )
 
-const key = "file-sync"
+const (
+	TypeMemory = "memory"
+	TypeDisk   = "disk"
+	TypeRedis  = "redis"
+)
+
+// Item is queued message with delivery state.
+type Item struct {
+	ID          string      `json:"id"`
+	Message     api.Message `json:"message"`
+	Attempts    int         `json:"attempts"`
+	Created     time.Time   `json:"created"`
+	LastAttempt time.Time   `json:"lastAttempt"`
+	LastError   string      `json:"lastError,omitempty"`
+	// item is not delivered before this time
+	NotBefore time.Time `json:"notBefore"`
+	// time when item was moved to dead-letter queue
+	Failed time.Time `json:"failed"`
+	// backend specific reference of consumed item
+	receipt string
+}
+
+// Queue is storage of messages that must be delivered to destinations.
+type Queue interface {
+	// Add appends item to the end of queue.
+	Add(ctx context.Context, item *Item) error
+	// Consume blocks until next item is available or context is done.
+	Consume(ctx context.Context) (*Item, error)
+	// Ack marks item as processed.
+	Ack(ctx context.Context, item *Item) error
+	// Nack returns not processed item to the head of queue.
+	Nack(ctx context.Context, item *Item) error
+	// Len returns number of items in queue.
+	Len(ctx context.Context) (int64, error)
+	// List returns items in queue order.
+	List(ctx context.Context, offset, limit int64) ([]*Item, error)
+	// Delete removes items that match and returns removed items, consumed items are not removed.
+	Delete(ctx context.Context, match func(*Item) bool) ([]*Item, error)
+	// Flush removes all items from queue.
+	Flush(ctx context.Context) error
+	// Info returns backend specific information.
+	Info(ctx context.Context) (map[string]interface{}, error)
+}
+
+var errDeleted = errors.New("message was deleted from queue")
 
 var (
-	rdb        *redis.Client
-	OnNewValue func(api.Message)
-	mutex      sync.Mutex
+	// OnNewValue is called concurrently by workers of destinations, changes of one file
+	// are delivered in queue order.
+	OnNewValue func(api.Message) error
 	ctx        = context.Background()
-	mustStop   = false
+	cancel     = func() {}
 )
 
 func Init() error {
-	// queue work with redis only
-	if !*config.Get().RedisEnabled {
-		return nil
-	}
+	// consumers of previous Init use globals that are replaced
+	GracefullShutdown()
+
+	queueType := *config.Get().QueueType
 
-	redisOptions := redis.Options{
-		Addr:     *config.Get().RedisAddress,
-		Password: *config.Get().RedisPassword,
+	// backward compatibility with redis.enabled
+	if *config.Get().RedisEnabled {
+		queueType = TypeRedis
 	}
 
-	if *config.Get().RedisTLS {
-		redisOptions.TLSConfig = &tls.Config{
-			MinVersion: tls.VersionTLS12,
+	var consumerCtx context.Context
+
+	consumerCtx, cancel = context.WithCancel(ctx)
+
+	var (
+		rdb      *redis.Client
+		existing []string
+		err      error
+	)
+
+	consume := true
+
+	switch queueType {
+	case TypeMemory:
+		deadLetters = NewMemoryDeadLetterQueue()
+		jobs = NewMemoryJobStore()
+		newQueue = func(destination string) (Queue, error) {
+			return NewMemoryQueue(), nil
+		}
+	case TypeDisk:
+		dir := *config.Get().QueueDir
+
+		deadLetters, err = NewDiskDeadLetterQueue(filepath.Join(dir, diskDeadLetterDir))
+		if err != nil {
+			return errors.Wrap(err, "error in queue.NewDiskDeadLetterQueue")
+		}
+
+		jobs = NewMemoryJobStore()
+
+		newQueue = func(destination string) (Queue, error) {
+			return NewDiskQueue(getDiskQueueDir(dir, destination))
+		}
+
+		existing, err = getDiskDestinations(dir)
+		if err != nil {
+			return err
 		}
 
-		if *config.Get().RedisTLSInsecure {
-			redisOptions.TLSConfig.InsecureSkipVerify = true
+		log.Infof("Disk queue started in %s", dir)
+	case TypeRedis:
+		rdb = newRedisClient()
+		deadLetters = NewRedisDeadLetterQueue(rdb)
+		jobs = NewRedisJobStore(rdb)
+		newQueue = func(destination string) (Queue, error) {
+			return NewRedisQueue(ctx, rdb, destination, *config.Get().RedisConsumer, *config.Get().RedisClaimTimeout)
 		}
+		consume = *config.Get().ExecuteRedisQueue
+
+		existing, err = getRedisDestinations(ctx, rdb)
+		if err != nil {
+			return err
+		}
+
+		log.Infof("Redis queue started on %s server", *config.Get().RedisAddress)
+	default:
+		return errors.Errorf("unknown queue type %s", queueType)
 	}
 
-	rdb = redis.NewClient(&redisOptions)
+	initDestinations(consumerCtx, consume)
 
-	log.Infof("Redis queue started on %s server", *config.Get().RedisAddress)
+	// queues of removed destinations are processed until they are empty
+	for _, destination := range append(getConfigDestinations(), existing...) {
+		if _, err := getDestination(destination); err != nil {
+			return err
+		}
+	}
 
-	if *config.Get().ExecuteRedisQueue {
-		go executeRedisQueue(ctx)
+	if queueType == TypeRedis {
+		if err := migrateRedisList(ctx, rdb); err != nil {
+			return err
+		}
 	}
 
+	updateDeadLetterMetrics()
+
 	return nil
 }
 
-func Flush() error {
-	return rdb.FlushDB(ctx).Err()
+func getConfigDestinations() []string {
+	return strings.Split(*config.Get().SyncAddress, ",")
 }
 
-func GracefullShutdown() {
-	mustStop = true
-}
+// Delete removes queued items of all destinations that match filter.
+func Delete(filter Filter) (int, error) {
+	count := 0
 
-func executeRedisQueue(ctx context.Context) {
-	for {
-		if mustStop {
-			break
+	for _, destination := range getDestinations() {
+		if len(filter.Destination) > 0 && filter.Destination != destination.name {
+			continue
 		}
 
-		result, err := rdb.BLPop(ctx, 0*time.Second, key).Result()
-		if err != nil {
-			log.WithError(err).Error("error in queue.rdb.BLPop")
+		items, err := destination.queue.Delete(ctx, filter.Match)
 
-			continue
+		for _, item := range items {
+			setJobState(item, JobFailed, errDeleted)
+
+			log.
+				WithField("message", item.Message.String()).
+				Infof("message %s deleted from queue of %s", item.ID, destination.name)
 		}
 
-		message := api.Message{}
+		count += len(items)
 
-		err = json.Unmarshal([]byte(result[1]), &message)
 		if err != nil {
-			log.
-				WithError(err).
-				WithField("message", message.String()).
-				Error("error in json.Unmarshal")
-
-			continue
+			return count, errors.Wrapf(err, "error in queue.Delete %s", destination.name)
 		}
+	}
+
+	return count, nil
+}
 
-		onNewValue(message)
+// Flush removes all items from queues of all destinations.
+func Flush() error {
+	for _, destination := range getDestinations() {
+		if err := destination.queue.Flush(ctx); err != nil {
+			return errors.Wrapf(err, "error in queue.Flush %s", destination.name)
+		}
 	}
+
+	return nil
 }
 
-func onNewValue(message api.Message) {
-	mutex.Lock()
-	defer mutex.Unlock()
+// GracefullShutdown stops consumers, items that are processed are returned to queue.
+func GracefullShutdown() {
+	stopDestinations(cancel)
+}
 
+func onNewValue(message api.Message) error {
 	if OnNewValue != nil {
-		OnNewValue(message)
+		return OnNewValue(message)
 	}
+
+	return nil
 }
 
 func Add(value api.Message) (string, error) {
@@ -120,27 +233,202 @@ func Add(value api.Message) (string, error) {
 		value.ID = uuid.NewString()
 	}
 
-	messageJSON, err := json.Marshal(value)
-	if err != nil {
-		return value.ID, errors.Wrap(err, "error in json.Marshal")
+	item := &Item{
+		ID:      value.ID,
+		Message: value,
+		Created: time.Now(),
 	}
 
-	push := rdb.RPush(ctx, key, messageJSON)
+	// job is queued before add, item can be merged with pending item in add
+	setJobState(item, JobQueued, nil)
+
+	if err := addItem(item); err != nil {
+		setJobState(item, JobFailed, err)
+
+		return value.ID, err
+	}
 
-	_, err = push.Result()
+	return value.ID, nil
+}
+
+// addItem adds item to queue of message destination.
+func addItem(item *Item) error {
+	destination, err := getDestination(item.Message.Destination)
 	if err != nil {
-		return value.ID, errors.Wrap(err, "error push.Result")
+		return err
 	}
 
-	return value.ID, err
+	if err := destination.queue.Add(ctx, item); err != nil {
+		return errors.Wrap(err, "error in queue.Add")
+	}
+
+	return nil
+}
+
+// Send adds message to queue for all destinations.
+// Returns message id or error text for each destination.
+func Send(message api.Message, destinations []string) ([]string, error) {
+	var lastErr error
+
+	resultText := make([]string, 0)
+
+	for _, address := range destinations {
+		message.Destination = address
+
+		result, err := Add(message)
+		if err != nil {
+			log.
+				WithError(err).
+				WithField("message", message.String()).
+				Error("error in queue.Send")
+
+			metrics.QueueErrorCounter.WithLabelValues(message.Type).Inc()
+
+			lastErr = err
+			result = err.Error()
+		}
+
+		resultText = append(resultText, result)
+	}
+
+	return resultText, lastErr
 }
 
+// ListResult is queued message without file content.
 type ListResult struct {
-	ID   string
-	File string
-	Type string
+	ID          string `json:"id"`
+	Destination string `json:"destination"`
+	File        string `json:"file"`
+	NewFile     string `json:"newFile,omitempty"`
+	Type        string `json:"type"`
+	// size of file content in queue
+	Size      int64     `json:"size"`
+	Attempts  int       `json:"attempts"`
+	LastError string    `json:"lastError,omitempty"`
+	Created   time.Time `json:"created"`
+	NotBefore time.Time `json:"notBefore,omitempty"`
 }
 
-func Info() (string, error) {
-	return rdb.Info(ctx).Result()
+// List returns queued messages of all destinations that match filter,
+// messages are ordered by destination name and queue order.
+func List(filter Filter, offset, limit int) ([]ListResult, error) {
+	result := make([]ListResult, 0)
+
+	// without filter only first messages of queue are needed
+	listLimit := int64(0)
+	if limit > 0 && len(filter.ID) == 0 && len(filter.Type) == 0 && len(filter.File) == 0 {
+		listLimit = int64(offset + limit)
+	}
+
+	for _, destination := range getDestinations() {
+		if len(filter.Destination) > 0 && filter.Destination != destination.name {
+			continue
+		}
+
+		items, err := destination.queue.List(ctx, 0, listLimit)
+		if err != nil {
+			return nil, errors.Wrapf(err, "error in queue.List %s", destination.name)
+		}
+
+		for _, item := range items {
+			if !filter.Match(item) {
+				continue
+			}
+
+			if offset > 0 {
+				offset--
+
+				continue
+			}
+
+			if limit > 0 && len(result) >= limit {
+				return result, nil
+			}
+
+			result = append(result, ListResult{
+				ID:          item.ID,
+				Destination: item.Message.Destination,
+				File:        item.Message.FileName,
+				NewFile:     item.Message.NewFileName,
+				Type:        item.Message.Type,
+				Size:        getContentSize(item.Message),
+				Attempts:    item.Attempts,
+				LastError:   item.LastError,
+				Created:     item.Created,
+				NotBefore:   item.NotBefore,
+			})
+		}
+	}
+
+	return result, nil
+}
+
+// getContentSize returns size of file content that is kept in message,
+// content of streamed messages is read from source on delivery.
+func getContentSize(message api.Message) int64 {
+	size := len(message.FileContent)
+
+	if content := message.FileContentBase64; len(content) > 0 {
+		size += base64.StdEncoding.DecodedLen(len(content)) - (len(content) - len(strings.TrimRight(content, "=")))
+	}
+
+	return int64(size)
+}
+
+// DestinationStats is statistics of queue of one destination.
+type DestinationStats struct {
+	Destination string `json:"destination"`
+	State       State  `json:"state"`
+	Depth       int64  `json:"depth"`
+	// age of oldest queued message
+	OldestAge float64 `json:"oldestAgeSeconds"`
+	// size of file content in queue
+	Bytes int64 `json:"bytes"`
+	// backend specific information
+	Info map[string]interface{} `json:"info"`
+}
+
+// Stats is statistics of queues of all destinations.
+type Stats struct {
+	Type         string             `json:"type"`
+	Depth        int64              `json:"depth"`
+	OldestAge    float64            `json:"oldestAgeSeconds"`
+	Bytes        int64              `json:"bytes"`
+	DeadLetters  int64              `json:"deadLetters"`
+	Destinations []DestinationStats `json:"destinations"`
+}
+
+func GetStats() (*Stats, error) {
+	deadLettersLen, err := deadLetters.Len(ctx)
+	if err != nil {
+		return nil, errors.Wrap(err, "error in deadLetters.Len")
+	}
+
+	result := &Stats{
+		Type:         *config.Get().QueueType,
+		DeadLetters:  deadLettersLen,
+		Destinations: make([]DestinationStats, 0),
+	}
+
+	if *config.Get().RedisEnabled {
+		result.Type = TypeRedis
+	}
+
+	for _, destination := range getDestinations() {
+		stats, err := destination.stats(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		result.Depth += stats.Depth
+		result.Bytes += stats.Bytes
+
+		if stats.OldestAge > result.OldestAge {
+			result.OldestAge = stats.OldestAge
+		}
+
+		result.Destinations = append(result.Destinations, *stats)
+	}
+
+	return result, nil
 }
@@ -50,7 +50,7 @@ func TestAdd(t *testing.T) {
 
 	messageType := uuid.NewString()
 
-	_, err := queue.Info()
+	_, err := queue.GetStats()
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -60,7 +60,7 @@ func TestAdd(t *testing.T) {
 	queueFound := 0
 	lastID := -1
 
-	queue.OnNewValue = func(m api.Message) {
+	queue.OnNewValue = func(m api.Message) error {
 		t.Logf("OnNewValue=%s", m.ID)
 
 		currentID, err := strconv.Atoi(m.ID)
@@ -89,6 +89,8 @@ func TestAdd(t *testing.T) {
 		if queueFound == queueSize {
 			cancel()
 		}
+
+		return nil
 	}
 
 	for i := 0; i < queueSize; i++ {
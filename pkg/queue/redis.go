@@ -0,0 +1,1072 @@
+/*
+Copyright paskal.maksim@gmail.com
+Licensed under the Apache License, Version 2.0 (the "License")
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package queue
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/maksim-paskal/file-sync/pkg/api"
+	"github.com/maksim-paskal/file-sync/pkg/config"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// all keys are in namespace of redis.prefix, key is redis.prefix+":"+name.
+const (
+	// list of first versions, key was not prefixed with redis.prefix,
+	// messages from it are moved to streams of destinations on start
+	legacyListKey = "file-sync"
+	// stream of destination is streamKeyPrefix+destination
+	streamKeyPrefix = "stream:"
+	groupName       = "file-sync"
+	// sorted set of destination items by time of next attempt
+	delayedKeyPrefix = "delayed:"
+	// number of keys that are scanned at once.
+	redisScanCount = 100
+	// number of delayed items that are moved to stream at once.
+	redisPromoteCount = 100
+	// hash of items of destination by stream message id
+	itemsKeyPrefix = "items:"
+	// hash of pending write of file to stream message id, it is used to coalesce items
+	filesKeyPrefix = "files:"
+	// hash of dead-letter items by id
+	deadLetterKey = "dlq"
+	// hash of jobs by id and sorted set of job ids by update time
+	jobsKey        = "jobs"
+	jobsUpdatedKey = "jobs:updated"
+	// stream message field with item, retried items are added to stream with item
+	itemField = "item"
+	// stream message field with file of pending write, item is stored in items hash
+	fileField = "file"
+	// number of pending messages that are checked for claim at once.
+	redisClaimCount = 10
+	// XREADGROUP timeout, consumer checks context after timeout.
+	redisReadTimeout = time.Second
+)
+
+// promoteScript atomically moves due items from sorted set to stream.
+var promoteScript = redis.NewScript(`
+local items = redis.call('ZRANGEBYSCORE', KEYS[1], '-inf', ARGV[1], 'LIMIT', 0, ARGV[2])
+for _, item in ipairs(items) do
+	redis.call('ZREM', KEYS[1], item)
+	redis.call('XADD', KEYS[2], '*', ARGV[3], item)
+end
+return #items
+`)
+
+// addScript atomically adds item to stream or merges it with pending write of file,
+// it returns 0 if pending write was consumed or changed after it was read.
+var addScript = redis.NewScript(`
+local mode, pending, item, file, write = ARGV[1], ARGV[2], ARGV[3], ARGV[4], ARGV[5]
+if mode ~= 'add' then
+	if redis.call('HGET', KEYS[3], file) ~= pending then
+		return 0
+	end
+	if mode == 'replace' then
+		redis.call('HSET', KEYS[2], pending, item)
+		return 1
+	end
+	redis.call('HDEL', KEYS[3], file)
+	redis.call('HDEL', KEYS[2], pending)
+	redis.call('XDEL', KEYS[1], pending)
+end
+for i = 6, #ARGV do
+	if string.sub(ARGV[i], -1) == '/' then
+		for _, name in ipairs(redis.call('HKEYS', KEYS[3])) do
+			if string.sub(name, 1, #ARGV[i]) == ARGV[i] then
+				redis.call('HDEL', KEYS[3], name)
+			end
+		end
+	else
+		redis.call('HDEL', KEYS[3], ARGV[i])
+	end
+end
+local id = redis.call('XADD', KEYS[1], '*', 'file', write)
+redis.call('HSET', KEYS[2], id, item)
+if write ~= '' then
+	redis.call('HSET', KEYS[3], write, id)
+end
+return 1
+`)
+
+// takeScript returns item of stream message, item can not be merged with next items after take.
+var takeScript = redis.NewScript(`
+if ARGV[2] ~= '' and redis.call('HGET', KEYS[2], ARGV[2]) == ARGV[1] then
+	redis.call('HDEL', KEYS[2], ARGV[2])
+end
+return redis.call('HGET', KEYS[1], ARGV[1])
+`)
+
+// deleteScript removes stream message, it returns 0 if item of message was changed after it was read.
+var deleteScript = redis.NewScript(`
+local group, id, file, value = ARGV[1], ARGV[2], ARGV[3], ARGV[4]
+local current = redis.call('HGET', KEYS[2], id)
+if current and current ~= value then
+	return 0
+end
+if file ~= '' and redis.call('HGET', KEYS[3], file) == id then
+	redis.call('HDEL', KEYS[3], file)
+end
+redis.call('XACK', KEYS[1], group, id)
+redis.call('HDEL', KEYS[2], id)
+return redis.call('XDEL', KEYS[1], id)
+`)
+
+// RedisQueue keeps items in redis stream, items are shared between consumers of one group.
+// Consumed item stays pending until Ack, pending items of dead consumers are reclaimed
+// after claimTimeout, so claimTimeout must be longer than delivery of one item.
+// New items are stored in hash by stream message id, so pending write of file can be
+// replaced with newer write until it is consumed.
+type RedisQueue struct {
+	rdb          *redis.Client
+	stream       string
+	delayed      string
+	items        string
+	files        string
+	group        string
+	consumer     string
+	claimTimeout time.Duration
+
+	mutex       sync.Mutex
+	retry       []*Item
+	inflight    map[string]struct{}
+	lastClaim   time.Time
+	lastPromote time.Time
+}
+
+func newRedisClient() *redis.Client {
+	redisOptions := redis.Options{
+		Addr:     *config.Get().RedisAddress,
+		Password: *config.Get().RedisPassword,
+	}
+
+	if *config.Get().RedisTLS {
+		redisOptions.TLSConfig = &tls.Config{
+			MinVersion: tls.VersionTLS12,
+		}
+
+		if *config.Get().RedisTLSInsecure {
+			redisOptions.TLSConfig.InsecureSkipVerify = true
+		}
+	}
+
+	return redis.NewClient(&redisOptions)
+}
+
+// getRedisKey returns key of name in namespace of redis.prefix.
+func getRedisKey(name string) string {
+	return *config.Get().RedisPrefix + ":" + name
+}
+
+func NewRedisQueue(ctx context.Context, rdb *redis.Client, destination, consumer string, claimTimeout time.Duration) (*RedisQueue, error) { //nolint:lll
+	q := &RedisQueue{
+		rdb:          rdb,
+		stream:       getRedisKey(streamKeyPrefix + destination),
+		delayed:      getRedisKey(delayedKeyPrefix + destination),
+		items:        getRedisKey(itemsKeyPrefix + destination),
+		files:        getRedisKey(filesKeyPrefix + destination),
+		group:        groupName,
+		consumer:     consumer,
+		claimTimeout: claimTimeout,
+		retry:        make([]*Item, 0),
+		inflight:     make(map[string]struct{}),
+	}
+
+	if err := q.createGroup(ctx); err != nil {
+		return nil, err
+	}
+
+	if err := q.loadPending(ctx); err != nil {
+		return nil, err
+	}
+
+	return q, nil
+}
+
+// loadPending returns messages that were consumed before restart to this consumer.
+func (q *RedisQueue) loadPending(ctx context.Context) error {
+	streams, err := q.rdb.XReadGroup(ctx, &redis.XReadGroupArgs{
+		Group:    q.group,
+		Consumer: q.consumer,
+		Streams:  []string{q.stream, "0"},
+		Block:    -1,
+	}).Result()
+	if err != nil && !errors.Is(err, redis.Nil) {
+		return errors.Wrap(err, "error in rdb.XReadGroup")
+	}
+
+	for _, stream := range streams {
+		for _, message := range stream.Messages {
+			item, err := q.decodeMessage(ctx, message)
+			if err != nil {
+				log.WithError(err).Warn("error in queue.decodeMessage")
+
+				continue
+			}
+
+			if item != nil {
+				q.retry = append(q.retry, item)
+			}
+		}
+	}
+
+	return nil
+}
+
+func (q *RedisQueue) createGroup(ctx context.Context) error {
+	err := q.rdb.XGroupCreateMkStream(ctx, q.stream, q.group, "0").Err()
+	if err != nil && !strings.HasPrefix(err.Error(), "BUSYGROUP") {
+		return errors.Wrap(err, "error in rdb.XGroupCreateMkStream")
+	}
+
+	return nil
+}
+
+// getRedisDestinations returns destinations that have stream or delayed items.
+func getRedisDestinations(ctx context.Context, rdb *redis.Client) ([]string, error) {
+	found := make(map[string]struct{})
+
+	for _, prefix := range []string{getRedisKey(streamKeyPrefix), getRedisKey(delayedKeyPrefix)} {
+		iter := rdb.Scan(ctx, 0, prefix+"*", redisScanCount).Iterator()
+
+		for iter.Next(ctx) {
+			found[strings.TrimPrefix(iter.Val(), prefix)] = struct{}{}
+		}
+
+		if err := iter.Err(); err != nil {
+			return nil, errors.Wrap(err, "error in rdb.Scan")
+		}
+	}
+
+	result := make([]string, 0, len(found))
+
+	for destination := range found {
+		result = append(result, destination)
+	}
+
+	return result, nil
+}
+
+// migrateRedisList moves messages from list of first versions to streams of destinations.
+func migrateRedisList(ctx context.Context, rdb *redis.Client) error {
+	key := legacyListKey
+
+	for {
+		value, err := rdb.LIndex(ctx, key, 0).Result()
+		if errors.Is(err, redis.Nil) {
+			return nil
+		}
+
+		if err != nil {
+			return errors.Wrap(err, "error in rdb.LIndex")
+		}
+
+		item, err := decodeItem(value)
+		if err != nil {
+			log.WithError(err).Warnf("dropping invalid message %s", value)
+		} else if err := addItem(item); err != nil {
+			return err
+		}
+
+		// message can be duplicated if process is killed here
+		if err := rdb.LPop(ctx, key).Err(); err != nil {
+			return errors.Wrap(err, "error in rdb.LPop")
+		}
+	}
+}
+
+func (q *RedisQueue) Add(ctx context.Context, item *Item) error {
+	for {
+		pendingID, pending, err := q.getPendingWrite(ctx, item)
+		if err != nil {
+			return err
+		}
+
+		result, merged := coalesce(pending, item)
+
+		value := item
+		if merged != nil {
+			value = merged
+		}
+
+		itemJSON, err := json.Marshal(value)
+		if err != nil {
+			return errors.Wrap(err, "error in json.Marshal")
+		}
+
+		write := ""
+		if isWrite(item) {
+			write = item.Message.FileName
+		}
+
+		args := []interface{}{result, pendingID, itemJSON, item.Message.FileName, write}
+
+		// next items of these files can not be merged with previous writes,
+		// argument with trailing slash is directory with all files in it
+		for _, fileName := range []string{item.Message.FileName, item.Message.NewFileName} {
+			if len(fileName) > 0 {
+				args = append(args, fileName)
+			}
+
+			if len(fileName) > 0 && api.IsDirType(item.Message.Type) {
+				args = append(args, strings.TrimSuffix(fileName, "/")+"/")
+			}
+		}
+
+		added, err := addScript.Run(ctx, q.rdb, []string{q.stream, q.items, q.files}, args...).Int()
+		if err != nil {
+			return errors.Wrap(err, "error in addScript.Run")
+		}
+
+		if added == 1 {
+			observeCoalesce(result, getID(pending), item)
+
+			return nil
+		}
+
+		// pending write was consumed, item is coalesced again
+	}
+}
+
+// getPendingWrite returns stream message id and item of pending write that can be merged with item.
+func (q *RedisQueue) getPendingWrite(ctx context.Context, item *Item) (string, *Item, error) {
+	if len(item.Message.NewFileName) > 0 || !*config.Get().QueueCoalesce {
+		return "", nil, nil
+	}
+
+	pendingID, err := q.rdb.HGet(ctx, q.files, item.Message.FileName).Result()
+	if errors.Is(err, redis.Nil) {
+		return "", nil, nil
+	}
+
+	if err != nil {
+		return "", nil, errors.Wrap(err, "error in rdb.HGet")
+	}
+
+	value, err := q.rdb.HGet(ctx, q.items, pendingID).Result()
+	if errors.Is(err, redis.Nil) {
+		return "", nil, nil
+	}
+
+	if err != nil {
+		return "", nil, errors.Wrap(err, "error in rdb.HGet")
+	}
+
+	pending, err := decodeItem(value)
+	if err != nil {
+		return "", nil, err
+	}
+
+	return pendingID, pending, nil
+}
+
+func (q *RedisQueue) Consume(ctx context.Context) (*Item, error) {
+	for {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+
+		if err := q.promote(ctx); err != nil {
+			return nil, err
+		}
+
+		item, err := q.nextRetry(ctx)
+		if item != nil || err != nil {
+			return item, err
+		}
+
+		item, err = q.claim(ctx)
+		if item != nil || err != nil {
+			return item, err
+		}
+
+		item, err = q.read(ctx)
+		if item != nil || err != nil {
+			return item, err
+		}
+	}
+}
+
+// promote moves delayed items with passed time of next attempt to stream.
+func (q *RedisQueue) promote(ctx context.Context) error {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	if time.Since(q.lastPromote) < redisReadTimeout {
+		return nil
+	}
+
+	q.lastPromote = time.Now()
+
+	now := strconv.FormatInt(time.Now().UnixMilli(), 10)
+
+	err := promoteScript.Run(ctx, q.rdb, []string{q.delayed, q.stream}, now, redisPromoteCount, itemField).Err()
+	if err != nil && !errors.Is(err, redis.Nil) {
+		return errors.Wrap(err, "error in promoteScript.Run")
+	}
+
+	return nil
+}
+
+// nextRetry returns item that was returned by Nack, if it was not reclaimed by other consumer.
+func (q *RedisQueue) nextRetry(ctx context.Context) (*Item, error) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	for len(q.retry) > 0 {
+		item := q.retry[0]
+		q.retry = q.retry[1:]
+
+		// resets idle time of pending message
+		messages, err := q.rdb.XClaim(ctx, &redis.XClaimArgs{
+			Stream:   q.stream,
+			Group:    q.group,
+			Consumer: q.consumer,
+			Messages: []string{item.receipt},
+		}).Result()
+		if err != nil {
+			q.retry = append([]*Item{item}, q.retry...)
+
+			return nil, errors.Wrap(err, "error in rdb.XClaim")
+		}
+
+		if len(messages) > 0 {
+			return item, nil
+		}
+
+		delete(q.inflight, item.receipt)
+	}
+
+	return nil, nil
+}
+
+// claim takes message of dead consumer that was not acknowledged for claimTimeout,
+// XPENDING with XCLAIM is used because XAUTOCLAIM reply of redis 7 is not supported by client.
+func (q *RedisQueue) claim(ctx context.Context) (*Item, error) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	if time.Since(q.lastClaim) < redisReadTimeout {
+		return nil, nil
+	}
+
+	q.lastClaim = time.Now()
+
+	pending, err := q.rdb.XPendingExt(ctx, &redis.XPendingExtArgs{
+		Stream: q.stream,
+		Group:  q.group,
+		Idle:   q.claimTimeout,
+		Start:  "-",
+		End:    "+",
+		Count:  redisClaimCount,
+	}).Result()
+	if err != nil && !errors.Is(err, redis.Nil) {
+		return nil, errors.Wrap(err, "error in rdb.XPendingExt")
+	}
+
+	for _, message := range pending {
+		// message of this consumer is still processed
+		if _, ok := q.inflight[message.ID]; ok {
+			continue
+		}
+
+		// other consumer can claim message first
+		messages, err := q.rdb.XClaim(ctx, &redis.XClaimArgs{
+			Stream:   q.stream,
+			Group:    q.group,
+			Consumer: q.consumer,
+			MinIdle:  q.claimTimeout,
+			Messages: []string{message.ID},
+		}).Result()
+		if err != nil {
+			return nil, errors.Wrap(err, "error in rdb.XClaim")
+		}
+
+		if len(messages) == 0 {
+			continue
+		}
+
+		log.Warnf("claimed message %s of consumer %s", message.ID, message.Consumer)
+
+		// continue without delay while there are messages to claim
+		q.lastClaim = time.Time{}
+
+		return q.decodeMessage(ctx, messages[0])
+	}
+
+	return nil, nil
+}
+
+func (q *RedisQueue) read(ctx context.Context) (*Item, error) {
+	streams, err := q.rdb.XReadGroup(ctx, &redis.XReadGroupArgs{
+		Group:    q.group,
+		Consumer: q.consumer,
+		Streams:  []string{q.stream, ">"},
+		Count:    1,
+		Block:    redisReadTimeout,
+	}).Result()
+	if errors.Is(err, redis.Nil) {
+		return nil, nil
+	}
+
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+
+		// stream was removed by flush
+		if strings.HasPrefix(err.Error(), "NOGROUP") {
+			return nil, q.createGroup(ctx)
+		}
+
+		return nil, errors.Wrap(err, "error in rdb.XReadGroup")
+	}
+
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	for _, stream := range streams {
+		for _, message := range stream.Messages {
+			return q.decodeMessage(ctx, message)
+		}
+	}
+
+	return nil, nil
+}
+
+// decodeMessage returns item of stream message, it returns nil if item was removed by coalesce.
+func (q *RedisQueue) decodeMessage(ctx context.Context, message redis.XMessage) (*Item, error) {
+	value, ok := message.Values[itemField].(string)
+	if !ok {
+		file, _ := message.Values[fileField].(string)
+
+		var err error
+
+		value, err = takeScript.Run(ctx, q.rdb, []string{q.items, q.files}, message.ID, file).Text()
+		if errors.Is(err, redis.Nil) {
+			q.remove(message.ID)
+
+			return nil, nil
+		}
+
+		if err != nil {
+			return nil, errors.Wrap(err, "error in takeScript.Run")
+		}
+	}
+
+	item, err := decodeItem(value)
+	if err != nil {
+		// invalid message will never be processed
+		q.remove(message.ID)
+
+		return nil, errors.Wrapf(err, "invalid message %s", message.ID)
+	}
+
+	item.receipt = message.ID
+	q.inflight[message.ID] = struct{}{}
+
+	return item, nil
+}
+
+// remove removes message that will never be processed.
+func (q *RedisQueue) remove(id string) {
+	if err := q.ack(context.Background(), id); err != nil {
+		log.WithError(err).Error("error in queue.ack")
+	}
+}
+
+// decodeItem also reads messages that were queued by previous versions.
+func decodeItem(value string) (*Item, error) {
+	item := &Item{}
+
+	if err := json.Unmarshal([]byte(value), item); err != nil {
+		return nil, errors.Wrap(err, "error in json.Unmarshal")
+	}
+
+	if len(item.Message.Type) == 0 {
+		if err := json.Unmarshal([]byte(value), &item.Message); err != nil {
+			return nil, errors.Wrap(err, "error in json.Unmarshal")
+		}
+
+		item.ID = item.Message.ID
+	}
+
+	return item, nil
+}
+
+func (q *RedisQueue) Ack(ctx context.Context, item *Item) error {
+	if err := q.ack(ctx, item.receipt); err != nil {
+		return err
+	}
+
+	q.mutex.Lock()
+	delete(q.inflight, item.receipt)
+	q.mutex.Unlock()
+
+	return nil
+}
+
+func (q *RedisQueue) ack(ctx context.Context, id string) error {
+	_, err := q.rdb.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.XAck(ctx, q.stream, q.group, id)
+		pipe.XDel(ctx, q.stream, id)
+		pipe.HDel(ctx, q.items, id)
+
+		return nil
+	})
+	if err != nil {
+		return errors.Wrap(err, "error in rdb.TxPipelined")
+	}
+
+	return nil
+}
+
+// Nack keeps item pending in stream, it will be consumed again by this consumer
+// or by other consumer after claimTimeout. Item with NotBefore is moved to sorted set
+// of delayed items and will be added to the end of stream after NotBefore.
+func (q *RedisQueue) Nack(ctx context.Context, item *Item) error {
+	if item.NotBefore.After(time.Now()) {
+		return q.delay(ctx, item)
+	}
+
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	q.retry = append([]*Item{item}, q.retry...)
+
+	return nil
+}
+
+func (q *RedisQueue) delay(ctx context.Context, item *Item) error {
+	itemJSON, err := json.Marshal(item)
+	if err != nil {
+		return errors.Wrap(err, "error in json.Marshal")
+	}
+
+	_, err = q.rdb.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.ZAdd(ctx, q.delayed, &redis.Z{
+			Score:  float64(item.NotBefore.UnixMilli()),
+			Member: itemJSON,
+		})
+		pipe.XAck(ctx, q.stream, q.group, item.receipt)
+		pipe.XDel(ctx, q.stream, item.receipt)
+		pipe.HDel(ctx, q.items, item.receipt)
+
+		return nil
+	})
+	if err != nil {
+		return errors.Wrap(err, "error in rdb.TxPipelined")
+	}
+
+	q.mutex.Lock()
+	delete(q.inflight, item.receipt)
+	q.mutex.Unlock()
+
+	return nil
+}
+
+// Len returns number of not acknowledged and delayed items.
+func (q *RedisQueue) Len(ctx context.Context) (int64, error) {
+	streamLen, err := q.rdb.XLen(ctx, q.stream).Result()
+	if err != nil {
+		return 0, errors.Wrap(err, "error in rdb.XLen")
+	}
+
+	delayedLen, err := q.rdb.ZCard(ctx, q.delayed).Result()
+	if err != nil {
+		return 0, errors.Wrap(err, "error in rdb.ZCard")
+	}
+
+	return streamLen + delayedLen, nil
+}
+
+func (q *RedisQueue) List(ctx context.Context, offset, limit int64) ([]*Item, error) {
+	var (
+		messages []redis.XMessage
+		err      error
+	)
+
+	if limit > 0 {
+		messages, err = q.rdb.XRangeN(ctx, q.stream, "-", "+", offset+limit).Result()
+	} else {
+		messages, err = q.rdb.XRange(ctx, q.stream, "-", "+").Result()
+	}
+
+	if err != nil {
+		return nil, errors.Wrap(err, "error in rdb.XRange")
+	}
+
+	values, err := q.getValues(ctx, messages)
+	if err != nil {
+		return nil, err
+	}
+
+	// delayed items are after stream items
+	if limit <= 0 || int64(len(values)) < offset+limit {
+		stop := int64(-1)
+		if limit > 0 {
+			stop = offset + limit - int64(len(values)) - 1
+		}
+
+		delayed, err := q.rdb.ZRange(ctx, q.delayed, 0, stop).Result()
+		if err != nil {
+			return nil, errors.Wrap(err, "error in rdb.ZRange")
+		}
+
+		values = append(values, delayed...)
+	}
+
+	result := make([]*Item, 0, len(values))
+
+	for i := offset; i < int64(len(values)); i++ {
+		item, err := decodeItem(values[i])
+		if err != nil {
+			return nil, err
+		}
+
+		result = append(result, item)
+	}
+
+	return result, nil
+}
+
+// getValues returns items of stream messages, items that were removed by coalesce are skipped.
+func (q *RedisQueue) getValues(ctx context.Context, messages []redis.XMessage) ([]string, error) {
+	ids := make([]string, 0)
+
+	for _, message := range messages {
+		if _, ok := message.Values[itemField]; !ok {
+			ids = append(ids, message.ID)
+		}
+	}
+
+	items := make(map[string]string, len(ids))
+
+	if len(ids) > 0 {
+		values, err := q.rdb.HMGet(ctx, q.items, ids...).Result()
+		if err != nil {
+			return nil, errors.Wrap(err, "error in rdb.HMGet")
+		}
+
+		for i, value := range values {
+			if value, ok := value.(string); ok {
+				items[ids[i]] = value
+			}
+		}
+	}
+
+	result := make([]string, 0, len(messages))
+
+	for _, message := range messages {
+		value, ok := message.Values[itemField].(string)
+		if !ok {
+			value, ok = items[message.ID]
+		}
+
+		if ok {
+			result = append(result, value)
+		}
+	}
+
+	return result, nil
+}
+
+// Delete removes stream and delayed items that match, item that is consumed by other consumer
+// is removed too, its acknowledge does nothing.
+func (q *RedisQueue) Delete(ctx context.Context, match func(*Item) bool) ([]*Item, error) {
+	messages, err := q.rdb.XRange(ctx, q.stream, "-", "+").Result()
+	if err != nil {
+		return nil, errors.Wrap(err, "error in rdb.XRange")
+	}
+
+	removed := make([]*Item, 0)
+
+	for _, message := range messages {
+		values, err := q.getValues(ctx, []redis.XMessage{message})
+		if err != nil {
+			return removed, err
+		}
+
+		// item was removed by coalesce
+		if len(values) == 0 {
+			continue
+		}
+
+		item, err := decodeItem(values[0])
+		if err != nil || !match(item) {
+			continue
+		}
+
+		file, _ := message.Values[fileField].(string)
+
+		deleted, err := deleteScript.Run(ctx, q.rdb, []string{q.stream, q.items, q.files},
+			q.group, message.ID, file, values[0]).Int()
+		if err != nil {
+			return removed, errors.Wrap(err, "error in deleteScript.Run")
+		}
+
+		if deleted == 1 {
+			removed = append(removed, item)
+		}
+	}
+
+	delayed, err := q.rdb.ZRange(ctx, q.delayed, 0, -1).Result()
+	if err != nil {
+		return removed, errors.Wrap(err, "error in rdb.ZRange")
+	}
+
+	for _, value := range delayed {
+		item, err := decodeItem(value)
+		if err != nil || !match(item) {
+			continue
+		}
+
+		// item could be moved to stream after it was read
+		deleted, err := q.rdb.ZRem(ctx, q.delayed, value).Result()
+		if err != nil {
+			return removed, errors.Wrap(err, "error in rdb.ZRem")
+		}
+
+		if deleted == 1 {
+			removed = append(removed, item)
+		}
+	}
+
+	return removed, nil
+}
+
+// Flush removes stream, delayed and coalesced items of destination.
+func (q *RedisQueue) Flush(ctx context.Context) error {
+	if err := q.rdb.Del(ctx, q.stream, q.delayed, q.items, q.files).Err(); err != nil {
+		return errors.Wrap(err, "error in rdb.Del")
+	}
+
+	q.mutex.Lock()
+	q.retry = make([]*Item, 0)
+	q.mutex.Unlock()
+
+	return q.createGroup(ctx)
+}
+
+func (q *RedisQueue) Info(ctx context.Context) (map[string]interface{}, error) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	return map[string]interface{}{
+		"type":     TypeRedis,
+		"stream":   q.stream,
+		"consumer": q.consumer,
+		"inflight": len(q.inflight),
+	}, nil
+}
+
+// RedisDeadLetterQueue keeps items in redis hash.
+type RedisDeadLetterQueue struct {
+	rdb *redis.Client
+	key string
+}
+
+func NewRedisDeadLetterQueue(rdb *redis.Client) *RedisDeadLetterQueue {
+	return &RedisDeadLetterQueue{
+		rdb: rdb,
+		key: getRedisKey(deadLetterKey),
+	}
+}
+
+func (q *RedisDeadLetterQueue) Add(ctx context.Context, item *Item) error {
+	itemJSON, err := json.Marshal(item)
+	if err != nil {
+		return errors.Wrap(err, "error in json.Marshal")
+	}
+
+	if err := q.rdb.HSet(ctx, q.key, item.ID, itemJSON).Err(); err != nil {
+		return errors.Wrap(err, "error in rdb.HSet")
+	}
+
+	return nil
+}
+
+func (q *RedisDeadLetterQueue) Get(ctx context.Context, id string) (*Item, error) {
+	value, err := q.rdb.HGet(ctx, q.key, id).Result()
+	if errors.Is(err, redis.Nil) {
+		return nil, ErrNotFound
+	}
+
+	if err != nil {
+		return nil, errors.Wrap(err, "error in rdb.HGet")
+	}
+
+	return decodeItem(value)
+}
+
+func (q *RedisDeadLetterQueue) List(ctx context.Context) ([]*Item, error) {
+	values, err := q.rdb.HGetAll(ctx, q.key).Result()
+	if err != nil {
+		return nil, errors.Wrap(err, "error in rdb.HGetAll")
+	}
+
+	result := make([]*Item, 0, len(values))
+
+	for _, value := range values {
+		item, err := decodeItem(value)
+		if err != nil {
+			return nil, err
+		}
+
+		result = append(result, item)
+	}
+
+	sortByFailed(result)
+
+	return result, nil
+}
+
+func (q *RedisDeadLetterQueue) Remove(ctx context.Context, id string) error {
+	if err := q.rdb.HDel(ctx, q.key, id).Err(); err != nil {
+		return errors.Wrap(err, "error in rdb.HDel")
+	}
+
+	return nil
+}
+
+func (q *RedisDeadLetterQueue) Len(ctx context.Context) (int64, error) {
+	return q.rdb.HLen(ctx, q.key).Result()
+}
+
+// RedisJobStore keeps jobs in redis hash, expired jobs are found by sorted set of update time.
+type RedisJobStore struct {
+	rdb         *redis.Client
+	key         string
+	updatedKey  string
+	mutex       sync.Mutex
+	lastCleanup time.Time
+}
+
+func NewRedisJobStore(rdb *redis.Client) *RedisJobStore {
+	return &RedisJobStore{
+		rdb:        rdb,
+		key:        getRedisKey(jobsKey),
+		updatedKey: getRedisKey(jobsUpdatedKey),
+	}
+}
+
+func (s *RedisJobStore) Get(ctx context.Context, id string) (*Job, error) {
+	value, err := s.rdb.HGet(ctx, s.key, id).Result()
+	if errors.Is(err, redis.Nil) {
+		return nil, ErrNotFound
+	}
+
+	if err != nil {
+		return nil, errors.Wrap(err, "error in rdb.HGet")
+	}
+
+	job := &Job{}
+
+	if err := json.Unmarshal([]byte(value), job); err != nil {
+		return nil, errors.Wrap(err, "error in json.Unmarshal")
+	}
+
+	return job, nil
+}
+
+func (s *RedisJobStore) Set(ctx context.Context, job *Job) error {
+	jobJSON, err := json.Marshal(job)
+	if err != nil {
+		return errors.Wrap(err, "error in json.Marshal")
+	}
+
+	_, err = s.rdb.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.HSet(ctx, s.key, job.ID, jobJSON)
+		pipe.ZAdd(ctx, s.updatedKey, &redis.Z{
+			Score:  float64(job.Updated.UnixMilli()),
+			Member: job.ID,
+		})
+
+		return nil
+	})
+	if err != nil {
+		return errors.Wrap(err, "error in rdb.TxPipelined")
+	}
+
+	return s.cleanup(ctx)
+}
+
+// cleanup removes jobs that were not updated for jobs.retention.
+func (s *RedisJobStore) cleanup(ctx context.Context) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if time.Since(s.lastCleanup) < jobCleanupInterval {
+		return nil
+	}
+
+	s.lastCleanup = time.Now()
+
+	maxScore := strconv.FormatInt(time.Now().Add(-*config.Get().JobsRetention).UnixMilli(), 10)
+
+	ids, err := s.rdb.ZRangeByScore(ctx, s.updatedKey, &redis.ZRangeBy{Min: "-inf", Max: maxScore}).Result()
+	if err != nil {
+		return errors.Wrap(err, "error in rdb.ZRangeByScore")
+	}
+
+	if len(ids) == 0 {
+		return nil
+	}
+
+	members := make([]interface{}, 0, len(ids))
+	for _, id := range ids {
+		members = append(members, id)
+	}
+
+	_, err = s.rdb.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.HDel(ctx, s.key, ids...)
+		pipe.ZRem(ctx, s.updatedKey, members...)
+
+		return nil
+	})
+	if err != nil {
+		return errors.Wrap(err, "error in rdb.TxPipelined")
+	}
+
+	return nil
+}
+
+func (s *RedisJobStore) List(ctx context.Context) ([]*Job, error) {
+	values, err := s.rdb.HGetAll(ctx, s.key).Result()
+	if err != nil {
+		return nil, errors.Wrap(err, "error in rdb.HGetAll")
+	}
+
+	result := make([]*Job, 0, len(values))
+
+	for _, value := range values {
+		job := &Job{}
+
+		if err := json.Unmarshal([]byte(value), job); err != nil {
+			return nil, errors.Wrap(err, "error in json.Unmarshal")
+		}
+
+		result = append(result, job)
+	}
+
+	sortByCreated(result)
+
+	return result, nil
+}
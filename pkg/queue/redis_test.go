@@ -0,0 +1,213 @@
+/*
+Copyright paskal.maksim@gmail.com
+Licensed under the Apache License, Version 2.0 (the "License")
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package queue_test
+
+import (
+	"context"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis/v8"
+	"github.com/maksim-paskal/file-sync/pkg/api"
+	"github.com/maksim-paskal/file-sync/pkg/queue"
+)
+
+const redisTestClaimTimeout = 100 * time.Millisecond
+
+func newTestRedis(t *testing.T) *redis.Client {
+	t.Helper()
+
+	rdb := redis.NewClient(&redis.Options{Addr: miniredis.RunT(t).Addr()})
+	t.Cleanup(func() { rdb.Close() })
+
+	return rdb
+}
+
+func newTestRedisQueue(ctx context.Context, t *testing.T, rdb *redis.Client, consumer string) *queue.RedisQueue {
+	t.Helper()
+
+	q, err := queue.NewRedisQueue(ctx, rdb, "test", consumer, redisTestClaimTimeout)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return q
+}
+
+func addTestItems(ctx context.Context, t *testing.T, q queue.Queue, count int) {
+	t.Helper()
+
+	for i := 0; i < count; i++ {
+		item := &queue.Item{
+			ID:      strconv.Itoa(i),
+			Message: api.Message{Type: api.MessageTypePut, FileName: strconv.Itoa(i)},
+		}
+
+		if err := q.Add(ctx, item); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func consumeTestItem(ctx context.Context, t *testing.T, q queue.Queue, id string) *queue.Item {
+	t.Helper()
+
+	item, err := q.Consume(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if item.ID != id {
+		t.Fatalf("item %s must be consumed, got %s", id, item.ID)
+	}
+
+	return item
+}
+
+func TestRedisQueueClaim(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	rdb := newTestRedis(t)
+
+	dead := newTestRedisQueue(ctx, t, rdb, "dead")
+
+	addTestItems(ctx, t, dead, 2)
+
+	// consumer died while delivering first item
+	consumeTestItem(ctx, t, dead, "0")
+
+	time.Sleep(2 * redisTestClaimTimeout)
+
+	q := newTestRedisQueue(ctx, t, rdb, "alive")
+
+	// stale item is claimed before new items
+	item := consumeTestItem(ctx, t, q, "0")
+
+	if err := q.Ack(ctx, item); err != nil {
+		t.Fatal(err)
+	}
+
+	item = consumeTestItem(ctx, t, q, "1")
+
+	if err := q.Ack(ctx, item); err != nil {
+		t.Fatal(err)
+	}
+
+	if queueLen, err := q.Len(ctx); err != nil || queueLen != 0 {
+		t.Fatalf("queue must be empty, got %d, %v", queueLen, err)
+	}
+}
+
+func TestRedisQueueNack(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	q := newTestRedisQueue(ctx, t, newTestRedis(t), "test")
+
+	addTestItems(ctx, t, q, 3)
+
+	// failed item returns to the head of queue
+	item := consumeTestItem(ctx, t, q, "0")
+	item.Attempts++
+
+	if err := q.Nack(ctx, item); err != nil {
+		t.Fatal(err)
+	}
+
+	item = consumeTestItem(ctx, t, q, "0")
+	if item.Attempts != 1 {
+		t.Fatalf("attempts must be kept, got %d", item.Attempts)
+	}
+
+	if err := q.Ack(ctx, item); err != nil {
+		t.Fatal(err)
+	}
+
+	// item with time of next attempt is moved to the end of queue
+	item = consumeTestItem(ctx, t, q, "1")
+	item.NotBefore = time.Now().Add(redisTestClaimTimeout)
+
+	if err := q.Nack(ctx, item); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, id := range []string{"2", "1"} {
+		if err := q.Ack(ctx, consumeTestItem(ctx, t, q, id)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if queueLen, err := q.Len(ctx); err != nil || queueLen != 0 {
+		t.Fatalf("queue must be empty, got %d, %v", queueLen, err)
+	}
+}
+
+func TestRedisQueueDelete(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	q := newTestRedisQueue(ctx, t, newTestRedis(t), "test")
+
+	addTestItems(ctx, t, q, 4)
+
+	// delayed item is deleted too
+	item := consumeTestItem(ctx, t, q, "0")
+	item.NotBefore = time.Now().Add(time.Hour)
+
+	if err := q.Nack(ctx, item); err != nil {
+		t.Fatal(err)
+	}
+
+	removed, err := q.Delete(ctx, func(item *queue.Item) bool {
+		return item.ID == "0" || item.ID == "2"
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(removed) != 2 {
+		t.Fatalf("2 items must be removed, got %d", len(removed))
+	}
+
+	// new write of removed file is not merged with removed item
+	if err := q.Add(ctx, &queue.Item{
+		ID:      "4",
+		Message: api.Message{Type: api.MessageTypePut, FileName: "2"},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	items, err := q.List(ctx, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ids := make([]string, 0, len(items))
+	for _, item := range items {
+		ids = append(ids, item.ID)
+	}
+
+	if want := []string{"1", "3", "4"}; strings.Join(ids, ",") != strings.Join(want, ",") {
+		t.Fatalf("want %v, got %v", want, ids)
+	}
+}
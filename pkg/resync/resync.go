@@ -0,0 +1,178 @@
+/*
+Copyright paskal.maksim@gmail.com
+Licensed under the Apache License, Version 2.0 (the "License")
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package resync
+
+import (
+	"context"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/maksim-paskal/file-sync/pkg/api"
+	"github.com/maksim-paskal/file-sync/pkg/config"
+	"github.com/maksim-paskal/file-sync/pkg/queue"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+var mutex sync.Mutex
+
+type Result struct {
+	Put    int    `json:"put"`
+	Patch  int    `json:"patch"`
+	Delete int    `json:"delete"`
+	Error  string `json:"error,omitempty"`
+}
+
+// Diff returns messages that make destination equal to source, put and patch messages are without content.
+func Diff(source, destination []api.ManifestItem) []api.Message {
+	result := make([]api.Message, 0)
+
+	destinationFiles := make(map[string]api.ManifestItem, len(destination))
+	for _, item := range destination {
+		destinationFiles[item.Path] = item
+	}
+
+	for _, item := range source {
+		destinationItem, ok := destinationFiles[item.Path]
+
+		delete(destinationFiles, item.Path)
+
+		switch {
+		case !ok:
+			result = append(result, api.Message{Type: api.MessageTypePut, FileName: item.Path})
+		case destinationItem.SHA256 != item.SHA256:
+			result = append(result, api.Message{Type: api.MessageTypePatch, FileName: item.Path})
+		}
+	}
+
+	deleted := make([]string, 0, len(destinationFiles))
+	for fileName := range destinationFiles {
+		deleted = append(deleted, fileName)
+	}
+
+	sort.Strings(deleted)
+
+	for _, fileName := range deleted {
+		result = append(result, api.Message{Type: api.MessageTypeDelete, FileName: fileName})
+	}
+
+	return result
+}
+
+// Run compares SourceDir with destination manifest and sends messages to fix differences.
+func Run(ctx context.Context, destination string) (Result, error) {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	result := Result{}
+
+	// resync is not started if SourceDir is missing, all files on destination would be deleted
+	source, err := api.GetManifest(*config.Get().SourceDir)
+	if err != nil {
+		return result, errors.Wrap(err, "error in api.GetManifest")
+	}
+
+	destinationManifest, err := api.GetRemoteManifest(ctx, destination)
+	if err != nil {
+		return result, errors.Wrap(err, "error in api.GetRemoteManifest")
+	}
+
+	for _, message := range Diff(source, destinationManifest) {
+		if err := Send(destination, message); err != nil {
+			return result, err
+		}
+
+		switch message.Type {
+		case api.MessageTypePut:
+			result.Put++
+		case api.MessageTypePatch:
+			result.Patch++
+		case api.MessageTypeDelete:
+			result.Delete++
+		}
+	}
+
+	log.Infof("resync destination=%s,put=%d,patch=%d,delete=%d", destination, result.Put, result.Patch, result.Delete)
+
+	return result, nil
+}
+
+// Send sends message from diff to destination, content of put and patch messages is read from SourceDir.
+func Send(destination string, message api.Message) error {
+	if message.Type == api.MessageTypePut || message.Type == api.MessageTypePatch {
+		var err error
+
+		message, err = api.NewMessage(message.Type, filepath.FromSlash(message.FileName), "")
+		if errors.Is(err, api.ErrFileNotFound) {
+			// file was deleted after manifest was created
+			return nil
+		}
+
+		if err != nil {
+			return errors.Wrap(err, "error in api.NewMessage")
+		}
+
+		// destination state can be changed before message will be delivered
+		message.Force = true
+	}
+
+	if _, err := queue.Send(message, []string{destination}); err != nil {
+		return errors.Wrap(err, "error in queue.Send")
+	}
+
+	return nil
+}
+
+// RunAll runs resync for all destinations.
+func RunAll(ctx context.Context, destinations []string) map[string]Result {
+	results := make(map[string]Result, len(destinations))
+
+	for _, destination := range destinations {
+		result, err := Run(ctx, destination)
+		if err != nil {
+			log.WithError(err).WithField("destination", destination).Error("error in resync.Run")
+
+			result.Error = err.Error()
+		}
+
+		results[destination] = result
+	}
+
+	return results
+}
+
+// Schedule runs resync for all destinations every resync.interval.
+func Schedule(ctx context.Context, destinations []string) {
+	interval := *config.Get().ResyncInterval
+	if interval <= 0 {
+		return
+	}
+
+	log.Infof("resync scheduled every %s", interval)
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				RunAll(ctx, destinations)
+			}
+		}
+	}()
+}
@@ -0,0 +1,70 @@
+/*
+Copyright paskal.maksim@gmail.com
+Licensed under the Apache License, Version 2.0 (the "License")
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package resync_test
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/maksim-paskal/file-sync/pkg/api"
+	"github.com/maksim-paskal/file-sync/pkg/config"
+	"github.com/maksim-paskal/file-sync/pkg/resync"
+)
+
+func TestDiff(t *testing.T) {
+	t.Parallel()
+
+	source := []api.ManifestItem{
+		{Path: "same.txt", SHA256: "1"},
+		{Path: "changed.txt", SHA256: "2"},
+		{Path: "new.txt", SHA256: "3"},
+	}
+
+	destination := []api.ManifestItem{
+		{Path: "same.txt", SHA256: "1"},
+		{Path: "changed.txt", SHA256: "old"},
+		{Path: "deleted2.txt", SHA256: "4"},
+		{Path: "deleted1.txt", SHA256: "5"},
+	}
+
+	want := []api.Message{
+		{Type: api.MessageTypePatch, FileName: "changed.txt"},
+		{Type: api.MessageTypePut, FileName: "new.txt"},
+		{Type: api.MessageTypeDelete, FileName: "deleted1.txt"},
+		{Type: api.MessageTypeDelete, FileName: "deleted2.txt"},
+	}
+
+	if got := resync.Diff(source, destination); !reflect.DeepEqual(got, want) {
+		t.Fatalf("got=%+v,want=%+v", got, want)
+	}
+
+	if got := resync.Diff(source, source); len(got) != 0 {
+		t.Fatalf("no changes expected, got=%+v", got)
+	}
+}
+
+func TestRunSourceNotExists(t *testing.T) {
+	t.Parallel()
+
+	sourceDir := filepath.Join(t.TempDir(), "not-exists")
+	config.Get().SourceDir = &sourceDir
+
+	// destination must not be requested
+	_, err := resync.Run(context.Background(), "127.0.0.1:1")
+	if !errors.Is(err, api.ErrFileNotFound) {
+		t.Fatalf("must be file not found error, got %v", err)
+	}
+}
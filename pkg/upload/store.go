@@ -0,0 +1,103 @@
+/*
+Copyright paskal.maksim@gmail.com
+Licensed under the Apache License, Version 2.0 (the "License")
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package upload
+
+import (
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/maksim-paskal/file-sync/pkg/config"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// folder of chunk store in upload folder.
+const storeDir = "chunks"
+
+func getStoreDir() string {
+	return filepath.Join(*config.Get().SyncUploadDir, storeDir)
+}
+
+// getChunkPath returns folder and name of chunk in store, chunks are split
+// to folders by first bytes of SHA256.
+func getChunkPath(hash string) (string, string) {
+	return filepath.Join(getStoreDir(), hash[:2]), hash
+}
+
+// hasChunk returns true if chunk is in store, found chunk is not removed for retention period.
+func hasChunk(hash string) (bool, error) {
+	dir, name := getChunkPath(hash)
+	chunkPath := filepath.Join(dir, name)
+
+	now := time.Now()
+
+	err := os.Chtimes(chunkPath, now, now)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+
+	if err != nil {
+		return false, errors.Wrap(err, "error in os.Chtimes")
+	}
+
+	return true, nil
+}
+
+// CleanupChunks removes chunks that were not used for retention period, returns number of removed chunks.
+func CleanupChunks(retention time.Duration) (int, error) {
+	removed := 0
+
+	err := filepath.WalkDir(getStoreDir(), func(path string, entry fs.DirEntry, err error) error {
+		if os.IsNotExist(err) {
+			return nil
+		}
+
+		if err != nil {
+			return err
+		}
+
+		// temporary files are removed with chunks
+		if entry.IsDir() || !(idRegexp.MatchString(entry.Name()) || strings.HasSuffix(entry.Name(), tmpSuffix)) {
+			return nil
+		}
+
+		info, err := entry.Info()
+		if err != nil {
+			return errors.Wrap(err, "error in entry.Info")
+		}
+
+		if time.Since(info.ModTime()) < retention {
+			return nil
+		}
+
+		if err := os.Remove(path); err != nil {
+			return errors.Wrap(err, "error in os.Remove")
+		}
+
+		removed++
+
+		return nil
+	})
+	if err != nil {
+		return removed, errors.Wrap(err, "error in filepath.WalkDir")
+	}
+
+	if removed > 0 {
+		log.Infof("%d chunks removed, they were not used for %s", removed, retention)
+	}
+
+	return removed, nil
+}
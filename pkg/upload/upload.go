@@ -0,0 +1,435 @@
+/*
+Copyright paskal.maksim@gmail.com
+Licensed under the Apache License, Version 2.0 (the "License")
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package upload
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"time"
+
+	"github.com/maksim-paskal/file-sync/pkg/config"
+	"github.com/maksim-paskal/file-sync/pkg/utils"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	sessionFile = "session.json"
+	tmpSuffix   = ".tmp"
+	// max number of chunks in one upload
+	maxChunks       = 100000
+	cleanupInterval = 10 * time.Minute
+)
+
+var (
+	ErrNotFound = errors.New("upload not found")
+	ErrInvalid  = errors.New("invalid upload")
+	ErrChecksum = errors.New("chunk SHA256 check failed")
+)
+
+var idRegexp = regexp.MustCompile(`^[0-9a-f]{64}$`)
+
+// Session is upload of one file in chunks, chunks are kept in store by SHA256
+// and are read in order when upload is committed.
+type Session struct {
+	ID        string `json:"id"`
+	FileName  string `json:"fileName"`
+	SHA256    string `json:"sha256"`
+	Size      int64  `json:"size"`
+	ChunkSize int64  `json:"chunkSize"`
+	// SHA256 of every chunk
+	Hashes []string `json:"hashes"`
+	// indexes of chunks that are in store, they were received in this upload or in other files
+	Chunks []int `json:"chunks"`
+}
+
+// Count returns number of chunks.
+func (s *Session) Count() int {
+	return int((s.Size + s.ChunkSize - 1) / s.ChunkSize)
+}
+
+// ChunkLen returns size of chunk, last chunk can be shorter.
+func (s *Session) ChunkLen(index int) int64 {
+	if index == s.Count()-1 {
+		return s.Size - int64(index)*s.ChunkSize
+	}
+
+	return s.ChunkSize
+}
+
+// id of session depends on file and content, interrupted upload of the same content is resumed.
+func newID(session Session) string {
+	value := fmt.Sprintf("%s:%s:%d:%d", session.FileName, session.SHA256, session.Size, session.ChunkSize)
+
+	return utils.NewSHA256([]byte(value))
+}
+
+func getDir(id string) (string, error) {
+	if !idRegexp.MatchString(id) {
+		return "", errors.Wrapf(ErrInvalid, "id %s", id)
+	}
+
+	return filepath.Join(*config.Get().SyncUploadDir, id), nil
+}
+
+// Begin creates upload session, returned session has chunks that destination
+// has in store from interrupted upload of the same file or from other files.
+func Begin(session Session) (*Session, error) {
+	if len(session.FileName) == 0 || len(session.SHA256) == 0 || session.Size <= 0 || session.ChunkSize <= 0 {
+		return nil, errors.Wrap(ErrInvalid, "fileName, sha256, size and chunkSize are required")
+	}
+
+	if session.Count() > maxChunks {
+		return nil, errors.Wrapf(ErrInvalid, "more than %d chunks", maxChunks)
+	}
+
+	if len(session.Hashes) != session.Count() {
+		return nil, errors.Wrapf(ErrInvalid, "%d hashes of %d chunks", len(session.Hashes), session.Count())
+	}
+
+	for _, hash := range session.Hashes {
+		if !idRegexp.MatchString(hash) {
+			return nil, errors.Wrapf(ErrInvalid, "hash %s", hash)
+		}
+	}
+
+	session.ID = newID(session)
+	session.Chunks = nil
+
+	dir, err := getDir(session.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := os.MkdirAll(dir, 0o755); err != nil { //nolint:gomnd
+		return nil, errors.Wrap(err, "error in os.MkdirAll")
+	}
+
+	// resumed upload is not removed while sender is active
+	now := time.Now()
+
+	if err := os.Chtimes(dir, now, now); err != nil {
+		return nil, errors.Wrap(err, "error in os.Chtimes")
+	}
+
+	if _, err := os.Stat(filepath.Join(dir, sessionFile)); os.IsNotExist(err) {
+		data, err := json.Marshal(session)
+		if err != nil {
+			return nil, errors.Wrap(err, "error in json.Marshal")
+		}
+
+		if _, err := writeFile(dir, sessionFile, bytes.NewReader(data)); err != nil {
+			return nil, err
+		}
+
+		log.Infof("upload %s of file %s started", session.ID, session.FileName)
+	}
+
+	return Get(session.ID)
+}
+
+// Get returns upload session with chunks that are in store.
+func Get(id string) (*Session, error) {
+	_, session, err := load(id)
+	if err != nil {
+		return nil, err
+	}
+
+	session.Chunks = make([]int, 0)
+
+	for index, hash := range session.Hashes {
+		ok, err := hasChunk(hash)
+		if err != nil {
+			return nil, err
+		}
+
+		if ok {
+			session.Chunks = append(session.Chunks, index)
+		}
+	}
+
+	return session, nil
+}
+
+func load(id string) (string, *Session, error) {
+	dir, err := getDir(id)
+	if err != nil {
+		return "", nil, err
+	}
+
+	data, err := os.ReadFile(filepath.Join(dir, sessionFile))
+	if os.IsNotExist(err) {
+		return "", nil, errors.Wrap(ErrNotFound, id)
+	}
+
+	if err != nil {
+		return "", nil, errors.Wrap(err, "error in os.ReadFile")
+	}
+
+	session := &Session{}
+
+	if err := json.Unmarshal(data, session); err != nil {
+		return "", nil, errors.Wrap(err, "error in json.Unmarshal")
+	}
+
+	return dir, session, nil
+}
+
+// WriteChunk stores chunk of upload, chunk is stored only if its content matches sha256 from session.
+func WriteChunk(id string, index int, checksum string, body io.Reader) error {
+	dir, session, err := load(id)
+	if err != nil {
+		return err
+	}
+
+	if index < 0 || index >= session.Count() {
+		return errors.Wrapf(ErrInvalid, "chunk %d, upload has %d chunks", index, session.Count())
+	}
+
+	if checksum != session.Hashes[index] {
+		return errors.Wrapf(ErrChecksum, "chunk %d must have SHA256 %s", index, session.Hashes[index])
+	}
+
+	// upload is not removed while chunks are received
+	now := time.Now()
+
+	if err := os.Chtimes(dir, now, now); err != nil {
+		return errors.Wrap(err, "error in os.Chtimes")
+	}
+
+	length := session.ChunkLen(index)
+
+	check := func(size int64, hash string) error {
+		if size != length {
+			return errors.Wrapf(ErrInvalid, "chunk %d size %d, must be %d", index, size, length)
+		}
+
+		if hash != checksum {
+			return errors.Wrapf(ErrChecksum, "chunk %d", index)
+		}
+
+		return nil
+	}
+
+	chunkDir, chunkName := getChunkPath(checksum)
+
+	if err := os.MkdirAll(chunkDir, 0o755); err != nil { //nolint:gomnd
+		return errors.Wrap(err, "error in os.MkdirAll")
+	}
+
+	// chunk must have exact size, bigger chunk is not read to the end
+	written, err := writeFile(chunkDir, chunkName, io.LimitReader(body, length+1), check)
+	if err != nil {
+		return err
+	}
+
+	log.Debugf("upload %s chunk %d received, size=%d", id, index, written)
+
+	return nil
+}
+
+// writeFile writes file atomically, file is replaced only if all checks of its size and SHA256 are passed.
+func writeFile(dir, name string, content io.Reader, checks ...func(size int64, hash string) error) (int64, error) {
+	file, err := os.CreateTemp(dir, name+"-*"+tmpSuffix)
+	if err != nil {
+		return 0, errors.Wrap(err, "error in os.CreateTemp")
+	}
+	defer os.Remove(file.Name())
+	defer file.Close()
+
+	hash := sha256.New()
+
+	size, err := io.Copy(io.MultiWriter(file, hash), content)
+	if err != nil {
+		return 0, errors.Wrap(err, "error in io.Copy")
+	}
+
+	for _, check := range checks {
+		if err := check(size, hex.EncodeToString(hash.Sum(nil))); err != nil {
+			return 0, err
+		}
+	}
+
+	if err := file.Sync(); err != nil {
+		return 0, errors.Wrap(err, "error in file.Sync")
+	}
+
+	if err := file.Close(); err != nil {
+		return 0, errors.Wrap(err, "error in file.Close")
+	}
+
+	if err := os.Rename(file.Name(), filepath.Join(dir, name)); err != nil {
+		return 0, errors.Wrap(err, "error in os.Rename")
+	}
+
+	return size, nil
+}
+
+// Open returns content of upload, all chunks must be in store.
+func Open(id string) (io.ReadCloser, error) {
+	session, err := Get(id)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(session.Chunks) != session.Count() {
+		return nil, errors.Wrapf(ErrInvalid, "upload is incomplete, received %d of %d chunks", len(session.Chunks), session.Count()) //nolint:lll
+	}
+
+	return &reader{hashes: session.Hashes}, nil
+}
+
+// Remove removes upload, chunks are kept in store for other uploads.
+func Remove(id string) error {
+	dir, err := getDir(id)
+	if err != nil {
+		return err
+	}
+
+	if err := os.RemoveAll(dir); err != nil {
+		return errors.Wrap(err, "error in os.RemoveAll")
+	}
+
+	return nil
+}
+
+// Cleanup removes uploads that were not changed for timeout, returns number of removed uploads.
+func Cleanup(timeout time.Duration) (int, error) {
+	entries, err := os.ReadDir(*config.Get().SyncUploadDir)
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+
+	if err != nil {
+		return 0, errors.Wrap(err, "error in os.ReadDir")
+	}
+
+	removed := 0
+
+	for _, entry := range entries {
+		if !entry.IsDir() || !idRegexp.MatchString(entry.Name()) {
+			continue
+		}
+
+		info, err := entry.Info()
+		if err != nil {
+			return removed, errors.Wrap(err, "error in entry.Info")
+		}
+
+		if time.Since(info.ModTime()) < timeout {
+			continue
+		}
+
+		if err := Remove(entry.Name()); err != nil {
+			return removed, err
+		}
+
+		log.Infof("upload %s removed, it was not changed for %s", entry.Name(), timeout)
+
+		removed++
+	}
+
+	return removed, nil
+}
+
+// Schedule removes abandoned uploads and chunks that were not used in background.
+func Schedule(ctx context.Context) {
+	timeout := *config.Get().SyncUploadTimeout
+	retention := *config.Get().SyncChunkMaxAge
+
+	if timeout <= 0 && retention <= 0 {
+		return
+	}
+
+	go func() {
+		ticker := time.NewTicker(cleanupInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				if timeout > 0 {
+					if _, err := Cleanup(timeout); err != nil {
+						log.WithError(err).Error("error in upload.Cleanup")
+					}
+				}
+
+				if retention > 0 {
+					if _, err := CleanupChunks(retention); err != nil {
+						log.WithError(err).Error("error in upload.CleanupChunks")
+					}
+				}
+			}
+		}
+	}()
+}
+
+// reader reads chunks of upload in order.
+type reader struct {
+	hashes []string
+	index  int
+	file   *os.File
+}
+
+func (r *reader) Read(p []byte) (int, error) {
+	for {
+		if r.file == nil {
+			if r.index >= len(r.hashes) {
+				return 0, io.EOF
+			}
+
+			file, err := os.Open(filepath.Join(getChunkPath(r.hashes[r.index])))
+			if err != nil {
+				return 0, errors.Wrap(err, "error in os.Open")
+			}
+
+			r.file = file
+			r.index++
+		}
+
+		n, err := r.file.Read(p)
+		if errors.Is(err, io.EOF) {
+			if err := r.file.Close(); err != nil {
+				return n, errors.Wrap(err, "error in file.Close")
+			}
+
+			r.file = nil
+
+			if n == 0 {
+				continue
+			}
+
+			return n, nil
+		}
+
+		return n, err //nolint:wrapcheck
+	}
+}
+
+func (r *reader) Close() error {
+	if r.file == nil {
+		return nil
+	}
+
+	return r.file.Close() //nolint:wrapcheck
+}
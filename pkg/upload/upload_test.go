@@ -0,0 +1,182 @@
+/*
+Copyright paskal.maksim@gmail.com
+Licensed under the Apache License, Version 2.0 (the "License")
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package upload_test
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/maksim-paskal/file-sync/pkg/config"
+	"github.com/maksim-paskal/file-sync/pkg/upload"
+	"github.com/maksim-paskal/file-sync/pkg/utils"
+)
+
+func withUploadDir(t *testing.T) {
+	t.Helper()
+
+	dir := t.TempDir()
+
+	value := config.Get().SyncUploadDir
+	config.Get().SyncUploadDir = &dir
+
+	t.Cleanup(func() { config.Get().SyncUploadDir = value })
+}
+
+func TestUpload(t *testing.T) { //nolint:paralleltest
+	withUploadDir(t)
+
+	content := []byte("0123456789")
+	chunks := [][]byte{content[0:4], content[4:8], content[8:10]}
+
+	begin := upload.Session{
+		FileName:  "test.txt",
+		SHA256:    utils.NewSHA256(content),
+		Size:      int64(len(content)),
+		ChunkSize: 4,
+	}
+
+	for _, chunk := range chunks {
+		begin.Hashes = append(begin.Hashes, utils.NewSHA256(chunk))
+	}
+
+	session, err := upload.Begin(begin)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if session.Count() != len(chunks) || len(session.Chunks) != 0 {
+		t.Fatalf("session %+v not OK", session)
+	}
+
+	if err := upload.WriteChunk(session.ID, 1, utils.NewSHA256(chunks[1]), bytes.NewReader(chunks[1])); err != nil {
+		t.Fatal(err)
+	}
+
+	// wrong chunks are not stored
+	if err := upload.WriteChunk(session.ID, 0, "wrong", bytes.NewReader(chunks[0])); !errors.Is(err, upload.ErrChecksum) {
+		t.Fatalf("must be checksum error, got %v", err)
+	}
+
+	if err := upload.WriteChunk(session.ID, 2, utils.NewSHA256(chunks[2]), bytes.NewReader(content)); !errors.Is(err, upload.ErrInvalid) { //nolint:lll
+		t.Fatalf("must be invalid error, got %v", err)
+	}
+
+	if err := upload.WriteChunk(session.ID, 3, utils.NewSHA256(chunks[0]), bytes.NewReader(chunks[0])); !errors.Is(err, upload.ErrInvalid) { //nolint:lll
+		t.Fatalf("must be invalid error, got %v", err)
+	}
+
+	if _, err := upload.Open(session.ID); !errors.Is(err, upload.ErrInvalid) {
+		t.Fatalf("incomplete upload must not be opened, got %v", err)
+	}
+
+	// interrupted upload is resumed
+	session, err = upload.Begin(begin)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(session.Chunks) != 1 || session.Chunks[0] != 1 {
+		t.Fatalf("received chunks %v not OK", session.Chunks)
+	}
+
+	for _, index := range []int{0, 2} {
+		if err := upload.WriteChunk(session.ID, index, utils.NewSHA256(chunks[index]), bytes.NewReader(chunks[index])); err != nil { //nolint:lll
+			t.Fatal(err)
+		}
+	}
+
+	body, err := upload.Open(session.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer body.Close()
+
+	result, err := ioutil.ReadAll(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(result, content) {
+		t.Fatalf("content %s not OK", string(result))
+	}
+
+	if err := upload.Remove(session.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := upload.Get(session.ID); !errors.Is(err, upload.ErrNotFound) {
+		t.Fatalf("upload must be removed, got %v", err)
+	}
+
+	// chunks of other file with the same content are in store
+	begin.FileName = "copy.txt"
+
+	session, err = upload.Begin(begin)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(session.Chunks) != len(chunks) {
+		t.Fatalf("chunks %v must be in store", session.Chunks)
+	}
+
+	if _, err := upload.Get("../test"); !errors.Is(err, upload.ErrInvalid) {
+		t.Fatalf("id must be invalid, got %v", err)
+	}
+}
+
+func TestUploadCleanup(t *testing.T) { //nolint:paralleltest
+	withUploadDir(t)
+
+	content := []byte("1")
+	hash := utils.NewSHA256(content)
+
+	begin := upload.Session{FileName: "test.txt", SHA256: hash, Size: 1, ChunkSize: 1, Hashes: []string{hash}}
+
+	session, err := upload.Begin(begin)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := upload.WriteChunk(session.ID, 0, hash, bytes.NewReader(content)); err != nil {
+		t.Fatal(err)
+	}
+
+	if removed, err := upload.CleanupChunks(time.Hour); err != nil || removed != 0 {
+		t.Fatalf("used chunk must not be removed, removed=%d,err=%v", removed, err)
+	}
+
+	if removed, err := upload.CleanupChunks(0); err != nil || removed != 1 {
+		t.Fatalf("unused chunk must be removed, removed=%d,err=%v", removed, err)
+	}
+
+	if removed, err := upload.Cleanup(time.Hour); err != nil || removed != 0 {
+		t.Fatalf("active upload must not be removed, removed=%d,err=%v", removed, err)
+	}
+
+	if removed, err := upload.Cleanup(0); err != nil || removed != 1 {
+		t.Fatalf("abandoned upload must be removed, removed=%d,err=%v", removed, err)
+	}
+
+	if _, err := upload.Get(session.ID); !errors.Is(err, upload.ErrNotFound) {
+		t.Fatalf("upload must be removed, got %v", err)
+	}
+
+	// store without chunks
+	if removed, err := upload.CleanupChunks(0); err != nil || removed != 0 {
+		t.Fatalf("removed=%d,err=%v", removed, err)
+	}
+}
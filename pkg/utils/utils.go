@@ -15,6 +15,10 @@ package utils
 import (
 	"crypto/sha256"
 	"encoding/hex"
+	"io"
+	"os"
+
+	"github.com/pkg/errors"
 )
 
 func NewSHA256(data []byte) string {
@@ -23,3 +27,24 @@ func NewSHA256(data []byte) string {
 
 	return hex.EncodeToString(hashByte)
 }
+
+// NewSHA256Reader returns SHA256 of all data from reader without loading it into memory.
+func NewSHA256Reader(r io.Reader) (string, error) {
+	hash := sha256.New()
+
+	if _, err := io.Copy(hash, r); err != nil {
+		return "", errors.Wrap(err, "error in io.Copy")
+	}
+
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+func NewSHA256File(fileName string) (string, error) {
+	file, err := os.Open(fileName)
+	if err != nil {
+		return "", errors.Wrap(err, "error in os.Open")
+	}
+	defer file.Close()
+
+	return NewSHA256Reader(file)
+}
@@ -13,6 +13,7 @@ limitations under the License.
 package utils_test
 
 import (
+	"strings"
 	"testing"
 
 	"github.com/maksim-paskal/file-sync/pkg/utils"
@@ -26,3 +27,16 @@ func TestNewSHA256(t *testing.T) {
 		t.Error("SHA256 is not correct")
 	}
 }
+
+func TestNewSHA256Reader(t *testing.T) {
+	t.Parallel()
+
+	got, err := utils.NewSHA256Reader(strings.NewReader("dsdd"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got != utils.NewSHA256([]byte("dsdd")) {
+		t.Error("SHA256 is not correct")
+	}
+}
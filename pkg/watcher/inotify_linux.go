@@ -0,0 +1,310 @@
+/*
+Copyright paskal.maksim@gmail.com
+Licensed under the Apache License, Version 2.0 (the "License")
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package watcher
+
+import (
+	"context"
+	"io/fs"
+	"path/filepath"
+	"strings"
+	"time"
+	"unsafe"
+
+	"github.com/maksim-paskal/file-sync/pkg/config"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	inotifyMask = unix.IN_CREATE | unix.IN_CLOSE_WRITE | unix.IN_MODIFY | unix.IN_ATTRIB |
+		unix.IN_DELETE | unix.IN_MOVED_FROM | unix.IN_MOVED_TO
+	inotifyBufferSize = 64 * 1024
+	minPollTimeout    = 10 * time.Millisecond
+)
+
+type moveEvent struct {
+	fileName string
+	isDir    bool
+	time     time.Time
+}
+
+type inotify struct {
+	fd      int
+	root    string
+	watches map[int]string
+	moves   map[uint32]moveEvent
+	changes *changes
+}
+
+// Start watching SourceDir recursively, changes are sent to OnNewMessage.
+func Start(ctx context.Context) error {
+	fd, err := unix.InotifyInit1(unix.IN_CLOEXEC | unix.IN_NONBLOCK)
+	if err != nil {
+		return errors.Wrap(err, "error in unix.InotifyInit1")
+	}
+
+	w := &inotify{
+		fd:      fd,
+		root:    *config.Get().SourceDir,
+		watches: make(map[int]string),
+		moves:   make(map[uint32]moveEvent),
+		changes: newChanges(),
+	}
+
+	if err := w.addWatches(".", *config.Get().WatchInitialScan); err != nil {
+		unix.Close(fd)
+
+		return err
+	}
+
+	log.Infof("Start watching %s", w.root)
+
+	go w.run(ctx)
+
+	return nil
+}
+
+func (w *inotify) run(ctx context.Context) {
+	defer unix.Close(w.fd)
+
+	debounce := *config.Get().WatchDebounce
+
+	pollTimeout := debounce / 2 //nolint:gomnd
+	if pollTimeout < minPollTimeout {
+		pollTimeout = minPollTimeout
+	}
+
+	buffer := make([]byte, inotifyBufferSize)
+
+	for {
+		if ctx.Err() != nil {
+			for _, item := range w.changes.flush(time.Now(), debounce, true) {
+				sendChange(item)
+			}
+
+			return
+		}
+
+		if err := w.read(buffer, pollTimeout); err != nil {
+			log.WithError(err).Error("error in watcher.read")
+		}
+
+		now := time.Now()
+
+		// file was moved outside of SourceDir
+		for cookie, move := range w.moves {
+			if now.Sub(move.time) >= debounce {
+				delete(w.moves, cookie)
+				w.removeWatches(move.fileName)
+				w.deleted(move.fileName, move.isDir, now)
+			}
+		}
+
+		for _, item := range w.changes.flush(now, debounce, false) {
+			sendChange(item)
+		}
+	}
+}
+
+func (w *inotify) read(buffer []byte, timeout time.Duration) error {
+	fds := []unix.PollFd{{Fd: int32(w.fd), Events: unix.POLLIN}}
+
+	n, err := unix.Poll(fds, int(timeout.Milliseconds()))
+	if err != nil {
+		if errors.Is(err, unix.EINTR) {
+			return nil
+		}
+
+		return errors.Wrap(err, "error in unix.Poll")
+	}
+
+	if n == 0 {
+		return nil
+	}
+
+	n, err = unix.Read(w.fd, buffer)
+	if err != nil {
+		if errors.Is(err, unix.EAGAIN) || errors.Is(err, unix.EINTR) {
+			return nil
+		}
+
+		return errors.Wrap(err, "error in unix.Read")
+	}
+
+	for offset := 0; offset+unix.SizeofInotifyEvent <= n; {
+		event := (*unix.InotifyEvent)(unsafe.Pointer(&buffer[offset])) //nolint:gosec
+		nameStart := offset + unix.SizeofInotifyEvent
+		nameEnd := nameStart + int(event.Len)
+		name := strings.TrimRight(string(buffer[nameStart:nameEnd]), "\x00")
+
+		w.handleEvent(event, name)
+
+		offset = nameEnd
+	}
+
+	return nil
+}
+
+func (w *inotify) handleEvent(event *unix.InotifyEvent, name string) { //nolint:cyclop
+	now := time.Now()
+
+	if event.Mask&unix.IN_Q_OVERFLOW != 0 {
+		log.Warn("inotify queue overflow, rescan all files")
+
+		if err := w.addWatches(".", true); err != nil {
+			log.WithError(err).Error("error in watcher.addWatches")
+		}
+
+		return
+	}
+
+	dir, ok := w.watches[int(event.Wd)]
+	if !ok {
+		return
+	}
+
+	if event.Mask&unix.IN_IGNORED != 0 {
+		delete(w.watches, int(event.Wd))
+
+		return
+	}
+
+	fileName := filepath.Join(dir, name)
+	isDir := event.Mask&unix.IN_ISDIR != 0
+
+	switch {
+	case event.Mask&unix.IN_MOVED_FROM != 0:
+		if !isIgnored(fileName, isDir) {
+			w.moves[event.Cookie] = moveEvent{fileName: fileName, isDir: isDir, time: now}
+		}
+	case event.Mask&unix.IN_MOVED_TO != 0:
+		w.movedTo(event.Cookie, fileName, isDir, now)
+	case isIgnored(fileName, isDir):
+		return
+	case event.Mask&unix.IN_CREATE != 0:
+		if isDir {
+			// files can be created before watch was added
+			if err := w.addWatches(fileName, true); err != nil {
+				log.WithError(err).Error("error in watcher.addWatches")
+			}
+		} else {
+			w.changes.created(fileName, now)
+		}
+	case event.Mask&unix.IN_DELETE != 0:
+		w.deleted(fileName, isDir, now)
+	case isDir:
+		return
+	default:
+		w.changes.modified(fileName, now)
+	}
+}
+
+func (w *inotify) movedTo(cookie uint32, fileName string, isDir bool, now time.Time) {
+	move, ok := w.moves[cookie]
+	delete(w.moves, cookie)
+
+	isNewIgnored := isIgnored(fileName, isDir)
+
+	switch {
+	case ok && isNewIgnored:
+		w.removeWatches(move.fileName)
+		w.deleted(move.fileName, move.isDir, now)
+	case isNewIgnored:
+		return
+	case ok:
+		w.renameWatches(move.fileName, fileName)
+		w.changes.moved(move.fileName, fileName, isDir, now)
+	case isDir:
+		if err := w.addWatches(fileName, true); err != nil {
+			log.WithError(err).Error("error in watcher.addWatches")
+		}
+	default:
+		w.changes.created(fileName, now)
+	}
+}
+
+// deleted adds delete of file, directory is deleted with all files on destination.
+func (w *inotify) deleted(fileName string, isDir bool, now time.Time) {
+	if isDir {
+		w.changes.deletedDir(fileName, now)
+
+		return
+	}
+
+	w.changes.deleted(fileName, now)
+}
+
+// addWatches adds watches to all directories in dir, with scan all files will be reported as created.
+func (w *inotify) addWatches(dir string, scan bool) error {
+	now := time.Now()
+
+	return filepath.WalkDir(filepath.Join(w.root, dir), func(filePath string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		fileName, err := filepath.Rel(w.root, filePath)
+		if err != nil {
+			return errors.Wrap(err, "error in filepath.Rel")
+		}
+
+		if fileName != "." && isIgnored(fileName, d.IsDir()) {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+
+			return nil
+		}
+
+		if !d.IsDir() {
+			if scan && d.Type().IsRegular() {
+				w.changes.created(fileName, now)
+			}
+
+			return nil
+		}
+
+		wd, err := unix.InotifyAddWatch(w.fd, filePath, inotifyMask)
+		if err != nil {
+			return errors.Wrapf(err, "error in unix.InotifyAddWatch %s", filePath)
+		}
+
+		w.watches[wd] = fileName
+
+		return nil
+	})
+}
+
+func isSubDir(dir, fileName string) bool {
+	return fileName == dir || strings.HasPrefix(fileName, dir+string(filepath.Separator))
+}
+
+func (w *inotify) removeWatches(dir string) {
+	for wd, fileName := range w.watches {
+		if isSubDir(dir, fileName) {
+			delete(w.watches, wd)
+
+			_, _ = unix.InotifyRmWatch(w.fd, uint32(wd))
+		}
+	}
+}
+
+// renameWatches updates paths of moved directories, watches follow inodes.
+func (w *inotify) renameWatches(oldDir, newDir string) {
+	for wd, fileName := range w.watches {
+		if isSubDir(oldDir, fileName) {
+			w.watches[wd] = newDir + strings.TrimPrefix(fileName, oldDir)
+		}
+	}
+}
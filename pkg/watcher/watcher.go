@@ -0,0 +1,293 @@
+/*
+Copyright paskal.maksim@gmail.com
+Licensed under the Apache License, Version 2.0 (the "License")
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package watcher
+
+import (
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/maksim-paskal/file-sync/pkg/api"
+	"github.com/maksim-paskal/file-sync/pkg/config"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// changes that are not quiet for this period will be sent anyway.
+const maxDelayMultiplier = 10
+
+// OnNewMessage called for every change in SourceDir.
+var OnNewMessage func(api.Message)
+
+type change struct {
+	messageType string
+	fileName    string
+	newFileName string
+	first       time.Time
+	last        time.Time
+	dropped     bool
+}
+
+// changes coalesce bursts of file events, list keeps order of changes,
+// index holds last put, patch or delete of file that can be merged with new events.
+type changes struct {
+	list  []*change
+	index map[string]*change
+}
+
+func newChanges() *changes {
+	return &changes{
+		list:  make([]*change, 0),
+		index: make(map[string]*change),
+	}
+}
+
+func (c *changes) add(messageType, fileName, newFileName string, now time.Time) *change {
+	item := &change{
+		messageType: messageType,
+		fileName:    fileName,
+		newFileName: newFileName,
+		first:       now,
+		last:        now,
+	}
+
+	c.list = append(c.list, item)
+
+	if messageType != api.MessageTypeMove && messageType != api.MessageTypeDeleteDir {
+		c.index[fileName] = item
+	}
+
+	return item
+}
+
+func (c *changes) drop(fileName string) *change {
+	item, ok := c.index[fileName]
+	if !ok {
+		return nil
+	}
+
+	item.dropped = true
+	delete(c.index, fileName)
+
+	return item
+}
+
+func (c *changes) created(fileName string, now time.Time) {
+	if item, ok := c.index[fileName]; ok {
+		if item.messageType == api.MessageTypeDelete {
+			item.messageType = api.MessageTypePatch
+		}
+
+		item.last = now
+
+		return
+	}
+
+	c.add(api.MessageTypePut, fileName, "", now)
+}
+
+func (c *changes) modified(fileName string, now time.Time) {
+	if item, ok := c.index[fileName]; ok {
+		if item.messageType == api.MessageTypeDelete {
+			item.messageType = api.MessageTypePatch
+		}
+
+		item.last = now
+
+		return
+	}
+
+	c.add(api.MessageTypePatch, fileName, "", now)
+}
+
+func (c *changes) deleted(fileName string, now time.Time) {
+	if item, ok := c.index[fileName]; ok {
+		// file was created and deleted in one burst
+		if item.messageType == api.MessageTypePut {
+			c.drop(fileName)
+
+			return
+		}
+
+		item.messageType = api.MessageTypeDelete
+		item.last = now
+
+		return
+	}
+
+	c.add(api.MessageTypeDelete, fileName, "", now)
+}
+
+// deletedDir replaces not sent changes of files in directory with recursive delete.
+func (c *changes) deletedDir(dirName string, now time.Time) {
+	for fileName := range c.index {
+		if fileName == dirName || strings.HasPrefix(fileName, dirName+string(filepath.Separator)) {
+			c.drop(fileName)
+		}
+	}
+
+	c.add(api.MessageTypeDeleteDir, dirName, "", now)
+}
+
+func (c *changes) moved(oldFileName, newFileName string, isDir bool, now time.Time) {
+	// target will be overwritten by rename
+	c.drop(newFileName)
+
+	// file was created and renamed in one burst
+	if item, ok := c.index[oldFileName]; ok && item.messageType == api.MessageTypePut {
+		c.drop(oldFileName)
+		c.add(api.MessageTypePut, newFileName, "", now)
+
+		return
+	}
+
+	// content of not sent writes will be read from new location after move
+	rewrites := make([]string, 0)
+
+	for fileName, item := range c.index {
+		isMoved := fileName == oldFileName || (isDir && strings.HasPrefix(fileName, oldFileName+string(filepath.Separator)))
+
+		if isMoved && item.messageType != api.MessageTypeDelete {
+			c.drop(fileName)
+			rewrites = append(rewrites, newFileName+strings.TrimPrefix(fileName, oldFileName))
+		}
+	}
+
+	c.add(api.MessageTypeMove, oldFileName, newFileName, now)
+
+	// next events of old file name are related to new file
+	delete(c.index, oldFileName)
+
+	for _, fileName := range rewrites {
+		c.add(api.MessageTypePatch, fileName, "", now)
+	}
+}
+
+// flush returns changes that are quiet for debounce period, order of changes is preserved.
+func (c *changes) flush(now time.Time, debounce time.Duration, force bool) []*change {
+	result := make([]*change, 0)
+
+	for len(c.list) > 0 {
+		item := c.list[0]
+
+		if !item.dropped {
+			isQuiet := now.Sub(item.last) >= debounce
+			isTooLong := now.Sub(item.first) >= debounce*maxDelayMultiplier
+
+			if !force && !isQuiet && !isTooLong {
+				break
+			}
+
+			result = append(result, item)
+
+			if c.index[item.fileName] == item {
+				delete(c.index, item.fileName)
+			}
+		}
+
+		c.list = c.list[1:]
+	}
+
+	return result
+}
+
+func getPatterns(value string) []string {
+	result := make([]string, 0)
+
+	for _, pattern := range strings.Split(value, ",") {
+		if pattern = strings.TrimSpace(pattern); len(pattern) > 0 {
+			result = append(result, pattern)
+		}
+	}
+
+	return result
+}
+
+// matchPattern matches pattern with relative file name or with base name.
+func matchPattern(pattern, fileName string) bool {
+	if matched, _ := filepath.Match(pattern, fileName); matched {
+		return true
+	}
+
+	matched, _ := filepath.Match(pattern, filepath.Base(fileName))
+
+	return matched
+}
+
+// isIgnored returns true if file or any of its parent directories match watch.exclude,
+// files also must match watch.include if it's not empty.
+func isIgnored(fileName string, isDir bool) bool {
+	if api.IsTempFile(fileName) {
+		return true
+	}
+
+	for _, pattern := range getPatterns(*config.Get().WatchExclude) {
+		for parent := fileName; parent != "." && parent != string(filepath.Separator); parent = filepath.Dir(parent) {
+			if matchPattern(pattern, parent) {
+				return true
+			}
+		}
+	}
+
+	if isDir {
+		return false
+	}
+
+	include := getPatterns(*config.Get().WatchInclude)
+	if len(include) == 0 {
+		return false
+	}
+
+	for _, pattern := range include {
+		if matchPattern(pattern, fileName) {
+			return false
+		}
+	}
+
+	return true
+}
+
+func sendChange(item *change) {
+	message := api.Message{
+		Type:        item.messageType,
+		FileName:    item.fileName,
+		NewFileName: item.newFileName,
+	}
+
+	if item.messageType == api.MessageTypePut || item.messageType == api.MessageTypePatch {
+		var err error
+
+		message, err = api.NewMessage(item.messageType, item.fileName, "")
+		if errors.Is(err, api.ErrFileNotFound) {
+			// file already deleted, delete event will come next
+			log.WithError(err).Debug()
+
+			return
+		}
+
+		if err != nil {
+			log.WithError(err).WithField("message", message.String()).Error("error in api.NewMessage")
+
+			return
+		}
+
+		// destination state is unknown, so put and patch always overwrite files
+		message.Force = true
+	}
+
+	log.WithField("message", message.String()).Debug("watcher")
+
+	if OnNewMessage != nil {
+		OnNewMessage(message)
+	}
+}
@@ -0,0 +1,138 @@
+//go:build linux
+// +build linux
+
+/*
+Copyright paskal.maksim@gmail.com
+Licensed under the Apache License, Version 2.0 (the "License")
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package watcher_test
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/maksim-paskal/file-sync/pkg/api"
+	"github.com/maksim-paskal/file-sync/pkg/config"
+	"github.com/maksim-paskal/file-sync/pkg/watcher"
+)
+
+func expectMessage(t *testing.T, messages chan api.Message, messageType, fileName, newFileName string) {
+	t.Helper()
+
+	select {
+	case message := <-messages:
+		if message.Type != messageType || message.FileName != fileName || message.NewFileName != newFileName {
+			t.Fatalf("message %s not OK, want type=%s,filename=%s", message.String(), messageType, fileName)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("no message type=%s,filename=%s", messageType, fileName)
+	}
+}
+
+func writeFile(t *testing.T, fileName, content string) {
+	t.Helper()
+
+	err := ioutil.WriteFile(filepath.Join(*config.Get().SourceDir, fileName), []byte(content), 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestWatcher(t *testing.T) {
+	t.Parallel()
+
+	if err := config.Load(); err != nil {
+		t.Fatal(err)
+	}
+
+	sourceDir := *config.Get().SourceDir
+
+	if err := os.RemoveAll(sourceDir); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.MkdirAll(sourceDir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	writeFile(t, "initial.txt", "initial")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	messages := make(chan api.Message, 100)
+
+	watcher.OnNewMessage = func(message api.Message) {
+		messages <- message
+	}
+
+	if err := watcher.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	expectMessage(t, messages, api.MessageTypePut, "initial.txt", "")
+
+	// burst of writes must be coalesced
+	for i := 0; i < 10; i++ {
+		writeFile(t, "test.txt", strconv.Itoa(i))
+	}
+
+	writeFile(t, "test.swp", "ignored")
+
+	expectMessage(t, messages, api.MessageTypePut, "test.txt", "")
+
+	writeFile(t, "test.txt", "new")
+	expectMessage(t, messages, api.MessageTypePatch, "test.txt", "")
+
+	if err := os.Rename(filepath.Join(sourceDir, "test.txt"), filepath.Join(sourceDir, "test2.txt")); err != nil {
+		t.Fatal(err)
+	}
+
+	expectMessage(t, messages, api.MessageTypeMove, "test.txt", "test2.txt")
+
+	if err := os.MkdirAll(filepath.Join(sourceDir, "dir"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	writeFile(t, "dir/test3.txt", "test")
+	expectMessage(t, messages, api.MessageTypePut, "dir/test3.txt", "")
+
+	if err := os.Remove(filepath.Join(sourceDir, "test2.txt")); err != nil {
+		t.Fatal(err)
+	}
+
+	expectMessage(t, messages, api.MessageTypeDelete, "test2.txt", "")
+
+	// file created and deleted in one burst must be ignored
+	writeFile(t, "temp.txt", "temp")
+
+	if err := os.Remove(filepath.Join(sourceDir, "temp.txt")); err != nil {
+		t.Fatal(err)
+	}
+
+	writeFile(t, "last.txt", "last")
+	expectMessage(t, messages, api.MessageTypePut, "last.txt", "")
+
+	// directory moved outside of SourceDir is deleted with all files
+	movedDir := filepath.Join(filepath.Dir(sourceDir), "watcher-moved")
+	defer os.RemoveAll(movedDir)
+
+	if err := os.Rename(filepath.Join(sourceDir, "dir"), movedDir); err != nil {
+		t.Fatal(err)
+	}
+
+	expectMessage(t, messages, api.MessageTypeDeleteDir, "dir", "")
+}
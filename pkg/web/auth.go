@@ -0,0 +1,74 @@
+/*
+Copyright paskal.maksim@gmail.com
+Licensed under the Apache License, Version 2.0 (the "License")
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package web
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strings"
+
+	"github.com/maksim-paskal/file-sync/pkg/config"
+	logrushooksentry "github.com/maksim-paskal/logrus-hook-sentry"
+	log "github.com/sirupsen/logrus"
+)
+
+const bearerPrefix = "Bearer "
+
+// isAuthorized checks token of request, without http.token requests are authorized only with http.insecure.
+func isAuthorized(r *http.Request) bool {
+	token := *config.Get().HTTPToken
+	if len(token) == 0 {
+		return *config.Get().HTTPInsecure
+	}
+
+	value := r.Header.Get("Authorization")
+	if !strings.HasPrefix(value, bearerPrefix) {
+		return false
+	}
+
+	return subtle.ConstantTimeCompare([]byte(strings.TrimPrefix(value, bearerPrefix)), []byte(token)) == 1
+}
+
+// withAuthorization wraps handler of operation that changes or removes queued messages.
+func withAuthorization(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !isAuthorized(r) {
+			log.
+				WithFields(logrushooksentry.AddRequest(r)).
+				Warn("unauthorized queue management request")
+
+			if len(*config.Get().HTTPToken) == 0 {
+				http.Error(w, "queue management is disabled, http.token is not set", http.StatusForbidden)
+			} else {
+				http.Error(w, "unauthorized", http.StatusUnauthorized)
+			}
+
+			return
+		}
+
+		handler(w, r)
+	}
+}
+
+// logAuthorization warns on start that queue management requests are disabled or not authorized.
+func logAuthorization() {
+	if len(*config.Get().HTTPToken) > 0 {
+		return
+	}
+
+	if *config.Get().HTTPInsecure {
+		log.Warn("http.token is not set, queue management requests are not authorized")
+	} else {
+		log.Warn("http.token is not set, queue management requests are disabled")
+	}
+}
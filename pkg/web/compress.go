@@ -0,0 +1,63 @@
+/*
+Copyright paskal.maksim@gmail.com
+Licensed under the Apache License, Version 2.0 (the "License")
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package web
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/maksim-paskal/file-sync/pkg/api"
+	logrushooksentry "github.com/maksim-paskal/logrus-hook-sentry"
+	log "github.com/sirupsen/logrus"
+)
+
+// handlerEncodings returns compressions of request body that destination supports.
+func handlerEncodings(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, r, api.GetEncodings())
+}
+
+// withDecompression decompresses request body with Content-Encoding.
+func withDecompression(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		encoding := r.Header.Get(api.HeaderContentEncoding)
+		if len(encoding) == 0 {
+			handler(w, r)
+
+			return
+		}
+
+		body, err := api.NewDecoder(encoding, r.Body)
+		if err != nil {
+			log.
+				WithError(err).
+				WithFields(logrushooksentry.AddRequest(r)).
+				Error("error in api.NewDecoder")
+
+			statusCode := http.StatusBadRequest
+			if errors.Is(err, api.ErrUnsupportedEncoding) {
+				statusCode = http.StatusUnsupportedMediaType
+			}
+
+			http.Error(w, err.Error(), statusCode)
+
+			return
+		}
+		defer body.Close()
+
+		r.Body = body
+		r.Header.Del(api.HeaderContentEncoding)
+		r.ContentLength = -1
+
+		handler(w, r)
+	}
+}
@@ -0,0 +1,150 @@
+/*
+Copyright paskal.maksim@gmail.com
+Licensed under the Apache License, Version 2.0 (the "License")
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package web
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/maksim-paskal/file-sync/pkg/queue"
+	logrushooksentry "github.com/maksim-paskal/logrus-hook-sentry"
+	log "github.com/sirupsen/logrus"
+)
+
+type bulkResult struct {
+	Count int    `json:"count"`
+	Error string `json:"error,omitempty"`
+}
+
+func getFilter(r *http.Request) queue.Filter {
+	return queue.Filter{
+		ID:          r.URL.Query().Get("id"),
+		Type:        r.URL.Query().Get("type"),
+		Destination: r.URL.Query().Get("destination"),
+		File:        r.URL.Query().Get("file"),
+	}
+}
+
+func getQueryInt(r *http.Request, name string) (int, error) {
+	value := r.URL.Query().Get(name)
+	if len(value) == 0 {
+		return 0, nil
+	}
+
+	return strconv.Atoi(value)
+}
+
+// items are returned without file content.
+func withoutContent(item *queue.Item) *queue.Item {
+	result := *item
+	result.Message.FileContent = ""
+	result.Message.FileContentBase64 = ""
+
+	return &result
+}
+
+func handlerDeadLetterList(w http.ResponseWriter, r *http.Request) {
+	offset, err := getQueryInt(r, "offset")
+	if err != nil {
+		http.Error(w, "invalid offset", http.StatusBadRequest)
+
+		return
+	}
+
+	limit, err := getQueryInt(r, "limit")
+	if err != nil {
+		http.Error(w, "invalid limit", http.StatusBadRequest)
+
+		return
+	}
+
+	items, err := queue.ListDeadLetters(getFilter(r), offset, limit)
+	if err != nil {
+		log.
+			WithError(err).
+			WithFields(logrushooksentry.AddRequest(r)).
+			Error("error in queue.ListDeadLetters")
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+
+		return
+	}
+
+	for i, item := range items {
+		items[i] = withoutContent(item)
+	}
+
+	writeJSON(w, r, items)
+}
+
+func handlerDeadLetterShow(w http.ResponseWriter, r *http.Request) {
+	item, err := queue.GetDeadLetter(r.URL.Query().Get("id"))
+	if errors.Is(err, queue.ErrNotFound) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+
+		return
+	}
+
+	if err != nil {
+		log.
+			WithError(err).
+			WithFields(logrushooksentry.AddRequest(r)).
+			Error("error in queue.GetDeadLetter")
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+
+		return
+	}
+
+	writeJSON(w, r, withoutContent(item))
+}
+
+func handlerDeadLetterRequeue(w http.ResponseWriter, r *http.Request) {
+	handleBulk(w, r, queue.RequeueDeadLetters)
+}
+
+func handlerDeadLetterPurge(w http.ResponseWriter, r *http.Request) {
+	handleBulk(w, r, queue.PurgeDeadLetters)
+}
+
+// handleBulk runs bulk operation, filter or all=true is required.
+func handleBulk(w http.ResponseWriter, r *http.Request, operation func(queue.Filter) (int, error)) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+
+		return
+	}
+
+	filter := getFilter(r)
+
+	if filter.IsEmpty() && r.URL.Query().Get("all") != "true" {
+		http.Error(w, "filter or all=true is required", http.StatusBadRequest)
+
+		return
+	}
+
+	count, err := operation(filter)
+	result := bulkResult{Count: count}
+
+	if err != nil {
+		log.
+			WithError(err).
+			WithFields(logrushooksentry.AddRequest(r)).
+			Error("error in bulk operation")
+
+		result.Error = err.Error()
+
+		w.WriteHeader(http.StatusInternalServerError)
+	}
+
+	writeJSON(w, r, result)
+}
@@ -0,0 +1,95 @@
+/*
+Copyright paskal.maksim@gmail.com
+Licensed under the Apache License, Version 2.0 (the "License")
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package web
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/maksim-paskal/file-sync/pkg/queue"
+	logrushooksentry "github.com/maksim-paskal/logrus-hook-sentry"
+	log "github.com/sirupsen/logrus"
+)
+
+const jobsPath = "/api/jobs/"
+
+// handlerJobs returns jobs that match filter, id can be comma separated list of ids.
+func handlerJobs(w http.ResponseWriter, r *http.Request) {
+	offset, err := getQueryInt(r, "offset")
+	if err != nil {
+		http.Error(w, "invalid offset", http.StatusBadRequest)
+
+		return
+	}
+
+	limit, err := getQueryInt(r, "limit")
+	if err != nil {
+		http.Error(w, "invalid limit", http.StatusBadRequest)
+
+		return
+	}
+
+	filter := queue.JobFilter{
+		State:       r.URL.Query().Get("state"),
+		Type:        r.URL.Query().Get("type"),
+		Destination: r.URL.Query().Get("destination"),
+		File:        r.URL.Query().Get("file"),
+	}
+
+	if ids := r.URL.Query().Get("id"); len(ids) > 0 {
+		filter.IDs = strings.Split(ids, ",")
+	}
+
+	jobs, err := queue.ListJobs(filter, offset, limit)
+	if err != nil {
+		log.
+			WithError(err).
+			WithFields(logrushooksentry.AddRequest(r)).
+			Error("error in queue.ListJobs")
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+
+		return
+	}
+
+	writeJSON(w, r, jobs)
+}
+
+// handlerJob returns job by id from /api/jobs/{id}.
+func handlerJob(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimPrefix(r.URL.Path, jobsPath)
+	if len(id) == 0 {
+		handlerJobs(w, r)
+
+		return
+	}
+
+	job, err := queue.GetJob(id)
+	if errors.Is(err, queue.ErrNotFound) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+
+		return
+	}
+
+	if err != nil {
+		log.
+			WithError(err).
+			WithFields(logrushooksentry.AddRequest(r)).
+			Error("error in queue.GetJob")
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+
+		return
+	}
+
+	writeJSON(w, r, job)
+}
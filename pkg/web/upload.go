@@ -0,0 +1,125 @@
+/*
+Copyright paskal.maksim@gmail.com
+Licensed under the Apache License, Version 2.0 (the "License")
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package web
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+
+	"github.com/maksim-paskal/file-sync/pkg/api"
+	"github.com/maksim-paskal/file-sync/pkg/upload"
+	logrushooksentry "github.com/maksim-paskal/logrus-hook-sentry"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+func getUploadStatusCode(err error) int {
+	switch {
+	case errors.Is(err, upload.ErrNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, upload.ErrInvalid):
+		return http.StatusBadRequest
+	case errors.Is(err, upload.ErrChecksum):
+		return api.StatusSHA256Failed
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// handlerUpload begins upload with POST and returns chunks of upload that are in store with GET /api/upload?id=.
+func handlerUpload(w http.ResponseWriter, r *http.Request) {
+	var (
+		session *upload.Session
+		err     error
+	)
+
+	switch r.Method {
+	case http.MethodPost:
+		value := upload.Session{}
+
+		if err := json.NewDecoder(r.Body).Decode(&value); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+
+			return
+		}
+
+		session, err = upload.Begin(value)
+	case http.MethodGet:
+		session, err = upload.Get(r.URL.Query().Get("id"))
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+
+		return
+	}
+
+	if err != nil {
+		log.
+			WithError(err).
+			WithFields(logrushooksentry.AddRequest(r)).
+			Error("error in upload")
+		http.Error(w, err.Error(), getUploadStatusCode(err))
+
+		return
+	}
+
+	writeJSON(w, r, session)
+}
+
+// handlerUploadChunk stores chunk from PUT /api/upload/chunk?id=&index=.
+func handlerUploadChunk(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPut {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+
+		return
+	}
+
+	index, err := strconv.Atoi(r.URL.Query().Get("index"))
+	if err != nil {
+		http.Error(w, "invalid index", http.StatusBadRequest)
+
+		return
+	}
+
+	err = upload.WriteChunk(r.URL.Query().Get("id"), index, r.Header.Get(api.HeaderChunkSHA256), r.Body)
+	if err != nil {
+		log.
+			WithError(err).
+			WithFields(logrushooksentry.AddRequest(r)).
+			Error("error in upload.WriteChunk")
+		http.Error(w, err.Error(), getUploadStatusCode(err))
+
+		return
+	}
+
+	handlerHealthz(w, r)
+}
+
+// processUpload applies message with content of upload, upload is removed when it is applied
+// or its content is corrupted, other failed uploads are resumed on retry.
+func processUpload(message api.Message) (string, error) {
+	body, err := upload.Open(message.Upload)
+	if err != nil {
+		return "", errors.Wrap(api.ErrUploadNotFound, err.Error())
+	}
+	defer body.Close()
+
+	sha256, err := api.ProcessMessageStream(message, body)
+	if err == nil || errors.Is(err, api.ErrSHA256Failed) {
+		if err := upload.Remove(message.Upload); err != nil {
+			log.WithError(err).Error("error in upload.Remove")
+		}
+	}
+
+	return sha256, err
+}
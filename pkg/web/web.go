@@ -16,16 +16,21 @@ import (
 	"crypto/tls"
 	"crypto/x509"
 	"encoding/json"
-	"io/ioutil"
+	"errors"
+	"fmt"
+	"io"
 	"net/http"
 	pprof "net/http/pprof"
 	"strings"
 
 	"github.com/maksim-paskal/file-sync/pkg/api"
+	"github.com/maksim-paskal/file-sync/pkg/applied"
 	"github.com/maksim-paskal/file-sync/pkg/certs"
 	"github.com/maksim-paskal/file-sync/pkg/config"
+	"github.com/maksim-paskal/file-sync/pkg/merkle"
 	"github.com/maksim-paskal/file-sync/pkg/metrics"
 	"github.com/maksim-paskal/file-sync/pkg/queue"
+	"github.com/maksim-paskal/file-sync/pkg/resync"
 	logrushooksentry "github.com/maksim-paskal/logrus-hook-sentry"
 	log "github.com/sirupsen/logrus"
 )
@@ -83,6 +88,7 @@ func StartServer() {
 		}
 
 		log.Infof("Start server on %s", server.Addr)
+		logAuthorization()
 
 		err := server.ListenAndServe()
 		if err != nil {
@@ -108,32 +114,50 @@ func StartServer() {
 }
 
 func handlerSync(w http.ResponseWriter, r *http.Request) {
-	message := api.Message{}
-
 	defer r.Body.Close()
 
-	body, err := ioutil.ReadAll(r.Body)
+	// file content can be sent as raw stream, message will be in headers
+	if r.Header.Get("Content-Type") == api.ContentTypeStream {
+		handlerSyncStream(w, r)
+
+		return
+	}
+
+	message := api.Message{}
+
+	err := json.NewDecoder(r.Body).Decode(&message)
 	if err != nil {
 		log.
 			WithError(err).
 			WithFields(logrushooksentry.AddRequest(r)).
 			WithField("message", message.String()).
-			Error("error in ioutil.ReadAll")
+			Error("error in json.Decode")
+
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+
+		return
 	}
 
-	err = json.Unmarshal(body, &message)
+	processSyncMessage(w, r, message, nil)
+}
+
+func handlerSyncStream(w http.ResponseWriter, r *http.Request) {
+	message, err := api.GetMessageFromHeader(r.Header)
 	if err != nil {
 		log.
 			WithError(err).
 			WithFields(logrushooksentry.AddRequest(r)).
-			WithField("message", message.String()).
-			Error("error in json.Unmarshal")
+			Error("error in api.GetMessageFromHeader")
 
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		http.Error(w, err.Error(), http.StatusBadRequest)
 
 		return
 	}
 
+	processSyncMessage(w, r, message, r.Body)
+}
+
+func processSyncMessage(w http.ResponseWriter, r *http.Request, message api.Message, body io.Reader) {
 	if log.GetLevel() <= log.DebugLevel {
 		log.
 			WithFields(logrushooksentry.AddRequest(r)).
@@ -141,7 +165,35 @@ func handlerSync(w http.ResponseWriter, r *http.Request) {
 			Debug()
 	}
 
-	err = api.ProcessMessage(message)
+	// retried message that was applied before gets original result
+	results := applied.Apply(message, func() api.Response {
+		return applyMessage(r, message, body)
+	})
+
+	js, err := json.Marshal(results)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+
+	_, err = w.Write(js)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+func applyMessage(r *http.Request, message api.Message, body io.Reader) api.Response {
+	var (
+		sha256 string
+		err    error
+	)
+
+	if len(message.Upload) > 0 {
+		sha256, err = processUpload(message)
+	} else {
+		sha256, err = api.ProcessMessageStream(message, body)
+	}
 
 	if err != nil {
 		log.
@@ -154,27 +206,40 @@ func handlerSync(w http.ResponseWriter, r *http.Request) {
 	results := api.Response{
 		Type:     message.Type,
 		FileName: message.FileName,
+		SHA256:   sha256,
 	}
 
 	if err != nil {
-		results.StatusCode = 500
+		results.StatusCode = getErrorStatusCode(err)
 		results.StatusText = err.Error()
 	} else {
 		results.StatusCode = 200
 		results.StatusText = "ok"
+
+		merkle.UpdateDestination(message)
 	}
 
-	js, err := json.Marshal(results)
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+	return results
+}
+
+func getErrorStatusCode(err error) int {
+	if errors.Is(err, api.ErrPathNotAllowed) {
+		return http.StatusBadRequest
 	}
 
-	w.Header().Set("Content-Type", "application/json")
+	if errors.Is(err, api.ErrSHA256Failed) {
+		return api.StatusSHA256Failed
+	}
 
-	_, err = w.Write(js)
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+	if errors.Is(err, api.ErrDeltaBaseChanged) {
+		return api.StatusDeltaBaseChanged
 	}
+
+	if errors.Is(err, api.ErrUploadNotFound) {
+		return api.StatusUploadNotFound
+	}
+
+	return http.StatusInternalServerError
 }
 
 func handlerQueue(w http.ResponseWriter, r *http.Request) { //nolint:cyclop
@@ -226,7 +291,7 @@ func handlerQueue(w http.ResponseWriter, r *http.Request) { //nolint:cyclop
 			WithFields(logrushooksentry.AddRequest(r)).
 			WithField("message", message.String()).
 			Error("error in web.api.getMessageFromValue")
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		http.Error(w, err.Error(), getErrorStatusCode(err))
 		metrics.QueueErrorCounter.WithLabelValues(message.Type).Inc()
 
 		return
@@ -239,53 +304,23 @@ func handlerQueue(w http.ResponseWriter, r *http.Request) { //nolint:cyclop
 			Debug()
 	}
 
-	isError := false
-	resultText := make([]string, 0)
+	merkle.UpdateSource(message)
 
 	// send messages to sync addresses
-	for _, address := range syncAddress {
-		message.Destination = address
-
-		if *config.Get().RedisEnabled { //nolint: nestif
-			id, err := queue.Add(message)
-			if err != nil {
-				log.
-					WithError(err).
-					WithFields(logrushooksentry.AddRequest(r)).
-					WithField("message", message.String()).
-					Error("error in web.queue.add")
-
-				metrics.QueueErrorCounter.WithLabelValues(message.Type).Inc()
-
-				isError = true
-
-				resultText = append(resultText, err.Error())
-			} else {
-				resultText = append(resultText, id)
-			}
-		} else {
-			err := api.SendWithRetry(message)
-			if err != nil {
-				log.
-					WithError(err).
-					WithFields(logrushooksentry.AddRequest(r)).
-					WithField("message", message.String()).
-					Error("error in web.api.send")
-				metrics.QueueErrorCounter.WithLabelValues(message.Type).Inc()
-
-				isError = true
-				resultText = append(resultText, err.Error())
-			} else {
-				resultText = append(resultText, "ok")
-			}
-		}
+	resultText, sendErr := queue.Send(message, syncAddress)
+	if sendErr != nil {
+		log.
+			WithError(sendErr).
+			WithFields(logrushooksentry.AddRequest(r)).
+			WithField("message", message.String()).
+			Error("error in web.queue.Send")
 	}
 
 	metrics.QueueRequestCounter.WithLabelValues(message.Type).Inc()
 
 	httpMessage := strings.Join(resultText, ",")
 
-	if isError {
+	if sendErr != nil {
 		http.Error(w, httpMessage, http.StatusInternalServerError)
 	} else {
 		_, err = w.Write([]byte(httpMessage))
@@ -310,53 +345,198 @@ func handlerHealthz(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-func handlerQueueInfo(w http.ResponseWriter, r *http.Request) {
-	meta, err := queue.Info()
+// handlerQueueList returns queued messages that match filter without file content.
+func handlerQueueList(w http.ResponseWriter, r *http.Request) {
+	offset, err := getQueryInt(r, "offset")
+	if err != nil {
+		http.Error(w, "invalid offset", http.StatusBadRequest)
+
+		return
+	}
+
+	limit, err := getQueryInt(r, "limit")
+	if err != nil {
+		http.Error(w, "invalid limit", http.StatusBadRequest)
+
+		return
+	}
+
+	items, err := queue.List(getFilter(r), offset, limit)
 	if err != nil {
 		log.
 			WithError(err).
 			WithFields(logrushooksentry.AddRequest(r)).
-			Error("error in queue.Info")
+			Error("error in queue.List")
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 
 		return
 	}
 
-	if _, err := w.Write([]byte(meta)); err != nil {
+	writeJSON(w, r, items)
+}
+
+func handlerQueueStats(w http.ResponseWriter, r *http.Request) {
+	stats, err := queue.GetStats()
+	if err != nil {
 		log.
 			WithError(err).
 			WithFields(logrushooksentry.AddRequest(r)).
-			Error("error in w.Write")
+			Error("error in queue.GetStats")
 		http.Error(w, err.Error(), http.StatusInternalServerError)
+
+		return
 	}
+
+	writeJSON(w, r, stats)
 }
 
-func handlerQueueFlush(w http.ResponseWriter, r *http.Request) {
-	err := queue.Flush()
+func handlerDestinations(w http.ResponseWriter, r *http.Request) {
+	result, err := queue.GetDestinationsHealth()
 	if err != nil {
 		log.
 			WithError(err).
 			WithFields(logrushooksentry.AddRequest(r)).
-			Error("error in queue.Flush")
+			Error("error in queue.GetDestinationsHealth")
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 
 		return
 	}
 
-	if _, err := w.Write([]byte("ok")); err != nil {
+	writeJSON(w, r, result)
+}
+
+func writeJSON(w http.ResponseWriter, r *http.Request, value interface{}) {
+	js, err := json.Marshal(value)
+	if err != nil {
+		log.
+			WithError(err).
+			WithFields(logrushooksentry.AddRequest(r)).
+			Error("error in json.Marshal")
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+
+		return
+	}
+
+	w.Header().Set("Content-Type", api.ContentTypeJSON)
+
+	if _, err := w.Write(js); err != nil {
 		log.
 			WithError(err).
 			WithFields(logrushooksentry.AddRequest(r)).
 			Error("error in w.Write")
+	}
+}
+
+func handlerManifest(w http.ResponseWriter, r *http.Request) {
+	manifest, err := api.GetDestinationManifest()
+	if err != nil {
+		log.
+			WithError(err).
+			WithFields(logrushooksentry.AddRequest(r)).
+			Error("error in api.GetDestinationManifest")
 		http.Error(w, err.Error(), http.StatusInternalServerError)
+
+		return
 	}
+
+	writeJSON(w, r, manifest)
+}
+
+func handlerSignature(w http.ResponseWriter, r *http.Request) {
+	signature, err := api.GetSignature(r.URL.Query().Get("file"))
+	if err != nil {
+		statusCode := getErrorStatusCode(err)
+		if errors.Is(err, api.ErrFileNotFound) {
+			statusCode = http.StatusNotFound
+		}
+
+		log.
+			WithError(err).
+			WithFields(logrushooksentry.AddRequest(r)).
+			Error("error in api.GetSignature")
+		http.Error(w, err.Error(), statusCode)
+
+		return
+	}
+
+	writeJSON(w, r, signature)
+}
+
+func handlerMerkle(w http.ResponseWriter, r *http.Request) {
+	node, err := merkle.GetDestinationNode(r.Context(), r.URL.Query().Get("path"))
+	if err != nil {
+		log.
+			WithError(err).
+			WithFields(logrushooksentry.AddRequest(r)).
+			Error("error in merkle.GetDestinationNode")
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+
+		return
+	}
+
+	writeJSON(w, r, node)
+}
+
+func isSyncAddress(destination string) bool {
+	for _, address := range syncAddress {
+		if address == destination {
+			return true
+		}
+	}
+
+	return false
+}
+
+func handlerResync(w http.ResponseWriter, r *http.Request) {
+	destinations := syncAddress
+
+	if destination := r.URL.Query().Get("destination"); len(destination) > 0 {
+		// source tree is sent only to configured destinations
+		if !isSyncAddress(destination) {
+			http.Error(w, fmt.Sprintf("unknown destination %s", destination), http.StatusBadRequest)
+
+			return
+		}
+
+		destinations = []string{destination}
+	}
+
+	results := resync.RunAll(r.Context(), destinations)
+
+	for _, result := range results {
+		if len(result.Error) > 0 {
+			w.WriteHeader(http.StatusInternalServerError)
+
+			break
+		}
+	}
+
+	writeJSON(w, r, results)
+}
+
+// handlerQueueDelete removes queued messages that match filter, all=true removes all messages.
+func handlerQueueDelete(w http.ResponseWriter, r *http.Request) {
+	handleBulk(w, r, queue.Delete)
 }
 
 func GetHTTPRouter() *http.ServeMux {
 	mux := http.NewServeMux()
 	mux.HandleFunc("/api/queue", handlerQueue)
-	mux.HandleFunc("/api/queue/info", handlerQueueInfo)
-	mux.HandleFunc("/api/queue/flush", handlerQueueFlush)
+	mux.HandleFunc("/api/queue/list", handlerQueueList)
+	mux.HandleFunc("/api/queue/stats", handlerQueueStats)
+	// backward compatibility, stats replaced raw information of queue
+	mux.HandleFunc("/api/queue/info", handlerQueueStats)
+	mux.HandleFunc("/api/queue/delete", withAuthorization(handlerQueueDelete))
+	// backward compatibility, flush removes only messages of this application
+	mux.HandleFunc("/api/queue/flush", withAuthorization(handlerQueueDelete))
+	mux.HandleFunc("/api/destinations", handlerDestinations)
+	mux.HandleFunc("/api/jobs", handlerJobs)
+	mux.HandleFunc(jobsPath, handlerJob)
+	mux.HandleFunc("/api/dlq", handlerDeadLetterList)
+	mux.HandleFunc("/api/dlq/show", handlerDeadLetterShow)
+	mux.HandleFunc("/api/dlq/requeue", withAuthorization(handlerDeadLetterRequeue))
+	mux.HandleFunc("/api/dlq/purge", withAuthorization(handlerDeadLetterPurge))
+	mux.HandleFunc("/api/resync", withAuthorization(handlerResync))
 	mux.HandleFunc("/api/healthz", handlerHealthz)
 
 	mux.HandleFunc("/debug/pprof/", pprof.Index)
@@ -370,7 +550,13 @@ func GetHTTPRouter() *http.ServeMux {
 
 func GetHTTPSRouter() *http.ServeMux {
 	mux := http.NewServeMux()
-	mux.HandleFunc("/api/sync", handlerSync)
+	mux.HandleFunc("/api/sync", withDecompression(handlerSync))
+	mux.HandleFunc("/api/encodings", handlerEncodings)
+	mux.HandleFunc("/api/manifest", handlerManifest)
+	mux.HandleFunc("/api/merkle", handlerMerkle)
+	mux.HandleFunc("/api/signature", handlerSignature)
+	mux.HandleFunc("/api/upload", handlerUpload)
+	mux.HandleFunc("/api/upload/chunk", withDecompression(handlerUploadChunk))
 	mux.HandleFunc("/api/healthz", handlerHealthz)
 
 	return mux
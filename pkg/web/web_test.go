@@ -15,18 +15,28 @@ package web_test
 import (
 	"bytes"
 	"context"
+	"encoding/base64"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"path"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/maksim-paskal/file-sync/pkg/api"
 	"github.com/maksim-paskal/file-sync/pkg/certs"
 	"github.com/maksim-paskal/file-sync/pkg/config"
+	"github.com/maksim-paskal/file-sync/pkg/delta"
+	"github.com/maksim-paskal/file-sync/pkg/merkle"
+	"github.com/maksim-paskal/file-sync/pkg/metrics"
+	"github.com/maksim-paskal/file-sync/pkg/queue"
+	"github.com/maksim-paskal/file-sync/pkg/utils"
 	"github.com/maksim-paskal/file-sync/pkg/web"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 )
 
 var ctx = context.Background()
@@ -44,9 +54,52 @@ func init() { //nolint: gochecknoinits
 		panic(err)
 	}
 
+	if err := queue.Init(); err != nil {
+		panic(err)
+	}
+
 	web.Init()
 }
 
+// routeTest is request to router with expected status and body, body is not checked if it is empty.
+type routeTest struct {
+	method     string
+	uri        string
+	statusCode int
+	body       string
+}
+
+func checkRoutes(t *testing.T, srv *httptest.Server, tests []routeTest) {
+	t.Helper()
+
+	for _, test := range tests {
+		req, err := http.NewRequestWithContext(ctx, test.method, srv.URL+test.uri, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		body, err := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if res.StatusCode != test.statusCode {
+			t.Errorf("%s %s status %d, must be %d", test.method, test.uri, res.StatusCode, test.statusCode)
+		}
+
+		if len(test.body) > 0 && string(body) != test.body {
+			t.Errorf("%s %s body %s, must be %s", test.method, test.uri, string(body), test.body)
+		}
+	}
+}
+
 func TestRouting_Queue(t *testing.T) {
 	t.Parallel()
 
@@ -72,21 +125,234 @@ func TestRouting_Queue(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	if res.StatusCode == http.StatusOK {
-		t.Error("must be error")
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("status %d not OK", res.StatusCode)
 	}
 
-	stringBody := string(body)
-
 	hosts := web.GetSyncAddress()
 	if len(hosts) != 3 {
 		t.Error("must be 3 hosts")
 	}
 
-	for _, host := range hosts {
-		if !strings.Contains(stringBody, host) {
-			t.Error("text must contain 10.10.10.10", stringBody)
+	// message is queued for every host
+	ids := strings.Split(string(body), ",")
+	if len(ids) != len(hosts) {
+		t.Fatal("must be id for every host", string(body))
+	}
+
+	for i, id := range ids {
+		job := getJob(t, srv.URL, id)
+
+		if job.Destination != hosts[i] || job.FileName != "tests/test.txt" {
+			t.Errorf("wrong job %+v", job)
+		}
+	}
+}
+
+func getJob(t *testing.T, url, id string) *queue.Job {
+	t.Helper()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url+"/api/jobs/"+id, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("job %s status %d", id, res.StatusCode)
+	}
+
+	job := &queue.Job{}
+
+	if err := json.NewDecoder(res.Body).Decode(job); err != nil {
+		t.Fatal(err)
+	}
+
+	return job
+}
+
+func TestRouting_Jobs(t *testing.T) {
+	t.Parallel()
+
+	srv := httptest.NewServer(web.GetHTTPRouter())
+	defer srv.Close()
+
+	tests := []routeTest{
+		{http.MethodGet, "/api/jobs/not-exists", http.StatusNotFound, ""},
+		{http.MethodGet, "/api/jobs?limit=a", http.StatusBadRequest, ""},
+		{http.MethodGet, "/api/jobs?id=not-exists", http.StatusOK, "[]"},
+		{http.MethodGet, "/api/jobs/?state=unknown", http.StatusOK, "[]"},
+	}
+
+	checkRoutes(t, srv, tests)
+}
+
+func TestRouting_QueueList(t *testing.T) {
+	t.Parallel()
+
+	srv := httptest.NewServer(web.GetHTTPRouter())
+	defer srv.Close()
+
+	tests := []routeTest{
+		{http.MethodGet, "/api/queue/list?limit=a", http.StatusBadRequest, ""},
+		{http.MethodGet, "/api/queue/list?destination=not-exists", http.StatusOK, "[]"},
+		{http.MethodGet, "/api/queue/list?offset=1&limit=10", http.StatusOK, ""},
+	}
+
+	checkRoutes(t, srv, tests)
+}
+
+func TestRouting_QueueStats(t *testing.T) {
+	t.Parallel()
+
+	srv := httptest.NewServer(web.GetHTTPRouter())
+	defer srv.Close()
+
+	for _, uri := range []string{"/api/queue/stats", "/api/queue/info"} {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, srv.URL+uri, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		stats := queue.Stats{}
+
+		err = json.NewDecoder(res.Body).Decode(&stats)
+		res.Body.Close()
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if res.StatusCode != http.StatusOK {
+			t.Fatalf("%s status %d, must be %d", uri, res.StatusCode, http.StatusOK)
+		}
+
+		// destinations from sync.address are created on start
+		if len(stats.Type) == 0 || len(stats.Destinations) == 0 {
+			t.Fatalf("%s wrong stats %+v", uri, stats)
+		}
+	}
+}
+
+func TestRouting_QueueDelete(t *testing.T) {
+	t.Parallel()
+
+	srv := httptest.NewServer(web.GetHTTPRouter())
+	defer srv.Close()
+
+	tests := []routeTest{
+		{http.MethodGet, "/api/queue/delete?all=true", http.StatusMethodNotAllowed, ""},
+		{http.MethodPost, "/api/queue/delete", http.StatusBadRequest, ""},
+		{http.MethodPost, "/api/queue/flush", http.StatusBadRequest, ""},
+		{http.MethodPost, "/api/queue/delete?destination=not-exists", http.StatusOK, `{"count":0}`},
+		{http.MethodPost, "/api/queue/delete?type=put&file=not-exists/*", http.StatusOK, `{"count":0}`},
+	}
+
+	checkRoutes(t, srv, tests)
+}
+
+func TestRouting_QueueAuthorization(t *testing.T) { //nolint:paralleltest
+	token := "test-token"
+
+	defer func(value *string) { config.Get().HTTPToken = value }(config.Get().HTTPToken)
+	config.Get().HTTPToken = &token
+
+	srv := httptest.NewServer(web.GetHTTPRouter())
+	defer srv.Close()
+
+	tests := []struct {
+		uri           string
+		authorization string
+		statusCode    int
+	}{
+		{"/api/queue/delete?destination=not-exists", "", http.StatusUnauthorized},
+		{"/api/queue/delete?destination=not-exists", "Bearer wrong", http.StatusUnauthorized},
+		{"/api/dlq/purge?all=true", "test-token", http.StatusUnauthorized},
+		{"/api/queue/delete?destination=not-exists", "Bearer test-token", http.StatusOK},
+		{"/api/dlq/purge?destination=not-exists", "Bearer test-token", http.StatusOK},
+		{"/api/resync?destination=not-exists", "", http.StatusUnauthorized},
+		// source tree must not be sent to destination that is not in sync.address
+		{"/api/resync?destination=not-exists", "Bearer test-token", http.StatusBadRequest},
+	}
+
+	for _, test := range tests {
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, srv.URL+test.uri, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(test.authorization) > 0 {
+			req.Header.Set("Authorization", test.authorization)
 		}
+
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		res.Body.Close()
+
+		if res.StatusCode != test.statusCode {
+			t.Errorf("%s %q status %d, must be %d", test.uri, test.authorization, res.StatusCode, test.statusCode)
+		}
+	}
+}
+
+func TestRouting_QueueAuthorizationDisabled(t *testing.T) { //nolint:paralleltest
+	token := ""
+	insecure := false
+
+	defer func(value *string) { config.Get().HTTPToken = value }(config.Get().HTTPToken)
+	config.Get().HTTPToken = &token
+
+	defer func(value *bool) { config.Get().HTTPInsecure = value }(config.Get().HTTPInsecure)
+	config.Get().HTTPInsecure = &insecure
+
+	srv := httptest.NewServer(web.GetHTTPRouter())
+	defer srv.Close()
+
+	// without http.token nothing is deleted unless http.insecure is set
+	checkRoutes(t, srv, []routeTest{
+		{http.MethodPost, "/api/queue/delete?destination=not-exists", http.StatusForbidden, ""},
+		{http.MethodPost, "/api/queue/flush?destination=not-exists", http.StatusForbidden, ""},
+		{http.MethodPost, "/api/dlq/requeue?destination=not-exists", http.StatusForbidden, ""},
+		{http.MethodPost, "/api/dlq/purge?destination=not-exists", http.StatusForbidden, ""},
+		{http.MethodPost, "/api/resync?destination=not-exists", http.StatusForbidden, ""},
+	})
+}
+
+func TestRouting_QueuePathNotAllowed(t *testing.T) {
+	t.Parallel()
+
+	srv := httptest.NewServer(web.GetHTTPRouter())
+	defer srv.Close()
+
+	queueURL := fmt.Sprintf("%s/api/queue?value=put:../../etc/passwd", srv.URL)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, queueURL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusBadRequest {
+		t.Fatalf("status %d not OK", res.StatusCode)
 	}
 }
 
@@ -127,7 +393,7 @@ func TestRouting_Sync(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	if string(body) != `{"type":"put","fileName":"tests/test-http.txt","statusCode":200,"statusText":"ok"}` {
+	if string(body) != `{"type":"put","fileName":"tests/test-http.txt","statusCode":200,"statusText":"ok","sha256":"701df70cc797a5d18f69fbf8fa538b15c5adcc06e51de80b446d465696d6c3b5"}` {
 		t.Fatalf("text %s not OK", string(body))
 	}
 
@@ -136,6 +402,691 @@ func TestRouting_Sync(t *testing.T) {
 	}
 }
 
+func TestRouting_SyncSHA256Failed(t *testing.T) {
+	t.Parallel()
+
+	srv := httptest.NewServer(web.GetHTTPSRouter())
+	defer srv.Close()
+
+	queueURL := fmt.Sprintf("%s/api/sync", srv.URL)
+
+	message := api.Message{
+		Type:              "put",
+		FileName:          "tests/test-http-sha256.txt",
+		FileContentBase64: "ZHNkZA==",
+		SHA256:            "wrong",
+	}
+
+	jsonStr, err := json.Marshal(message)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, queueURL, bytes.NewBuffer(jsonStr))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer res.Body.Close()
+
+	results := api.Response{}
+
+	if err := json.NewDecoder(res.Body).Decode(&results); err != nil {
+		t.Fatal(err)
+	}
+
+	if results.StatusCode != api.StatusSHA256Failed {
+		t.Fatalf("status %d not OK", results.StatusCode)
+	}
+
+	// file must not be created in strict mode
+	if _, err := os.Stat(path.Join(*config.Get().DestinationDir, message.FileName)); !os.IsNotExist(err) {
+		t.Fatalf("file must not exists, %v", err)
+	}
+}
+
+func TestRouting_SyncStream(t *testing.T) {
+	t.Parallel()
+
+	srv := httptest.NewServer(web.GetHTTPSRouter())
+	defer srv.Close()
+
+	queueURL := fmt.Sprintf("%s/api/sync", srv.URL)
+
+	message := api.Message{
+		Type:     "put",
+		FileName: "tests/test-http-stream.txt",
+		SHA256:   "701df70cc797a5d18f69fbf8fa538b15c5adcc06e51de80b446d465696d6c3b5",
+		Stream:   true,
+	}
+
+	jsonStr, err := json.Marshal(message)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, queueURL, strings.NewReader("dsdd"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req.Header.Set("Content-Type", api.ContentTypeStream)
+	req.Header.Set(api.HeaderMessage, base64.StdEncoding.EncodeToString(jsonStr))
+
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer res.Body.Close()
+
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(body) != `{"type":"put","fileName":"tests/test-http-stream.txt","statusCode":200,"statusText":"ok","sha256":"701df70cc797a5d18f69fbf8fa538b15c5adcc06e51de80b446d465696d6c3b5"}` {
+		t.Fatalf("text %s not OK", string(body))
+	}
+
+	fileContent, err := ioutil.ReadFile(path.Join(*config.Get().DestinationDir, message.FileName))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(fileContent) != "dsdd" {
+		t.Fatalf("file content %s not OK", string(fileContent))
+	}
+}
+
+func postDelta(t *testing.T, url string, message api.Message, body []byte) api.Response {
+	t.Helper()
+
+	jsonStr, err := json.Marshal(message)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req.Header.Set("Content-Type", api.ContentTypeStream)
+	req.Header.Set(api.HeaderMessage, base64.StdEncoding.EncodeToString(jsonStr))
+
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer res.Body.Close()
+
+	results := api.Response{}
+
+	if err := json.NewDecoder(res.Body).Decode(&results); err != nil {
+		t.Fatal(err)
+	}
+
+	return results
+}
+
+func TestRouting_SyncDelta(t *testing.T) {
+	t.Parallel()
+
+	srv := httptest.NewServer(web.GetHTTPSRouter())
+	defer srv.Close()
+
+	fileName := "tests/test-http-delta.txt"
+	filePath := path.Join(*config.Get().DestinationDir, fileName)
+
+	base := bytes.Repeat([]byte("0123456789abcdef"), 1000)
+	source := append(append([]byte{}, base[:5000]...), []byte("changed")...)
+	source = append(source, base[6000:]...)
+
+	if err := os.MkdirAll(path.Dir(filePath), 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := ioutil.WriteFile(filePath, base, 0o644); err != nil { //nolint:gosec
+		t.Fatal(err)
+	}
+
+	res, err := http.Get(srv.URL + "/api/signature?file=" + fileName) //nolint:noctx
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer res.Body.Close()
+
+	signature := delta.Signature{}
+
+	if err := json.NewDecoder(res.Body).Decode(&signature); err != nil {
+		t.Fatal(err)
+	}
+
+	if signature.Size != int64(len(base)) || len(signature.Blocks) == 0 {
+		t.Fatalf("signature %+v not OK", signature)
+	}
+
+	body := &bytes.Buffer{}
+
+	sha256, err := delta.Write(body, bytes.NewReader(source), &signature)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if body.Len() >= len(source) {
+		t.Fatalf("delta size %d must be less than file size %d", body.Len(), len(source))
+	}
+
+	message := api.Message{
+		Type:     api.MessageTypePatch,
+		FileName: fileName,
+		SHA256:   sha256,
+		Stream:   true,
+		Delta:    &api.Delta{BlockSize: signature.BlockSize, BaseSHA256: signature.SHA256},
+	}
+
+	syncURL := srv.URL + "/api/sync"
+
+	if results := postDelta(t, syncURL, message, body.Bytes()); results.StatusCode != http.StatusOK {
+		t.Fatalf("result %+v not OK", results)
+	}
+
+	fileContent, err := ioutil.ReadFile(filePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(fileContent, source) {
+		t.Fatal("file content not OK")
+	}
+
+	// base file was changed, sender must send full content
+	if results := postDelta(t, syncURL, message, body.Bytes()); results.StatusCode != api.StatusDeltaBaseChanged {
+		t.Fatalf("result %+v not OK", results)
+	}
+
+	res, err = http.Get(srv.URL + "/api/signature?file=tests/not-exists.txt") //nolint:noctx
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusNotFound {
+		t.Fatalf("status %d not OK", res.StatusCode)
+	}
+}
+
+func TestRouting_SyncChunked(t *testing.T) { //nolint:paralleltest
+	srv := httptest.NewTLSServer(web.GetHTTPSRouter())
+	defer srv.Close()
+
+	uploadDir := t.TempDir()
+	destinationDir := t.TempDir()
+	chunkSize := int64(3)
+
+	// source file has the same name on destination
+	defer func(value *string) { config.Get().DestinationDir = value }(config.Get().DestinationDir)
+	config.Get().DestinationDir = &destinationDir
+
+	defer func(value *string) { config.Get().SyncUploadDir = value }(config.Get().SyncUploadDir)
+	config.Get().SyncUploadDir = &uploadDir
+
+	defer func(value *int64) { config.Get().SyncChunkSize = value }(config.Get().SyncChunkSize)
+	config.Get().SyncChunkSize = &chunkSize
+
+	message := api.Message{
+		Type:        api.MessageTypePut,
+		Destination: srv.Listener.Addr().String(),
+		FileName:    "tests/test.txt",
+		Force:       true,
+		Stream:      true,
+		SHA256:      "701df70cc797a5d18f69fbf8fa538b15c5adcc06e51de80b446d465696d6c3b5",
+	}
+
+	if err := api.Send(message); err != nil {
+		t.Fatal(err)
+	}
+
+	fileContent, err := ioutil.ReadFile(path.Join(*config.Get().DestinationDir, message.FileName))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(fileContent) != "dsdd" {
+		t.Fatalf("file content %s not OK", string(fileContent))
+	}
+
+	// committed upload is removed, chunks are kept in store
+	files, err := os.ReadDir(uploadDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(files) != 1 || files[0].Name() != "chunks" {
+		t.Fatalf("upload folder must have only store of chunks, found %v", files)
+	}
+
+	// chunks that are in store are not sent again
+	skipped := testutil.ToFloat64(metrics.SendChunkCounter.WithLabelValues("skipped"))
+
+	if err := api.Send(message); err != nil {
+		t.Fatal(err)
+	}
+
+	if value := testutil.ToFloat64(metrics.SendChunkCounter.WithLabelValues("skipped")); value != skipped+2 {
+		t.Fatalf("chunks must be skipped, skipped %f", value-skipped)
+	}
+
+	// commit of removed upload must be retried
+	message.Upload = strings.Repeat("0", 64)
+
+	jsonStr, err := json.Marshal(message)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, srv.URL+"/api/sync", bytes.NewBuffer(jsonStr))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	res, err := srv.Client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer res.Body.Close()
+
+	results := api.Response{}
+
+	if err := json.NewDecoder(res.Body).Decode(&results); err != nil {
+		t.Fatal(err)
+	}
+
+	if results.StatusCode != api.StatusUploadNotFound {
+		t.Fatalf("result %+v not OK", results)
+	}
+}
+
+func TestRouting_SyncChunkedRepeated(t *testing.T) { //nolint:paralleltest
+	srv := httptest.NewTLSServer(web.GetHTTPSRouter())
+	defer srv.Close()
+
+	uploadDir := t.TempDir()
+	chunkSize := int64(4)
+
+	defer func(value *string) { config.Get().SyncUploadDir = value }(config.Get().SyncUploadDir)
+	config.Get().SyncUploadDir = &uploadDir
+
+	defer func(value *int64) { config.Get().SyncChunkSize = value }(config.Get().SyncChunkSize)
+	config.Get().SyncChunkSize = &chunkSize
+
+	content := "repeated bundle content"
+	chunks := (int64(len(content)) + chunkSize - 1) / chunkSize
+
+	// content is in message, file is not streamed
+	for i, fileName := range []string{"tests/bundle-1.js", "tests/bundle-2.js"} {
+		sent := testutil.ToFloat64(metrics.SendChunkCounter.WithLabelValues("sent"))
+		skipped := testutil.ToFloat64(metrics.SendChunkCounter.WithLabelValues("skipped"))
+
+		message := api.Message{
+			Type:              api.MessageTypePut,
+			Destination:       srv.Listener.Addr().String(),
+			FileName:          fileName,
+			Force:             true,
+			FileContentBase64: base64.StdEncoding.EncodeToString([]byte(content)),
+			SHA256:            utils.NewSHA256([]byte(content)),
+		}
+
+		if err := api.Send(message); err != nil {
+			t.Fatal(err)
+		}
+
+		fileContent, err := ioutil.ReadFile(path.Join(*config.Get().DestinationDir, fileName))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if string(fileContent) != content {
+			t.Fatalf("file content %s not OK", string(fileContent))
+		}
+
+		if i == 0 {
+			continue
+		}
+
+		// all chunks of repeated content are in store
+		if value := testutil.ToFloat64(metrics.SendChunkCounter.WithLabelValues("sent")); value != sent {
+			t.Fatalf("chunks must not be sent, sent %f", value-sent)
+		}
+
+		if value := testutil.ToFloat64(metrics.SendChunkCounter.WithLabelValues("skipped")); value != skipped+float64(chunks) { //nolint:lll
+			t.Fatalf("chunks must be skipped, skipped %f", value-skipped)
+		}
+	}
+}
+
+func TestRouting_SyncChunkedNotSupported(t *testing.T) { //nolint:paralleltest
+	uploads := 0
+	router := web.GetHTTPSRouter()
+
+	// destination of previous version without chunked uploads
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, "/api/upload") {
+			uploads++
+
+			http.NotFound(w, r)
+
+			return
+		}
+
+		router.ServeHTTP(w, r)
+	}))
+	defer srv.Close()
+
+	chunkSize := int64(3)
+
+	defer func(value *int64) { config.Get().SyncChunkSize = value }(config.Get().SyncChunkSize)
+	config.Get().SyncChunkSize = &chunkSize
+
+	message := api.Message{
+		Type:        api.MessageTypePut,
+		Destination: srv.Listener.Addr().String(),
+		FileName:    "tests/test.txt",
+		Force:       true,
+		Stream:      true,
+		SHA256:      "701df70cc797a5d18f69fbf8fa538b15c5adcc06e51de80b446d465696d6c3b5",
+	}
+
+	// file is sent in one request, destination is not asked for upload again
+	for i := 0; i < 2; i++ {
+		if err := api.Send(message); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	fileContent, err := ioutil.ReadFile(path.Join(*config.Get().DestinationDir, message.FileName))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(fileContent) != "dsdd" {
+		t.Fatalf("file content %s not OK", string(fileContent))
+	}
+
+	if uploads != 1 {
+		t.Fatalf("upload must be requested once, requested %d", uploads)
+	}
+}
+
+func TestRouting_SyncCompressed(t *testing.T) { //nolint:paralleltest
+	srv := httptest.NewTLSServer(web.GetHTTPSRouter())
+	defer srv.Close()
+
+	compressSize := int64(1)
+
+	defer func(value *int64) { config.Get().SyncCompressSize = value }(config.Get().SyncCompressSize)
+	config.Get().SyncCompressSize = &compressSize
+
+	content := strings.Repeat("compressed text ", 1000)
+
+	defer func(value *string) { config.Get().SyncCompress = value }(config.Get().SyncCompress)
+
+	for _, encoding := range api.GetEncodings() {
+		encoding := encoding
+		config.Get().SyncCompress = &encoding
+
+		saved := testutil.ToFloat64(metrics.SendCompressSavedBytes.WithLabelValues(encoding))
+
+		message := api.Message{
+			Type:              api.MessageTypePut,
+			Destination:       srv.Listener.Addr().String(),
+			FileName:          "tests/test-compressed-" + encoding + ".txt",
+			Force:             true,
+			FileContentBase64: base64.StdEncoding.EncodeToString([]byte(content)),
+			SHA256:            utils.NewSHA256([]byte(content)),
+		}
+
+		if err := api.Send(message); err != nil {
+			t.Fatal(err)
+		}
+
+		fileContent, err := ioutil.ReadFile(path.Join(*config.Get().DestinationDir, message.FileName))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if string(fileContent) != content {
+			t.Fatalf("%s file content not OK", encoding)
+		}
+
+		if testutil.ToFloat64(metrics.SendCompressSavedBytes.WithLabelValues(encoding)) <= saved {
+			t.Fatalf("%s saved bytes must be reported", encoding)
+		}
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, srv.URL+"/api/sync", strings.NewReader("test"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req.Header.Set(api.HeaderContentEncoding, "unknown")
+
+	res, err := srv.Client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusUnsupportedMediaType {
+		t.Fatalf("status %d not OK", res.StatusCode)
+	}
+}
+
+func TestRouting_SyncCompressedEncodingsFailed(t *testing.T) { //nolint:paralleltest
+	requests := 0
+	router := web.GetHTTPSRouter()
+
+	// destination is restarting on first request of encodings
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/api/encodings" {
+			if requests++; requests == 1 {
+				http.Error(w, "restarting", http.StatusServiceUnavailable)
+
+				return
+			}
+		}
+
+		router.ServeHTTP(w, r)
+	}))
+	defer srv.Close()
+
+	compressSize := int64(1)
+	encoding := "zstd"
+
+	defer func(value *int64) { config.Get().SyncCompressSize = value }(config.Get().SyncCompressSize)
+	config.Get().SyncCompressSize = &compressSize
+
+	defer func(value *string) { config.Get().SyncCompress = value }(config.Get().SyncCompress)
+	config.Get().SyncCompress = &encoding
+
+	content := strings.Repeat("compressed text ", 1000)
+
+	message := api.Message{
+		Type:              api.MessageTypePut,
+		Destination:       srv.Listener.Addr().String(),
+		FileName:          "tests/test-compressed-restart.txt",
+		Force:             true,
+		FileContentBase64: base64.StdEncoding.EncodeToString([]byte(content)),
+		SHA256:            utils.NewSHA256([]byte(content)),
+	}
+
+	saved := testutil.ToFloat64(metrics.SendCompressSavedBytes.WithLabelValues(encoding))
+
+	if err := api.Send(message); err != nil {
+		t.Fatal(err)
+	}
+
+	if testutil.ToFloat64(metrics.SendCompressSavedBytes.WithLabelValues(encoding)) != saved {
+		t.Fatal("payload must not be compressed while encodings are unknown")
+	}
+
+	// failed request of encodings is repeated after a second
+	time.Sleep(time.Second + 100*time.Millisecond)
+
+	if err := api.Send(message); err != nil {
+		t.Fatal(err)
+	}
+
+	if testutil.ToFloat64(metrics.SendCompressSavedBytes.WithLabelValues(encoding)) <= saved {
+		t.Fatal("payload must be compressed after encodings are requested again")
+	}
+
+	if requests != 2 {
+		t.Fatalf("encodings must be requested twice, requested %d", requests)
+	}
+}
+
+func TestRouting_Manifest(t *testing.T) {
+	t.Parallel()
+
+	srv := httptest.NewServer(web.GetHTTPSRouter())
+	defer srv.Close()
+
+	queueURL := fmt.Sprintf("%s/api/manifest", srv.URL)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, queueURL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("status %d not OK", res.StatusCode)
+	}
+
+	manifest := make([]api.ManifestItem, 0)
+
+	if err := json.NewDecoder(res.Body).Decode(&manifest); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, item := range manifest {
+		if len(item.Path) == 0 || len(item.SHA256) == 0 {
+			t.Fatalf("manifest item %+v not OK", item)
+		}
+	}
+}
+
+func TestRouting_Merkle(t *testing.T) {
+	t.Parallel()
+
+	srv := httptest.NewServer(web.GetHTTPSRouter())
+	defer srv.Close()
+
+	queueURL := fmt.Sprintf("%s/api/merkle?path=", srv.URL)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, queueURL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("status %d not OK", res.StatusCode)
+	}
+
+	node := merkle.Node{}
+
+	if err := json.NewDecoder(res.Body).Decode(&node); err != nil {
+		t.Fatal(err)
+	}
+
+	if !node.IsDir || len(node.Hash) == 0 {
+		t.Fatalf("root node %+v not OK", node)
+	}
+}
+
+func TestRouting_DeadLetter(t *testing.T) {
+	t.Parallel()
+
+	srv := httptest.NewServer(web.GetHTTPRouter())
+	defer srv.Close()
+
+	tests := []routeTest{
+		{http.MethodGet, "/api/dlq?type=put", http.StatusOK, "[]"},
+		{http.MethodGet, "/api/dlq?limit=a", http.StatusBadRequest, ""},
+		{http.MethodGet, "/api/dlq/show?id=not-exists", http.StatusNotFound, ""},
+		{http.MethodGet, "/api/dlq/purge?all=true", http.StatusMethodNotAllowed, ""},
+		{http.MethodPost, "/api/dlq/purge", http.StatusBadRequest, ""},
+		{http.MethodPost, "/api/dlq/requeue?destination=10.10.10.10", http.StatusOK, `{"count":0}`},
+		{http.MethodPost, "/api/dlq/purge?all=true", http.StatusOK, `{"count":0}`},
+	}
+
+	checkRoutes(t, srv, tests)
+}
+
+func TestRouting_Destinations(t *testing.T) {
+	t.Parallel()
+
+	srv := httptest.NewServer(web.GetHTTPRouter())
+	defer srv.Close()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, srv.URL+"/api/destinations", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("status %d, must be %d", res.StatusCode, http.StatusOK)
+	}
+
+	result := make([]queue.HealthStatus, 0)
+
+	if err := json.NewDecoder(res.Body).Decode(&result); err != nil {
+		t.Fatal(err)
+	}
+
+	// destinations from sync.address are created on start
+	if len(result) == 0 {
+		t.Fatal("destinations not found")
+	}
+
+	for _, destination := range result {
+		if len(destination.State) == 0 {
+			t.Fatalf("state of %s is empty", destination.Destination)
+		}
+	}
+}
+
 func TestRouting_Healthz(t *testing.T) {
 	t.Parallel()
 